@@ -1,16 +1,21 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bittorrent"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // Ensures gofmt doesn't remove the "os" encoding/json import (feel free to remove this!)
@@ -42,7 +47,14 @@ func main() {
 			os.Exit(1)
 		}
 
-		fmt.Printf("Tracker URL: %s\n", torrent.Announce)
+		if torrent.Announce != "" {
+			fmt.Printf("Tracker URL: %s\n", torrent.Announce)
+		} else {
+			// torrents with only an announce-list (BEP 12) print its tiers
+			for i, tier := range torrent.AnnounceList {
+				fmt.Printf("Tracker Tier %d: %s\n", i+1, strings.Join(tier, " "))
+			}
+		}
 		fmt.Printf("Length: %d\n", torrent.Info.Length)
 		infoHash, err := torrent.InfoHash()
 		if err != nil {
@@ -51,11 +63,23 @@ func main() {
 		} else {
 			fmt.Printf("Info Hash: %x\n", infoHash)
 		}
+		if infoHashV2, ok := torrent.InfoHashV2(); ok {
+			fmt.Printf("Info Hash v2: %x\n", infoHashV2)
+		}
 		fmt.Printf("Piece Length: %d\n", torrent.Info.PieceLength)
 		fmt.Printf("Piece Hashes:\n")
 		for i := 0; i < len(torrent.Info.Pieces); i += 20 {
 			fmt.Printf("%x\n", torrent.Info.Pieces[i:i+20])
 		}
+		if torrent.Info.IsMultiFile() {
+			fmt.Printf("Files:\n")
+			for _, file := range torrent.Info.Files {
+				if file.IsPad() {
+					continue
+				}
+				fmt.Printf("%d %s\n", file.Length, filepath.Join(file.Path...))
+			}
+		}
 		return
 	case "peers":
 		filePath := os.Args[2]
@@ -75,6 +99,43 @@ func main() {
 		for i := 0; i < len(response.Peers); i++ {
 			fmt.Println(response.Peers[i])
 		}
+	case "scrape":
+		// ./your_bittorrent.sh scrape <torrent file|magnet link>
+		source := os.Args[2]
+
+		var infoHash [20]byte
+		var trackers *bittorrent.TrackerList
+		if strings.HasPrefix(source, "magnet:") {
+			magnetLink, err := bittorrent.NewMagnetLink(source, 1234)
+			bittorrent.AssertNotNil(err, "parse error: %s\n", err)
+			infoHash, err = magnetLink.InfoHash()
+			bittorrent.AssertNotNil(err, "fail infohash: %s\n", err)
+			trackers = magnetLink.Trackers
+		} else {
+			torrent, err := bittorrent.NewTorrentFile(source, 1234)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			infoHash, err = torrent.InfoHash()
+			bittorrent.AssertNotNil(err, "fail infohash: %s\n", err)
+			trackers = torrent.Trackers
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		for _, tier := range trackers.Tiers() {
+			for _, trackerURL := range tier {
+				results, err := bittorrent.Scrape(ctx, trackerURL, [][20]byte{infoHash})
+				if err != nil {
+					fmt.Printf("%s: %s\n", trackerURL, err)
+					continue
+				}
+				for _, result := range results {
+					fmt.Printf("%s: seeders=%d leechers=%d downloaded=%d\n", trackerURL, result.Seeders, result.Leechers, result.Completed)
+				}
+			}
+		}
 	case "handshake":
 		filePath := os.Args[2]
 		peerInfo := os.Args[3]
@@ -93,9 +154,11 @@ func main() {
 		}
 		defer conn.Close()
 
+		readerCtx, stopReader := context.WithCancel(context.Background())
+		defer stopReader()
 		incoming := make(chan bittorrent.Message)
 		errs := make(chan error)
-		go bittorrent.HandleIncomingMessages(conn, incoming, errs)
+		go bittorrent.HandleIncomingMessages(readerCtx, conn, incoming, errs)
 
 		infoHash, err := torrent.InfoHash()
 		if err != nil {
@@ -151,32 +214,23 @@ func main() {
 			return
 		}
 
-		totalPieces := len(torrent.Info.Pieces) / 20
-		pieceLength := torrent.Info.PieceLength
-		piece := &bittorrent.Piece{
-			Idx:  pieceIndex,
-			Len:  pieceLength,
-			Path: outputPath,
-			// FIXME: might need to copy these
-			InfoHash: infoHash,
-			PeerId:   torrent.Progress.PeerID,
-		}
-		copy(piece.Hash[:], torrent.Info.Pieces[pieceIndex*20:pieceIndex*20+20])
-
-		if torrentLen := torrent.Info.Length; torrentLen%pieceLength != 0 {
-			if pieceIndex == totalPieces-1 {
-				piece.Len = torrentLen % pieceLength
-			}
+		if pieceIndex < 0 || pieceIndex >= torrent.Info.PieceCount() {
+			fmt.Printf("invalid pieceIndex %d, torrent has %d pieces\n", pieceIndex, torrent.Info.PieceCount())
+			os.Exit(1)
 		}
+		piece := torrent.Info.NewPiece(pieceIndex)
+		piece.Path = outputPath
+		// FIXME: might need to copy these
+		piece.InfoHash = infoHash
+		piece.PeerId = torrent.Progress.PeerID
 
-		todo := make(chan *bittorrent.Piece, 1)
+		picker := bittorrent.NewPiecePicker(torrent.Info.PieceCount(), []*bittorrent.Piece{piece})
 		done := make(chan *bittorrent.Piece)
 		errs := make(chan error)
-		todo <- piece
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		go bittorrent.PeerWorker(ctx, trackerResponse.Peers[0].String(), torrent, todo, done, errs)
+		go bittorrent.PeerWorker(ctx, trackerResponse.Peers[0].String(), torrent, picker, done, errs)
 
 		select {
 		case err := <-errs:
@@ -196,9 +250,10 @@ func main() {
 		os.Exit(1)
 
 	case "download":
-		// ./your_bittorrent.sh download -o /tmp/test.txt sample.torrent
+		// ./your_bittorrent.sh download -o /tmp/test.txt sample.torrent [upload slots]
 		outputPath := os.Args[3]
 		filePath := os.Args[4]
+		uploadSlots := uploadSlotsArg(5)
 
 		torrent, err := bittorrent.NewTorrentFile(filePath, 1234)
 		if err != nil {
@@ -207,109 +262,130 @@ func main() {
 		}
 		log.Printf("Torrent file size: %d", torrent.Info.Length)
 
-		trackerResponse, err := torrent.GetTrackerResponse()
+		infoHash, err := torrent.InfoHash()
 		if err != nil {
 			log.Println(err)
-			os.Exit(1)
+			return
 		}
 
-		infoHash, err := torrent.InfoHash()
+		// for multi-file torrents outputPath is the root directory
+		storage, err := bittorrent.NewFileStorage(outputPath, &torrent.Info)
 		if err != nil {
-			log.Println(err)
-			return
+			fmt.Printf("Failed to create output: %s\n", err)
+			os.Exit(1)
 		}
 
-		totalPieces := len(torrent.Info.Pieces) / 20
+		// the downloaded pieces are uploaded to the peers that connect to us
+		seed, stopSeeding := startSeeding(torrent, storage, uploadSlots)
+		defer stopSeeding()
+
+		totalPieces := torrent.Info.PieceCount()
 		pieces := make([]*bittorrent.Piece, totalPieces)
-		pieceLength := torrent.Info.PieceLength
 		for i := 0; i < totalPieces; i++ {
-			pieces[i] = &bittorrent.Piece{
-				Idx:  i,
-				Len:  pieceLength,
-				Path: outputPath + strconv.Itoa(i),
-				// FIXME: might need to copy these
-				InfoHash: infoHash,
-				PeerId:   torrent.Progress.PeerID,
-			}
-			copy(pieces[i].Hash[:], torrent.Info.Pieces[i*20:i*20+20])
-
-		}
-		if torrentLen := torrent.Info.Length; torrentLen%pieceLength != 0 {
-			lastPiece := pieces[totalPieces-1]
-			lastPiece.Len = torrentLen % pieceLength
+			pieces[i] = torrent.Info.NewPiece(i)
+			pieces[i].Storage = storage
+			// FIXME: might need to copy these
+			pieces[i].InfoHash = infoHash
+			pieces[i].PeerId = torrent.Progress.PeerID
 		}
 
-		todo := make(chan *bittorrent.Piece, totalPieces)
+		// the pieces are picked rarest first, the picker learns the availability from the bitfields of the peers
+		picker := bittorrent.NewPiecePicker(totalPieces, pieces)
 		done := make(chan *bittorrent.Piece, totalPieces)
 		errs := make(chan error, totalPieces)
-		for i := 0; i < totalPieces; i++ {
-			todo <- pieces[i]
-		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		// FIXME: connect only to peers == totalPieces
-		for _, peer := range trackerResponse.Peers {
-			go bittorrent.PeerWorker(ctx, peer.String(), torrent, todo, done, errs)
+
+		// the announcer finds the peers, it sends "stopped" once the download is done
+		swarm := bittorrent.NewSwarm()
+		torrent.Swarm = swarm
+		announcer := bittorrent.NewAnnouncer(torrent, swarm)
+		announcerCtx, stopAnnouncer := context.WithCancel(context.Background())
+		announcerDone := make(chan struct{})
+		go func() {
+			announcer.Run(announcerCtx)
+			close(announcerDone)
+		}()
+
+		// private torrents (BEP 27) only get their peers from the trackers, no DHT and no local service discovery
+		if !torrent.Info.IsPrivate() {
+			go runFallbackDHT(ctx, announcer, infoHash, torrent.Progress.Port)
+
+			lsd, err := bittorrent.NewLSD(bittorrent.LSDMulticastAddr)
+			if err != nil {
+				log.Printf("failed to start local service discovery: %s", err)
+			} else {
+				defer lsd.Close()
+				go lsd.Run(ctx, infoHash, torrent.Progress.Port, swarm)
+			}
 		}
 
 		for doneCnt := 0; doneCnt < totalPieces; {
 			select {
+			case peer := <-swarm.Peers:
+				go bittorrent.PeerWorker(ctx, peer.String(), torrent, picker, done, errs)
+
 			case err := <-errs:
 				// TODO: how to check if there are no more active PeerWorkers -> exit the program!
 				log.Println("Failed PeerWorker:", err)
 
 			case piece := <-done:
-				if piece.Done {
-					doneCnt++
-					log.Printf("piece done: idx=%v\n", piece.Idx)
-				} else {
-					// retry downloading the piece
-					log.Printf("piece failed, retry: idx=%v\n", piece.Idx)
-					piece.Buffer.Reset()
-					todo <- piece
-				}
+				// failed pieces are picked again by the workers
+				doneCnt++
+				seed.SetHave(piece.Idx)
+				log.Printf("piece done: idx=%v\n", piece.Idx)
 			}
 		}
 
-		outputFile, err := os.Create(outputPath)
-		if err != nil {
-			fmt.Printf("Failed to create output file: %s\n", err)
-			os.Exit(1)
-		}
-		defer outputFile.Close()
-		outputWriter := bufio.NewWriter(outputFile)
+		announcer.Completed()
+		stopAnnouncer()
+		<-announcerDone
 
-		// TODO: if we hold the buffers in the pieces, do we need to save pieces before?
-		for i := 0; i < totalPieces; i++ {
-			inputPath := pieces[i].Path
-			inputPiece, err := os.Open(inputPath)
-			if err != nil {
-				fmt.Printf("Failed to open piece file %s: %s\n", inputPath, err)
-				os.Exit(1)
-			}
-			defer inputPiece.Close()
+		fmt.Printf("Downloaded file: %s\n", outputPath)
+	case "seed":
+		// ./your_bittorrent.sh seed sample.torrent ./sample.txt [upload slots]
+		filePath := os.Args[2]
+		contentPath := os.Args[3]
+		uploadSlots := uploadSlotsArg(4)
 
-			inputReader := bufio.NewReader(inputPiece)
+		torrent, err := bittorrent.NewTorrentFile(filePath, 1234)
+		bittorrent.AssertNotNil(err, "failed to read torrent: %s\n", err)
 
-			_, err = outputWriter.ReadFrom(inputReader)
-			if err != nil {
-				fmt.Printf("Failed to read from %s to %s: %s\n", inputPath, outputPath, err)
-				os.Exit(1)
-			}
+		infoHash, err := torrent.InfoHash()
+		bittorrent.AssertNotNil(err, "failed to read torrent: %s\n", err)
 
-			// FIXME: is it ok to delete the piece? What if consequent piece fails?
-			if err = os.Remove(inputPath); err != nil {
-				fmt.Printf("Failed to remove %s: %s\n", inputPath, err)
-				os.Exit(1)
+		storage, err := bittorrent.OpenFileStorage(contentPath, &torrent.Info)
+		bittorrent.AssertNotNil(err, "failed to open content: %s\n", err)
+
+		seed, stopSeeding := startSeeding(torrent, storage, uploadSlots)
+		defer stopSeeding()
+		fmt.Printf("Verified pieces: %d/%d\n", seed.VerifyStorage(), torrent.Info.PieceCount())
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// the peers are not used, they are only found to keep the torrent announced
+		swarm := bittorrent.NewSwarm()
+		torrent.Swarm = swarm
+		announcer := bittorrent.NewAnnouncer(torrent, swarm)
+
+		// private torrents (BEP 27) only get their peers from the trackers, no DHT and no local service discovery
+		if !torrent.Info.IsPrivate() {
+			go runFallbackDHT(ctx, announcer, infoHash, torrent.Progress.Port)
+
+			lsd, err := bittorrent.NewLSD(bittorrent.LSDMulticastAddr)
+			if err != nil {
+				log.Printf("failed to start local service discovery: %s", err)
+			} else {
+				defer lsd.Close()
+				go lsd.Run(ctx, infoHash, torrent.Progress.Port, swarm)
 			}
 		}
-		if err = outputWriter.Flush(); err != nil {
-			fmt.Printf("Failed to flush to output file %s: %s\n", outputPath, err)
-			os.Exit(1)
-		}
 
-		fmt.Printf("Downloaded file: %s\n", outputPath)
+		// runs until interrupted, then "stopped" is sent
+		announcer.Run(ctx)
+		fmt.Printf("Uploaded: %d\n", torrent.Progress.Uploaded.Load())
 	case "magnet_parse":
 		magnetURL := os.Args[2]
 
@@ -324,10 +400,12 @@ func main() {
 		magnetLink, err := bittorrent.NewMagnetLink(magnetURL, 1234)
 		bittorrent.AssertNotNil(err, "parse error: %s\n", err)
 
-		response, err := magnetLink.GetTrackerResponse()
-		bittorrent.AssertNotNil(err, "failed to get tracker response: %s", err)
+		dht, peers := findMagnetPeers(magnetLink)
+		if dht != nil {
+			defer dht.Close()
+		}
 
-		peerInfo := response.Peers[0].String()
+		peerInfo := peers[0].String()
 		conn, err := net.Dial("tcp", peerInfo)
 
 		if err != nil {
@@ -336,9 +414,11 @@ func main() {
 		}
 		defer conn.Close()
 
+		readerCtx, stopReader := context.WithCancel(context.Background())
+		defer stopReader()
 		incoming := make(chan bittorrent.Message)
 		errs := make(chan error)
-		go bittorrent.HandleIncomingMessages(conn, incoming, errs)
+		go bittorrent.HandleIncomingMessages(readerCtx, conn, incoming, errs)
 
 		infoHash, err := magnetLink.InfoHash()
 		if err != nil {
@@ -390,13 +470,11 @@ func main() {
 						extended := bittorrent.NewExtendedMessage()
 						//fmt.Printf("Sending l=%d: %x \n", extended.Len, extended.Data)
 
-						d := map[string]interface{}{
-							"m": map[string]interface{}{
-								"ut_metadata": 1,
-								"ut_pex":      2,
-							},
+						msg, err := extended.AsExtended().AddDict(bittorrent.NewExtensionHandshake())
+						if err != nil {
+							fmt.Println("fail to encode extended:", err)
+							os.Exit(1)
 						}
-						msg := extended.AsExtended().AddDict(d)
 						//fmt.Printf("Sending l=%d: %x \n", msg.Len, msg.Data)
 						_, err = msg.WriteTo(conn)
 						if err != nil {
@@ -406,14 +484,13 @@ func main() {
 					}
 
 				case bittorrent.EXTENDED:
-					decoded, err := bittorrent.DecodeBencode(string(in.AsExtended().ExtensionDict()))
-					if err != nil {
+					var handshake bittorrent.ExtensionHandshake
+					if _, err := in.AsExtended().UnmarshalDict(&handshake); err != nil {
 						panic("Failed to decode dict:" + err.Error())
 					}
 
 					fmt.Printf("Peer ID: %x\n", state.peerId)
-					mDict := decoded.(map[string]interface{})["m"].(map[string]interface{})
-					fmt.Printf("Peer Metadata Extension ID: %d\n", mDict["ut_metadata"])
+					fmt.Printf("Peer Metadata Extension ID: %d\n", handshake.M[bittorrent.MetadataExtensionName])
 					return
 				default:
 					panic("unhandled default case")
@@ -430,10 +507,12 @@ func main() {
 		magnetLink, err := bittorrent.NewMagnetLink(magnetURL, 1234)
 		bittorrent.AssertNotNil(err, "parse error: %s\n", err)
 
-		response, err := magnetLink.GetTrackerResponse()
-		bittorrent.AssertNotNil(err, "failed to get tracker response: %s", err)
+		dht, peers := findMagnetPeers(magnetLink)
+		if dht != nil {
+			defer dht.Close()
+		}
 
-		peerInfo := response.Peers[0].String()
+		peerInfo := peers[0].String()
 		conn, err := net.Dial("tcp", peerInfo)
 
 		if err != nil {
@@ -442,9 +521,11 @@ func main() {
 		}
 		defer conn.Close()
 
+		readerCtx, stopReader := context.WithCancel(context.Background())
+		defer stopReader()
 		incoming := make(chan bittorrent.Message)
 		errs := make(chan error)
-		go bittorrent.HandleIncomingMessages(conn, incoming, errs)
+		go bittorrent.HandleIncomingMessages(readerCtx, conn, incoming, errs)
 
 		infoHash, err := magnetLink.InfoHash()
 		if err != nil {
@@ -468,13 +549,7 @@ func main() {
 			peerExtended   bool
 			peerId         [20]byte
 			peerMetadataId int
-			myM            map[string]interface{}
-		}{
-			myM: map[string]interface{}{
-				"ut_metadata": 1,
-				"ut_pex":      2,
-			},
-		}
+		}{}
 		_ = state
 
 		for {
@@ -503,8 +578,11 @@ func main() {
 						extended := bittorrent.NewExtendedMessage()
 						//fmt.Printf("Sending l=%myM: %x \n", extended.Len, extended.Data)
 
-						msg := extended.AsExtended().AddDict(map[string]interface{}{
-							"m": state.myM})
+						msg, err := extended.AsExtended().AddDict(bittorrent.NewExtensionHandshake())
+						if err != nil {
+							fmt.Println("fail to encode extended:", err)
+							os.Exit(1)
+						}
 
 						//fmt.Printf("Sending l=%myM: %x \n", msg.Len, msg.Data)
 
@@ -516,61 +594,53 @@ func main() {
 					}
 
 				case bittorrent.EXTENDED:
-					decoded, err := bittorrent.DecodeBencode(string(in.AsExtended().ExtensionDict()))
-					if err != nil {
-						panic("Failed to decode dict:" + err.Error())
-					}
-
 					switch id := in.AsExtended().ExtensionMessageId(); id {
 					case 0:
 						// handshake
-						mDict := decoded.(map[string]interface{})["m"].(map[string]interface{})
-						state.peerMetadataId = mDict["ut_metadata"].(int)
+						var handshake bittorrent.ExtensionHandshake
+						if _, err := in.AsExtended().UnmarshalDict(&handshake); err != nil {
+							panic("Failed to decode dict:" + err.Error())
+						}
+						state.peerMetadataId = handshake.M[bittorrent.MetadataExtensionName]
 						fmt.Printf("Peer Metadata Extension ID: %d\n", state.peerMetadataId)
-						fmt.Printf("Dict: %q\n", decoded)
+						fmt.Printf("Dict: %+v\n", handshake)
 
 						// send metadata request
 						msg := bittorrent.NewExtendedMessage()
 						msg.SetExtensionMessageId(byte(state.peerMetadataId))
-						msg = msg.AddDict(map[string]interface{}{
-							"msg_type": 0,
-							"piece":    0,
+						msg, err := msg.AddDict(bittorrent.MetadataMessage{
+							MsgType: bittorrent.MetadataRequest,
+							Piece:   0,
 						})
-						_, err := msg.WriteTo(conn)
+						if err != nil {
+							fmt.Println("fail to encode extended:", err)
+							os.Exit(1)
+						}
+						_, err = msg.WriteTo(conn)
 						if err != nil {
 							fmt.Println("fail to send extended:", err)
 							os.Exit(1)
 						}
 
-					case byte(state.myM["ut_metadata"].(int)):
-						fmt.Printf("Received my ut_metadata id: %d\n", id)
-						fmt.Printf("LEN=%d Dict: %q\n", in.Len, decoded)
-						msgType := decoded.(map[string]interface{})["msg_type"].(int)
-						piece := decoded.(map[string]interface{})["piece"].(int)
-						totalSize := decoded.(map[string]interface{})["total_size"].(int)
-
-						lenBendict := len(bittorrent.BencodeDict(decoded.(map[string]interface{})))
-
-						fmt.Printf("%s \n", in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:])
-						fmt.Printf("msg_type=%d, piece=%d, total_size=%d\n", msgType, piece, totalSize)
-
-						infoDict, err := bittorrent.DecodeBencode(string(in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:]))
+					case bittorrent.MetadataExtensionId:
+						var header bittorrent.MetadataMessage
+						metadata, err := in.AsExtended().UnmarshalDict(&header)
 						if err != nil {
 							panic("Failed to decode dict:" + err.Error())
 						}
 
-						fmt.Printf("infoDict: %q\n", infoDict)
+						fmt.Printf("Received my ut_metadata id: %d\n", id)
+						fmt.Printf("LEN=%d Dict: %+v\n", in.Len, header)
+						fmt.Printf("%s \n", metadata)
+						fmt.Printf("msg_type=%d, piece=%d, total_size=%d\n", header.MsgType, header.Piece, header.TotalSize)
 
-						calcInfoHash := sha1.Sum(in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:])
+						calcInfoHash := sha1.Sum(metadata)
 						fmt.Printf("shasum: %x\n", calcInfoHash)
 						fmt.Printf("infoHash: %x\n", infoHash)
 
-						info := infoDict.(map[string]interface{})
-						fileInfo := bittorrent.TorrentFileInfo{
-							Length:      info["length"].(int),
-							Pieces:      info["pieces"].(string),
-							Name:        info["name"].(string),
-							PieceLength: info["piece length"].(int),
+						fileInfo, err := bittorrent.NewTorrentFileInfo(metadata)
+						if err != nil {
+							panic("Failed to parse info dict:" + err.Error())
 						}
 
 						fmt.Printf("Tracker URL: %s\n", magnetLink.TrackerUrl())
@@ -610,10 +680,12 @@ func main() {
 		magnetLink, err := bittorrent.NewMagnetLink(magnetURL, 1234)
 		bittorrent.AssertNotNil(err, "parse error: %s\n", err)
 
-		response, err := magnetLink.GetTrackerResponse()
-		bittorrent.AssertNotNil(err, "failed to get tracker response: %s", err)
+		dht, peers := findMagnetPeers(magnetLink)
+		if dht != nil {
+			defer dht.Close()
+		}
 
-		peerInfo := response.Peers[0].String()
+		peerInfo := peers[0].String()
 		conn, err := net.Dial("tcp", peerInfo)
 
 		if err != nil {
@@ -622,8 +694,11 @@ func main() {
 		}
 		defer conn.Close()
 
+		// the reader keeps running for the download that continues with this connection
+		readerCtx, stopReader := context.WithCancel(context.Background())
+		defer stopReader()
 		handler := bittorrent.NewPeerStateHandler()
-		go bittorrent.HandleIncomingMessages(conn, handler.Incoming, handler.Errs)
+		go bittorrent.HandleIncomingMessages(readerCtx, conn, handler.Incoming, handler.Errs)
 
 		infoHash, err := magnetLink.InfoHash()
 		if err != nil {
@@ -647,24 +722,10 @@ func main() {
 			peerExtended   bool
 			peerId         [20]byte
 			peerMetadataId int
-			myM            map[string]interface{}
-		}{
-			myM: map[string]interface{}{
-				"ut_metadata": 1,
-				"ut_pex":      2,
-			},
-		}
+		}{}
 
-		// stub torrent file
-		torrent := bittorrent.TorrentFile{
-			FilePath: "non-existent",
-			Announce: magnetLink.TrackerUrl(),
-			Progress: bittorrent.TorrentProgress{
-				Compact: 1,
-				Port:    magnetLink.Port,
-				PeerID:  magnetLink.PeerId,
-			},
-		}
+		// created once the metadata is received
+		var torrent *bittorrent.TorrentFile
 
 		for {
 			select {
@@ -687,13 +748,26 @@ func main() {
 						panic("Bitfield already received")
 					}
 					state.doneBitfield = true
+					// the download continues with this connection, the bitfield is validated once the info is known
+					decoded, err := bittorrent.DecodeMessage(&in)
+					if err != nil {
+						fmt.Println("invalid bitfield:", err)
+						os.Exit(1)
+					}
+					if err := handler.PeerState.SetBitfield(decoded.(bittorrent.BitfieldMsg).Bitfield); err != nil {
+						fmt.Println("invalid bitfield:", err)
+						os.Exit(1)
+					}
 					//send the extension handshake
 					if state.peerExtended {
 						extended := bittorrent.NewExtendedMessage()
 						//fmt.Printf("Sending l=%myM: %x \n", extended.Len, extended.Data)
 
-						msg := extended.AsExtended().AddDict(map[string]interface{}{
-							"m": state.myM})
+						msg, err := extended.AsExtended().AddDict(bittorrent.NewExtensionHandshake())
+						if err != nil {
+							fmt.Println("fail to encode extended:", err)
+							os.Exit(1)
+						}
 
 						//fmt.Printf("Sending l=%myM: %x \n", msg.Len, msg.Data)
 
@@ -705,61 +779,53 @@ func main() {
 					}
 
 				case bittorrent.EXTENDED:
-					decoded, err := bittorrent.DecodeBencode(string(in.AsExtended().ExtensionDict()))
-					if err != nil {
-						panic("Failed to decode dict:" + err.Error())
-					}
-
 					switch id := in.AsExtended().ExtensionMessageId(); id {
 					case 0:
 						// handshake
-						mDict := decoded.(map[string]interface{})["m"].(map[string]interface{})
-						state.peerMetadataId = mDict["ut_metadata"].(int)
+						var handshake bittorrent.ExtensionHandshake
+						if _, err := in.AsExtended().UnmarshalDict(&handshake); err != nil {
+							panic("Failed to decode dict:" + err.Error())
+						}
+						state.peerMetadataId = handshake.M[bittorrent.MetadataExtensionName]
 						fmt.Printf("Peer Metadata Extension ID: %d\n", state.peerMetadataId)
-						fmt.Printf("Dict: %q\n", decoded)
+						fmt.Printf("Dict: %+v\n", handshake)
 
 						// send metadata request
 						msg := bittorrent.NewExtendedMessage()
 						msg.SetExtensionMessageId(byte(state.peerMetadataId))
-						msg = msg.AddDict(map[string]interface{}{
-							"msg_type": 0,
-							"piece":    0,
+						msg, err := msg.AddDict(bittorrent.MetadataMessage{
+							MsgType: bittorrent.MetadataRequest,
+							Piece:   0,
 						})
-						_, err := msg.WriteTo(conn)
+						if err != nil {
+							fmt.Println("fail to encode extended:", err)
+							os.Exit(1)
+						}
+						_, err = msg.WriteTo(conn)
 						if err != nil {
 							fmt.Println("fail to send extended:", err)
 							os.Exit(1)
 						}
 
-					case byte(state.myM["ut_metadata"].(int)):
-						fmt.Printf("Received my ut_metadata id: %d\n", id)
-						fmt.Printf("LEN=%d Dict: %q\n", in.Len, decoded)
-						msgType := decoded.(map[string]interface{})["msg_type"].(int)
-						piece := decoded.(map[string]interface{})["piece"].(int)
-						totalSize := decoded.(map[string]interface{})["total_size"].(int)
-
-						lenBendict := len(bittorrent.BencodeDict(decoded.(map[string]interface{})))
-
-						fmt.Printf("%s \n", in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:])
-						fmt.Printf("msg_type=%d, piece=%d, total_size=%d\n", msgType, piece, totalSize)
-
-						infoDict, err := bittorrent.DecodeBencode(string(in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:]))
+					case bittorrent.MetadataExtensionId:
+						var header bittorrent.MetadataMessage
+						metadata, err := in.AsExtended().UnmarshalDict(&header)
 						if err != nil {
 							panic("Failed to decode dict:" + err.Error())
 						}
 
-						fmt.Printf("infoDict: %q\n", infoDict)
+						fmt.Printf("Received my ut_metadata id: %d\n", id)
+						fmt.Printf("LEN=%d Dict: %+v\n", in.Len, header)
+						fmt.Printf("%s \n", metadata)
+						fmt.Printf("msg_type=%d, piece=%d, total_size=%d\n", header.MsgType, header.Piece, header.TotalSize)
 
-						calcInfoHash := sha1.Sum(in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:])
+						calcInfoHash := sha1.Sum(metadata)
 						fmt.Printf("shasum: %x\n", calcInfoHash)
 						fmt.Printf("infoHash: %x\n", infoHash)
 
-						info := infoDict.(map[string]interface{})
-						fileInfo := bittorrent.TorrentFileInfo{
-							Length:      info["length"].(int),
-							Pieces:      info["pieces"].(string),
-							Name:        info["name"].(string),
-							PieceLength: info["piece length"].(int),
+						fileInfo, err := bittorrent.NewTorrentFileInfo(metadata)
+						if err != nil {
+							panic("Failed to parse info dict:" + err.Error())
 						}
 
 						fmt.Printf("Tracker URL: %s\n", magnetLink.TrackerUrl())
@@ -771,7 +837,12 @@ func main() {
 							fmt.Printf("%x\n", fileInfo.Pieces[i:i+20])
 						}
 
-						torrent.Info = fileInfo
+						torrent, err = bittorrent.NewTorrentFileFromInfo(metadata, magnetLink.TrackerUrl(), magnetLink.Port)
+						if err != nil {
+							panic("Failed to parse info dict:" + err.Error())
+						}
+						torrent.Progress.PeerID = magnetLink.PeerId
+						torrent.Trackers = magnetLink.Trackers
 
 						goto ReadyToDownload
 					default:
@@ -791,35 +862,26 @@ func main() {
 
 	ReadyToDownload:
 
-		totalPieces := len(torrent.Info.Pieces) / 20
-		pieceLength := torrent.Info.PieceLength
-		piece := &bittorrent.Piece{
-			Idx:  pieceIndex,
-			Len:  pieceLength,
-			Path: outputPath,
-			// FIXME: might need to copy these
-			InfoHash: infoHash,
-			PeerId:   torrent.Progress.PeerID,
-		}
-		copy(piece.Hash[:], torrent.Info.Pieces[pieceIndex*20:pieceIndex*20+20])
-
-		if torrentLen := torrent.Info.Length; torrentLen%pieceLength != 0 {
-			if pieceIndex == totalPieces-1 {
-				piece.Len = torrentLen % pieceLength
-			}
+		if pieceIndex < 0 || pieceIndex >= torrent.Info.PieceCount() {
+			fmt.Printf("invalid pieceIndex %d, torrent has %d pieces\n", pieceIndex, torrent.Info.PieceCount())
+			os.Exit(1)
 		}
+		piece := torrent.Info.NewPiece(pieceIndex)
+		piece.Path = outputPath
+		// FIXME: might need to copy these
+		piece.InfoHash = infoHash
+		piece.PeerId = torrent.Progress.PeerID
 
-		todo := make(chan *bittorrent.Piece, 1)
+		picker := bittorrent.NewPiecePicker(torrent.Info.PieceCount(), []*bittorrent.Piece{piece})
 		done := make(chan *bittorrent.Piece)
 		errs := make(chan error)
-		todo <- piece
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
 		// handshake is done beforehand
 		handler.PeerState.Done_handshake = true
-		go bittorrent.PeerWorkerInitialized(ctx, peerInfo, &torrent, conn, handler, todo, done, errs)
+		go bittorrent.PeerWorkerInitialized(ctx, peerInfo, torrent, conn, handler, picker, done, errs)
 
 		select {
 		case err := <-errs:
@@ -838,17 +900,20 @@ func main() {
 		}
 		os.Exit(1)
 	case "magnet_download":
-		// ./your_bittorrent.sh magnet_download -o ./sample <magnet_link>
+		// ./your_bittorrent.sh magnet_download -o ./sample <magnet_link> [upload slots]
 		outputPath := os.Args[3]
 		magnetURL := os.Args[4]
+		uploadSlots := uploadSlotsArg(5)
 
 		magnetLink, err := bittorrent.NewMagnetLink(magnetURL, 1234)
 		bittorrent.AssertNotNil(err, "parse error: %s\n", err)
 
-		response, err := magnetLink.GetTrackerResponse()
-		bittorrent.AssertNotNil(err, "failed to get tracker response: %s", err)
+		dht, peers := findMagnetPeers(magnetLink)
+		if dht != nil {
+			defer dht.Close()
+		}
 
-		peerInfo := response.Peers[0].String()
+		peerInfo := peers[0].String()
 		conn, err := net.Dial("tcp", peerInfo)
 
 		if err != nil {
@@ -857,8 +922,11 @@ func main() {
 		}
 		defer conn.Close()
 
+		// the reader keeps running for the download that continues with this connection
+		readerCtx, stopReader := context.WithCancel(context.Background())
+		defer stopReader()
 		handler := bittorrent.NewPeerStateHandler()
-		go bittorrent.HandleIncomingMessages(conn, handler.Incoming, handler.Errs)
+		go bittorrent.HandleIncomingMessages(readerCtx, conn, handler.Incoming, handler.Errs)
 
 		infoHash, err := magnetLink.InfoHash()
 		if err != nil {
@@ -882,24 +950,10 @@ func main() {
 			peerExtended   bool
 			peerId         [20]byte
 			peerMetadataId int
-			myM            map[string]interface{}
-		}{
-			myM: map[string]interface{}{
-				"ut_metadata": 1,
-				"ut_pex":      2,
-			},
-		}
+		}{}
 
-		// stub torrent file
-		torrent := bittorrent.TorrentFile{
-			FilePath: "non-existent",
-			Announce: magnetLink.TrackerUrl(),
-			Progress: bittorrent.TorrentProgress{
-				Compact: 1,
-				Port:    magnetLink.Port,
-				PeerID:  magnetLink.PeerId,
-			},
-		}
+		// created once the metadata is received
+		var torrent *bittorrent.TorrentFile
 
 		for {
 			select {
@@ -922,13 +976,26 @@ func main() {
 						panic("Bitfield already received")
 					}
 					state.doneBitfield = true
+					// the download continues with this connection, the bitfield is validated once the info is known
+					decoded, err := bittorrent.DecodeMessage(&in)
+					if err != nil {
+						fmt.Println("invalid bitfield:", err)
+						os.Exit(1)
+					}
+					if err := handler.PeerState.SetBitfield(decoded.(bittorrent.BitfieldMsg).Bitfield); err != nil {
+						fmt.Println("invalid bitfield:", err)
+						os.Exit(1)
+					}
 					//send the extension handshake
 					if state.peerExtended {
 						extended := bittorrent.NewExtendedMessage()
 						//fmt.Printf("Sending l=%myM: %x \n", extended.Len, extended.Data)
 
-						msg := extended.AsExtended().AddDict(map[string]interface{}{
-							"m": state.myM})
+						msg, err := extended.AsExtended().AddDict(bittorrent.NewExtensionHandshake())
+						if err != nil {
+							fmt.Println("fail to encode extended:", err)
+							os.Exit(1)
+						}
 
 						//fmt.Printf("Sending l=%myM: %x \n", msg.Len, msg.Data)
 
@@ -940,61 +1007,55 @@ func main() {
 					}
 
 				case bittorrent.EXTENDED:
-					decoded, err := bittorrent.DecodeBencode(string(in.AsExtended().ExtensionDict()))
-					if err != nil {
-						panic("Failed to decode dict:" + err.Error())
-					}
-
 					switch id := in.AsExtended().ExtensionMessageId(); id {
 					case 0:
 						// handshake
-						mDict := decoded.(map[string]interface{})["m"].(map[string]interface{})
-						state.peerMetadataId = mDict["ut_metadata"].(int)
+						var handshake bittorrent.ExtensionHandshake
+						if _, err := in.AsExtended().UnmarshalDict(&handshake); err != nil {
+							panic("Failed to decode dict:" + err.Error())
+						}
+						state.peerMetadataId = handshake.M[bittorrent.MetadataExtensionName]
+						// the download continues with this connection, peer exchange needs the ids
+						handler.PeerState.Extensions = handshake.M
 						fmt.Printf("Peer Metadata Extension ID: %d\n", state.peerMetadataId)
-						fmt.Printf("Dict: %q\n", decoded)
+						fmt.Printf("Dict: %+v\n", handshake)
 
 						// send metadata request
 						msg := bittorrent.NewExtendedMessage()
 						msg.SetExtensionMessageId(byte(state.peerMetadataId))
-						msg = msg.AddDict(map[string]interface{}{
-							"msg_type": 0,
-							"piece":    0,
+						msg, err := msg.AddDict(bittorrent.MetadataMessage{
+							MsgType: bittorrent.MetadataRequest,
+							Piece:   0,
 						})
-						_, err := msg.WriteTo(conn)
+						if err != nil {
+							fmt.Println("fail to encode extended:", err)
+							os.Exit(1)
+						}
+						_, err = msg.WriteTo(conn)
 						if err != nil {
 							fmt.Println("fail to send extended:", err)
 							os.Exit(1)
 						}
 
-					case byte(state.myM["ut_metadata"].(int)):
-						fmt.Printf("Received my ut_metadata id: %d\n", id)
-						fmt.Printf("LEN=%d Dict: %q\n", in.Len, decoded)
-						msgType := decoded.(map[string]interface{})["msg_type"].(int)
-						piece := decoded.(map[string]interface{})["piece"].(int)
-						totalSize := decoded.(map[string]interface{})["total_size"].(int)
-
-						lenBendict := len(bittorrent.BencodeDict(decoded.(map[string]interface{})))
-
-						fmt.Printf("%s \n", in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:])
-						fmt.Printf("msg_type=%d, piece=%d, total_size=%d\n", msgType, piece, totalSize)
-
-						infoDict, err := bittorrent.DecodeBencode(string(in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:]))
+					case bittorrent.MetadataExtensionId:
+						var header bittorrent.MetadataMessage
+						metadata, err := in.AsExtended().UnmarshalDict(&header)
 						if err != nil {
 							panic("Failed to decode dict:" + err.Error())
 						}
 
-						fmt.Printf("infoDict: %q\n", infoDict)
+						fmt.Printf("Received my ut_metadata id: %d\n", id)
+						fmt.Printf("LEN=%d Dict: %+v\n", in.Len, header)
+						fmt.Printf("%s \n", metadata)
+						fmt.Printf("msg_type=%d, piece=%d, total_size=%d\n", header.MsgType, header.Piece, header.TotalSize)
 
-						calcInfoHash := sha1.Sum(in.Data[bittorrent.OFF_EXTENDED_DICT+lenBendict:])
+						calcInfoHash := sha1.Sum(metadata)
 						fmt.Printf("shasum: %x\n", calcInfoHash)
 						fmt.Printf("infoHash: %x\n", infoHash)
 
-						info := infoDict.(map[string]interface{})
-						fileInfo := bittorrent.TorrentFileInfo{
-							Length:      info["length"].(int),
-							Pieces:      info["pieces"].(string),
-							Name:        info["name"].(string),
-							PieceLength: info["piece length"].(int),
+						fileInfo, err := bittorrent.NewTorrentFileInfo(metadata)
+						if err != nil {
+							panic("Failed to parse info dict:" + err.Error())
 						}
 
 						fmt.Printf("Tracker URL: %s\n", magnetLink.TrackerUrl())
@@ -1006,7 +1067,12 @@ func main() {
 							fmt.Printf("%x\n", fileInfo.Pieces[i:i+20])
 						}
 
-						torrent.Info = fileInfo
+						torrent, err = bittorrent.NewTorrentFileFromInfo(metadata, magnetLink.TrackerUrl(), magnetLink.Port)
+						if err != nil {
+							panic("Failed to parse info dict:" + err.Error())
+						}
+						torrent.Progress.PeerID = magnetLink.PeerId
+						torrent.Trackers = magnetLink.Trackers
 
 						goto ReadyToDownloadFile
 					default:
@@ -1028,95 +1094,95 @@ func main() {
 
 		fmt.Printf("Ready to Download file\n")
 
-		totalPieces := len(torrent.Info.Pieces) / 20
+		// for multi-file torrents outputPath is the root directory
+		storage, err := bittorrent.NewFileStorage(outputPath, &torrent.Info)
+		if err != nil {
+			fmt.Printf("Failed to create output: %s\n", err)
+			os.Exit(1)
+		}
+
+		// the downloaded pieces are uploaded to the peers that connect to us
+		seed, stopSeeding := startSeeding(torrent, storage, uploadSlots)
+		defer stopSeeding()
+
+		totalPieces := torrent.Info.PieceCount()
 		pieces := make([]*bittorrent.Piece, totalPieces)
-		pieceLength := torrent.Info.PieceLength
 		for i := 0; i < totalPieces; i++ {
-			pieces[i] = &bittorrent.Piece{
-				Idx:  i,
-				Len:  pieceLength,
-				Path: outputPath + strconv.Itoa(i),
-				// FIXME: might need to copy these
-				InfoHash: infoHash,
-				PeerId:   torrent.Progress.PeerID,
-			}
-			copy(pieces[i].Hash[:], torrent.Info.Pieces[i*20:i*20+20])
-
-		}
-		if torrentLen := torrent.Info.Length; torrentLen%pieceLength != 0 {
-			lastPiece := pieces[totalPieces-1]
-			lastPiece.Len = torrentLen % pieceLength
+			pieces[i] = torrent.Info.NewPiece(i)
+			pieces[i].Storage = storage
+			// FIXME: might need to copy these
+			pieces[i].InfoHash = infoHash
+			pieces[i].PeerId = torrent.Progress.PeerID
 		}
 
-		todo := make(chan *bittorrent.Piece, totalPieces)
+		// the pieces are picked rarest first, the picker learns the availability from the bitfields of the peers
+		picker := bittorrent.NewPiecePicker(totalPieces, pieces)
 		done := make(chan *bittorrent.Piece, totalPieces)
 		errs := make(chan error, totalPieces)
-		for i := 0; i < totalPieces; i++ {
-			todo <- pieces[i]
-		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
+		// more peers are found by the announcer, it sends "stopped" once the download is done
+		swarm := bittorrent.NewSwarm()
+		torrent.Swarm = swarm
+		announcer := bittorrent.NewAnnouncer(torrent, swarm)
+		announcerCtx, stopAnnouncer := context.WithCancel(context.Background())
+		announcerDone := make(chan struct{})
+		go func() {
+			announcer.Run(announcerCtx)
+			close(announcerDone)
+		}()
+
+		// private torrents (BEP 27) only get their peers from the trackers, no DHT and no local service discovery
+		if !torrent.Info.IsPrivate() {
+			if dht == nil {
+				if dht, err = bittorrent.NewDHT(":0"); err != nil {
+					log.Printf("failed to start dht: %s", err)
+				} else {
+					defer dht.Close()
+				}
+			}
+			if dht != nil {
+				go dht.Run(ctx, infoHash, torrent.Progress.Port, swarm)
+			}
+
+			lsd, err := bittorrent.NewLSD(bittorrent.LSDMulticastAddr)
+			if err != nil {
+				log.Printf("failed to start local service discovery: %s", err)
+			} else {
+				defer lsd.Close()
+				go lsd.Run(ctx, infoHash, torrent.Progress.Port, swarm)
+			}
+		}
+
 		// handshake is done beforehand
 		handler.PeerState.Done_handshake = true
-		go bittorrent.PeerWorkerInitialized(ctx, peerInfo, &torrent, conn, handler, todo, done, errs)
+		go bittorrent.PeerWorkerInitialized(ctx, peerInfo, torrent, conn, handler, picker, done, errs)
 
 		for doneCnt := 0; doneCnt < totalPieces; {
 			select {
+			case peer := <-swarm.Peers:
+				// already connected to the first peer
+				if peer.String() != peerInfo {
+					go bittorrent.PeerWorker(ctx, peer.String(), torrent, picker, done, errs)
+				}
+
 			case err := <-errs:
 				// TODO: how to check if there are no more active PeerWorkers -> exit the program!
 				log.Println("Failed PeerWorker:", err)
 
 			case piece := <-done:
-				if piece.Done {
-					doneCnt++
-					log.Printf("piece done: idx=%v\n", piece.Idx)
-				} else {
-					// retry downloading the piece
-					log.Printf("piece failed, retry: idx=%v\n", piece.Idx)
-					piece.Buffer.Reset()
-					todo <- piece
-				}
+				// failed pieces are picked again by the workers
+				doneCnt++
+				seed.SetHave(piece.Idx)
+				log.Printf("piece done: idx=%v\n", piece.Idx)
 			}
 		}
 
-		outputFile, err := os.Create(outputPath)
-		if err != nil {
-			fmt.Printf("Failed to create output file: %s\n", err)
-			os.Exit(1)
-		}
-		defer outputFile.Close()
-		outputWriter := bufio.NewWriter(outputFile)
-
-		// TODO: if we hold the buffers in the pieces, do we need to save pieces before?
-		for i := 0; i < totalPieces; i++ {
-			inputPath := pieces[i].Path
-			inputPiece, err := os.Open(inputPath)
-			if err != nil {
-				fmt.Printf("Failed to open piece file %s: %s\n", inputPath, err)
-				os.Exit(1)
-			}
-			defer inputPiece.Close()
-
-			inputReader := bufio.NewReader(inputPiece)
-
-			_, err = outputWriter.ReadFrom(inputReader)
-			if err != nil {
-				fmt.Printf("Failed to read from %s to %s: %s\n", inputPath, outputPath, err)
-				os.Exit(1)
-			}
-
-			// FIXME: is it ok to delete the piece? What if consequent piece fails?
-			if err = os.Remove(inputPath); err != nil {
-				fmt.Printf("Failed to remove %s: %s\n", inputPath, err)
-				os.Exit(1)
-			}
-		}
-		if err = outputWriter.Flush(); err != nil {
-			fmt.Printf("Failed to flush to output file %s: %s\n", outputPath, err)
-			os.Exit(1)
-		}
+		announcer.Completed()
+		stopAnnouncer()
+		<-announcerDone
 
 		fmt.Printf("Downloaded file: %s\n", outputPath)
 
@@ -1143,3 +1209,77 @@ func main() {
 //   * Keep track of blocks received
 //   * On connection error, report the progress to main instance
 //   * When full piece is downloaded, notify main instance and wait for further messages
+
+// findMagnetPeers asks the trackers of the magnet link for peers, the DHT is only started when they know none.
+// The returned DHT is nil when the trackers knew peers, the caller closes it otherwise.
+func findMagnetPeers(magnetLink *bittorrent.MagnetLink) (*bittorrent.DHT, []bittorrent.TrackerPeer) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	peers, dht, err := magnetLink.FindPeers(ctx, func() (*bittorrent.DHT, error) {
+		return bittorrent.NewDHT(":0")
+	})
+	bittorrent.AssertNotNil(err, "failed to find peers: %s\n", err)
+
+	return dht, peers
+}
+
+// runFallbackDHT starts the DHT as a peer source of the torrent when the first announce brought no peers,
+// it runs until ctx is canceled.
+func runFallbackDHT(ctx context.Context, announcer *bittorrent.Announcer, infoHash [20]byte, port int) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-announcer.Announced():
+	}
+	if announcer.FirstPeers() > 0 {
+		return
+	}
+
+	dht, err := bittorrent.NewDHT(":0")
+	if err != nil {
+		log.Printf("failed to start dht: %s", err)
+		return
+	}
+	defer dht.Close()
+	dht.Run(ctx, infoHash, port, announcer.Swarm)
+}
+
+// startSeeding serves the verified pieces of the torrent on its announced port to uploadSlots unchoked peers
+// and one optimistic unchoke, the returned function stops it.
+// The download continues without uploading when the port is not available.
+func startSeeding(torrent *bittorrent.TorrentFile, storage io.ReaderAt, uploadSlots int) (*bittorrent.Seed, func()) {
+	seed := bittorrent.NewSeed(torrent, storage, uploadSlots)
+	// the download rates of our peer workers decide which peers are unchoked while downloading
+	torrent.Choker = seed.Choker
+
+	listener, err := bittorrent.NewPeerListener(fmt.Sprintf(":%d", torrent.Progress.Port))
+	if err != nil {
+		log.Printf("failed to listen for peers: %s", err)
+		return seed, func() {}
+	}
+	if err := listener.Add(seed); err != nil {
+		log.Printf("failed to seed: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go seed.Choker.Run(ctx)
+
+	return seed, func() {
+		cancel()
+		listener.Close()
+	}
+}
+
+// uploadSlotsArg returns the optional number of upload slots at os.Args[i], bittorrent.DefaultUploadSlots without it
+func uploadSlotsArg(i int) int {
+	if len(os.Args) <= i {
+		return bittorrent.DefaultUploadSlots
+	}
+	slots, err := strconv.Atoi(os.Args[i])
+	bittorrent.AssertNotNil(err, "invalid upload slots: %s\n", err)
+	if slots < 0 {
+		fmt.Printf("invalid upload slots: %d\n", slots)
+		os.Exit(1)
+	}
+	return slots
+}
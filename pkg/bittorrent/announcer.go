@@ -0,0 +1,152 @@
+package bittorrent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAnnounceInterval is used when the tracker does not send an interval
+	DefaultAnnounceInterval = 30 * time.Minute
+	// AnnounceRetryInterval is the first delay after a failed announce, it doubles up to the interval
+	AnnounceRetryInterval = 15 * time.Second
+	// AnnounceStoppedTimeout limits the "stopped" announce that is sent after the context is canceled
+	AnnounceStoppedTimeout = 5 * time.Second
+)
+
+// Announcer announces the torrent to its trackers for as long as it runs: "started" first,
+// then every interval, "completed" once the download finished and "stopped" when it is canceled.
+// The peers of every response are added to the Swarm.
+type Announcer struct {
+	Torrent *TorrentFile
+	Swarm   *Swarm
+
+	completed     chan struct{}
+	completedOnce sync.Once
+	// announced is closed after the first announce, firstPeers is set before
+	announced  chan struct{}
+	firstPeers int
+}
+
+func NewAnnouncer(torrent *TorrentFile, swarm *Swarm) *Announcer {
+	return &Announcer{
+		Torrent:   torrent,
+		Swarm:     swarm,
+		completed: make(chan struct{}),
+		announced: make(chan struct{}),
+	}
+}
+
+// Announced is closed once the first announce succeeded or failed, or Run returned before
+func (announcer *Announcer) Announced() <-chan struct{} {
+	return announcer.announced
+}
+
+// FirstPeers returns the number of peers the trackers sent for the first announce, it is 0 when it failed.
+// It is only valid once Announced is closed.
+func (announcer *Announcer) FirstPeers() int {
+	return announcer.firstPeers
+}
+
+// Completed makes the announcer send the "completed" event, it can be called more than once
+func (announcer *Announcer) Completed() {
+	announcer.completedOnce.Do(func() {
+		close(announcer.completed)
+	})
+}
+
+// Run blocks until ctx is canceled and the "stopped" event was sent
+func (announcer *Announcer) Run(ctx context.Context) {
+	event := EventStarted
+	completedSent := false
+	retry := AnnounceRetryInterval
+	completed := announcer.completed
+	announced := announcer.announced
+	defer func() {
+		if announced != nil {
+			close(announced)
+		}
+	}()
+
+	for {
+		var wait time.Duration
+		response, err := announcer.announce(ctx, event)
+		if announced != nil {
+			if err == nil {
+				announcer.firstPeers = len(response.Peers)
+			}
+			close(announced)
+			announced = nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("announce %q failed: %s", event, err)
+			wait = retry
+			retry = min(retry*2, DefaultAnnounceInterval)
+		} else {
+			retry = AnnounceRetryInterval
+			if event == EventCompleted {
+				completedSent = true
+			}
+			event = EventNone
+			announcer.Swarm.AddPeers(response.Peers)
+			wait = announceWait(response)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-completed:
+			timer.Stop()
+			// only once, a failed "completed" is retried by the timer
+			completed = nil
+			event = EventCompleted
+			continue
+		case <-timer.C:
+			continue
+		}
+		break
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), AnnounceStoppedTimeout)
+	defer cancel()
+
+	select {
+	case <-announcer.completed:
+		if !completedSent {
+			announcer.announce(stopCtx, EventCompleted)
+		}
+	default:
+	}
+	if _, err := announcer.announce(stopCtx, EventStopped); err != nil {
+		log.Printf("announce %q failed: %s", EventStopped, err)
+	}
+}
+
+func (announcer *Announcer) announce(ctx context.Context, event AnnounceEvent) (*TrackerResponse, error) {
+	request, err := announcer.Torrent.newAnnounceRequest()
+	if err != nil {
+		return nil, err
+	}
+	request.Event = event
+
+	response, _, err := announcer.Torrent.Trackers.Announce(ctx, request)
+	return response, err
+}
+
+// announceWait returns the interval of the response, never less than its min interval
+func announceWait(response *TrackerResponse) time.Duration {
+	wait := DefaultAnnounceInterval
+	if response.Interval > 0 {
+		wait = time.Duration(response.Interval) * time.Second
+	}
+	if minWait := time.Duration(response.MinInterval) * time.Second; minWait > wait {
+		wait = minWait
+	}
+	return wait
+}
@@ -0,0 +1,125 @@
+package bittorrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type announceRecorder struct {
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+func (recorder *announceRecorder) events() []string {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	var events []string
+	for _, query := range recorder.requests {
+		events = append(events, query.Get("event"))
+	}
+	return events
+}
+
+func newRecordingTracker(t *testing.T, body string) (*httptest.Server, *announceRecorder) {
+	recorder := &announceRecorder{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.mu.Lock()
+		recorder.requests = append(recorder.requests, r.URL.Query())
+		recorder.mu.Unlock()
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, recorder
+}
+
+func newAnnouncerTestTorrent(t *testing.T, announce string) *TorrentFile {
+	info := "d6:lengthi3e4:name1:a12:piece lengthi4e6:pieces20:01234567890123456789e"
+	torrent, err := NewTorrentFileFromInfo([]byte(info), announce, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+func TestAnnouncerEvents(t *testing.T) {
+	server, recorder := newRecordingTracker(t, "d8:intervali1e12:min intervali1e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	torrent := newAnnouncerTestTorrent(t, server.URL)
+	swarm := NewSwarm()
+	announcer := NewAnnouncer(torrent, swarm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		announcer.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case peer := <-swarm.Peers:
+		if peer.String() != "10.0.0.1:6881" {
+			t.Errorf("unexpected peer %s", peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peer from the announcer")
+	}
+	<-announcer.Announced()
+	if announcer.FirstPeers() != 1 {
+		t.Errorf("expected 1 peer from the first announce, got %d", announcer.FirstPeers())
+	}
+
+	// the regular announce after the interval
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.events()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	torrent.Progress.Downloaded.Add(3)
+	torrent.Progress.Left.Store(0)
+	announcer.Completed()
+	cancel()
+	<-done
+
+	events := recorder.events()
+	want := []string{"started", "", "completed", "stopped"}
+	if len(events) != len(want) {
+		t.Fatalf("got events %q want %q", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("got events %q want %q", events, want)
+		}
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	first, last := recorder.requests[0], recorder.requests[len(recorder.requests)-1]
+	if first.Get("left") != "3" || last.Get("left") != "0" || last.Get("downloaded") != "3" {
+		t.Errorf("unexpected progress: first %v last %v", first, last)
+	}
+	if swarm.Len() != 1 {
+		t.Errorf("expected the same peer to be reported once, got %d", swarm.Len())
+	}
+}
+
+func TestAnnounceWait(t *testing.T) {
+	tests := []struct {
+		interval, minInterval int
+		want                  time.Duration
+	}{
+		{-1, -1, DefaultAnnounceInterval},
+		{60, -1, time.Minute},
+		{60, 120, 2 * time.Minute},
+		{120, 60, 2 * time.Minute},
+	}
+
+	for _, v := range tests {
+		if got := announceWait(&TrackerResponse{Interval: v.interval, MinInterval: v.minInterval}); got != v.want {
+			t.Errorf("interval=%d min=%d: got %s want %s", v.interval, v.minInterval, got, v.want)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"unicode"
 )
 
 func BencodeInteger(i int) string {
@@ -15,247 +14,76 @@ func BencodeString(s string) string {
 	return fmt.Sprintf("%d:%s", len(s), s)
 }
 
+// BencodeList panics like Bencode.
+//
+// Deprecated: use EncodeBencode.
 func BencodeList(l []interface{}) string {
-	output := "l"
-	for _, obj := range l {
-		output += Bencode(obj)
-	}
-	return output + "e"
+	return Bencode(l)
 }
 
-// TODO: we should sort the map first
+// BencodeDict encodes the keys in sorted order, see BencodeEncoder. It panics like Bencode.
+//
+// Deprecated: use EncodeBencode.
 func BencodeDict(d map[string]interface{}) string {
-	output := "d"
+	return Bencode(d)
+}
 
-	for key, value := range d {
-		output += BencodeString(key)
-		output += Bencode(value)
+// Bencode panics if obj contains a value that can not be encoded.
+//
+// Deprecated: use EncodeBencode, it returns the error instead.
+func Bencode(obj interface{}) string {
+	encoded, err := EncodeBencode(obj)
+	if err != nil {
+		panic(err.Error())
 	}
+	return string(encoded)
+}
 
-	return output + "e"
+// decodeBencodePrefix decodes the first value of bencodedString, anything after it is ignored.
+// Keys do not need to be sorted, not every tracker or peer sorts them.
+func decodeBencodePrefix(bencodedString string) (interface{}, int, error) {
+	decoder := NewBencodeDecoder(strings.NewReader(bencodedString))
+	decoder.AllowUnsortedKeys = true
+	value, err := decoder.Decode()
+	return value, int(decoder.InputOffset()), err
 }
 
-func Bencode(obj interface{}) string {
-	switch v := obj.(type) {
-	case int:
-		return BencodeInteger(v)
-	case string:
-		return BencodeString(v)
-	case []interface{}:
-		return BencodeList(v)
-	case map[string]interface{}:
-		return BencodeDict(v)
-	default:
-		fmt.Printf("unknown type in list: %T\n", v)
-		panic("")
-		// FIXME: return "" ?
+func decodeBencodeAs[T any](bencodedString string, kind string) (T, int, error) {
+	var zero T
+	value, index, err := decodeBencodePrefix(bencodedString)
+	if err != nil {
+		return zero, index, err
+	}
+	v, ok := value.(T)
+	if !ok {
+		return zero, 0, fmt.Errorf("invalid %s %q", kind, bencodedString)
 	}
+	return v, index, nil
 }
 
 // Example:
 // - 5:hello -> hello
 // - 10:hello12345 -> hello12345
 func DecodeBencodeString(bencodedString string) (string, int, error) {
-	index := 0
-
-	switch {
-	case unicode.IsDigit(rune(bencodedString[index])):
-		var firstColonIndex int
-
-		for i := 0; i < len(bencodedString); i++ {
-			if bencodedString[i] == ':' {
-				firstColonIndex = i
-				break
-			}
-		}
-
-		lengthStr := bencodedString[:firstColonIndex]
-
-		length, err := strconv.Atoi(lengthStr)
-		if err != nil {
-			return "", index, err
-		}
-
-		index = firstColonIndex + 1 + length
-		decodedString := bencodedString[firstColonIndex+1 : index]
-
-		return decodedString, index, nil
-	default:
-		return "", 0, fmt.Errorf("invalid BencodeString %q", bencodedString)
-	}
+	return decodeBencodeAs[string](bencodedString, "BencodeString")
 }
 
 func DecodeBencodeInteger(bencodedString string) (int, int, error) {
-	index := 0
-
-	switch c := rune(bencodedString[index]); c {
-	case 'i':
-		indexEnd := strings.Index(bencodedString, "e")
-		integer, err := strconv.Atoi(bencodedString[1:indexEnd])
-		if err != nil {
-			return 0, 0, err
-		}
-
-		index = indexEnd + 1
-		return integer, index, nil
-
-	default:
-		return 0, 0, fmt.Errorf("invalid BencodeInteger %q", bencodedString)
-	}
+	return decodeBencodeAs[int](bencodedString, "BencodeInteger")
 }
 
 func DecodeBencodeList(bencodedString string) ([]interface{}, int, error) {
-	index := 0
-	depth := 0
-	l := make([]interface{}, 0)
-
-	for {
-		switch c := rune(bencodedString[index]); {
-		case c == 'e':
-			return l, index + 1, nil
-		case c == 'l':
-			if depth == 0 {
-				index += 1
-				depth += 1
-			} else {
-				// TODO: refactor to not use recursion
-				// this is a nested list
-				nl, relIndex, err := DecodeBencodeList(bencodedString[index:])
-				if err != nil {
-					return nil, index, err
-				}
-				l = append(l, nl)
-				index += relIndex
-			}
-		case c == 'i':
-			i, relIndex, err := DecodeBencodeInteger(bencodedString[index:])
-			if err != nil {
-				return nil, index, err
-			}
-			l = append(l, i)
-			index += relIndex
-		case unicode.IsDigit(c):
-			s, relIndex, err := DecodeBencodeString(bencodedString[index:])
-			if err != nil {
-				return nil, index, err
-			}
-			l = append(l, s)
-			index += relIndex
-		default:
-			return nil, index, fmt.Errorf("invalid BencodeList %q", bencodedString[index:])
-		}
-	}
+	return decodeBencodeAs[[]interface{}](bencodedString, "BencodeList")
 }
 
 func DecodeBencodeDict(bencodedString string) (map[string]interface{}, int, error) {
-	index := 0
-	depth := 0
-	isValue := false
-	key := ""
-	d := make(map[string]interface{})
-
-	for {
-		switch c := rune(bencodedString[index]); {
-		case c == 'e':
-			return d, index + 1, nil
-		case c == 'd':
-			switch {
-			case depth == 0:
-				index += 1
-				depth += 1
-			case isValue:
-				// TODO: refactor recursion out
-				nd, relIndex, err := DecodeBencodeDict(bencodedString[index:])
-				if err != nil {
-					return nil, index, err
-				}
-				d[key] = nd
-				index += relIndex
-				isValue = false
-			default:
-				return nil, index, fmt.Errorf("invalid BencodeDict %q", bencodedString[index:])
-			}
-		case unicode.IsDigit(c):
-			switch {
-			case depth == 0:
-				return nil, index, fmt.Errorf("invalid BencodeDict %q", bencodedString[index:])
-			case !isValue:
-				s, relIndex, err := DecodeBencodeString(bencodedString[index:])
-				if err != nil {
-					return nil, index, err
-				}
-				key = s
-				index += relIndex
-				isValue = true
-			case isValue:
-				s, relIndex, err := DecodeBencodeString(bencodedString[index:])
-				if err != nil {
-					return nil, index, err
-				}
-				d[key] = s
-				index += relIndex
-				isValue = false
-			default:
-				return nil, index, fmt.Errorf("invalid BencodeDict, unexpected string %q", bencodedString[index:])
-			}
-		case c == 'i':
-			if isValue {
-				i, relIndex, err := DecodeBencodeInteger(bencodedString[index:])
-				if err != nil {
-					return nil, index, err
-				}
-				d[key] = i
-				index += relIndex
-				isValue = false
-			} else {
-				return nil, index, fmt.Errorf("invalid BencodeDict, unexpected integer %q", bencodedString[index:])
-			}
-		case c == 'l':
-			if isValue {
-				l, relIndex, err := DecodeBencodeList(bencodedString[index:])
-				if err != nil {
-					return nil, index, err
-				}
-				d[key] = l
-				index += relIndex
-				isValue = false
-			} else {
-				return nil, index, fmt.Errorf("invalid BencodeDict, unexpected list %q", bencodedString[index:])
-			}
-		default:
-			return nil, index, fmt.Errorf("invalid BencodeDict %q", bencodedString[index:])
-		}
-	}
+	return decodeBencodeAs[map[string]interface{}](bencodedString, "BencodeDict")
 }
 
 func DecodeBencode(bencodedString string) (interface{}, error) {
-	c := rune(bencodedString[0])
-	switch {
-	case unicode.IsDigit(c):
-		result, _, err := DecodeBencodeString(bencodedString)
-		if err != nil {
-			return "", err
-		}
-		return result, nil
-	case c == 'i':
-		result, _, err := DecodeBencodeInteger(bencodedString)
-		if err != nil {
-			return "", err
-		}
-		return result, nil
-	case c == 'l':
-		result, _, err := DecodeBencodeList(bencodedString)
-		if err != nil {
-			return "", err
-		}
-		return result, nil
-	case c == 'd':
-		result, _, err := DecodeBencodeDict(bencodedString)
-		if err != nil {
-			return "", err
-		}
-		return result, nil
-	default:
-		return "", fmt.Errorf("Unsupported:\n%s\n", bencodedString)
+	result, _, err := decodeBencodePrefix(bencodedString)
+	if err != nil {
+		return "", err
 	}
+	return result, nil
 }
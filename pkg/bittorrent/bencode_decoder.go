@@ -0,0 +1,341 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var (
+	ErrBencodeUnexpectedEOF = fmt.Errorf("unexpected EOF")
+	ErrBencodeLeadingZero   = fmt.Errorf("leading zero")
+	ErrBencodeNegativeZero  = fmt.Errorf("negative zero")
+	ErrBencodeUnsortedKeys  = fmt.Errorf("unsorted dictionary keys")
+	ErrBencodeDuplicateKey  = fmt.Errorf("duplicate dictionary key")
+	ErrBencodeInvalidLength = fmt.Errorf("non-digit in string length")
+	ErrBencodeInvalidInt    = fmt.Errorf("invalid integer")
+	ErrBencodeInvalidByte   = fmt.Errorf("unexpected byte")
+	ErrBencodeNonStringKey  = fmt.Errorf("dictionary key is not a string")
+	ErrBencodeMissingValue  = fmt.Errorf("dictionary key without value")
+	ErrBencodeTooDeep       = fmt.Errorf("nesting too deep")
+	ErrBencodeTooLong       = fmt.Errorf("string too long")
+	ErrBencodeTrailingData  = fmt.Errorf("trailing data after value")
+)
+
+// BencodeSyntaxError describes why and where (byte offset from the start of the input) decoding failed
+type BencodeSyntaxError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *BencodeSyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Err, e.Offset)
+}
+
+func (e *BencodeSyntaxError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	BencodeMaxDepthDefault        = 64
+	BencodeMaxStringLengthDefault = 64 * 1024 * 1024
+	// 19 digits fit into int64, one more for the sign
+	bencodeMaxIntegerLength = 20
+)
+
+// BencodeDecoder decodes bencoded values from a byte stream without recursion.
+//
+// Decoded values are string, int, []interface{} and map[string]interface{}.
+// Only the first value is decoded, InputOffset tells where the next one starts.
+type BencodeDecoder struct {
+	r   io.ByteScanner
+	off int64
+	// consumed bytes are recorded while capturing, see readRaw
+	capture   []byte
+	capturing bool
+
+	MaxDepth        int
+	MaxStringLength int
+	// AllowUnsortedKeys accepts dictionaries that are not sorted by raw key bytes,
+	// duplicate keys are rejected regardless
+	AllowUnsortedKeys bool
+}
+
+// NewBencodeDecoder reads from r, if r is not an io.ByteScanner it is buffered
+// and the decoder may read past the end of the decoded value.
+func NewBencodeDecoder(r io.Reader) *BencodeDecoder {
+	scanner, ok := r.(io.ByteScanner)
+	if !ok {
+		scanner = bufio.NewReader(r)
+	}
+
+	return &BencodeDecoder{
+		r:               scanner,
+		MaxDepth:        BencodeMaxDepthDefault,
+		MaxStringLength: BencodeMaxStringLengthDefault,
+	}
+}
+
+// DecodeBencodeBytes decodes the first value in data and returns the number of bytes it occupies
+func DecodeBencodeBytes(data []byte) (interface{}, int, error) {
+	decoder := NewBencodeDecoder(bytes.NewReader(data))
+	value, err := decoder.Decode()
+	return value, int(decoder.InputOffset()), err
+}
+
+// InputOffset returns the number of bytes consumed so far
+func (d *BencodeDecoder) InputOffset() int64 {
+	return d.off
+}
+
+type bencodeFrame struct {
+	list    []interface{}
+	dict    map[string]interface{}
+	key     string
+	lastKey string
+	hasKey  bool
+}
+
+func (d *BencodeDecoder) Decode() (interface{}, error) {
+	var stack []*bencodeFrame
+
+	for {
+		start := d.off
+		c, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		top := (*bencodeFrame)(nil)
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		switch {
+		case c == 'e':
+			if top == nil {
+				return nil, d.syntaxError(start, ErrBencodeInvalidByte)
+			}
+			if top.dict != nil && top.hasKey {
+				return nil, d.syntaxError(start, ErrBencodeMissingValue)
+			}
+			_, _ = d.readByte()
+			stack = stack[:len(stack)-1]
+			if top.dict != nil {
+				value = top.dict
+			} else {
+				value = top.list
+			}
+		case top != nil && top.dict != nil && !top.hasKey:
+			if c < '0' || c > '9' {
+				return nil, d.syntaxError(start, ErrBencodeNonStringKey)
+			}
+			key, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			if len(top.dict) > 0 {
+				if key == top.lastKey {
+					return nil, d.syntaxError(start, ErrBencodeDuplicateKey)
+				}
+				if key < top.lastKey {
+					if !d.AllowUnsortedKeys {
+						return nil, d.syntaxError(start, ErrBencodeUnsortedKeys)
+					}
+					if _, ok := top.dict[key]; ok {
+						return nil, d.syntaxError(start, ErrBencodeDuplicateKey)
+					}
+				}
+			}
+			top.key = key
+			top.hasKey = true
+			continue
+		case c == 'l' || c == 'd':
+			if len(stack) >= d.MaxDepth {
+				return nil, d.syntaxError(start, ErrBencodeTooDeep)
+			}
+			_, _ = d.readByte()
+			frame := &bencodeFrame{list: make([]interface{}, 0)}
+			if c == 'd' {
+				frame = &bencodeFrame{dict: make(map[string]interface{})}
+			}
+			stack = append(stack, frame)
+			continue
+		case c == 'i':
+			value, err = d.readInteger()
+			if err != nil {
+				return nil, err
+			}
+		case c >= '0' && c <= '9':
+			value, err = d.readString()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, d.syntaxError(start, ErrBencodeInvalidByte)
+		}
+
+		if len(stack) == 0 {
+			return value, nil
+		}
+		top = stack[len(stack)-1]
+		if top.dict != nil {
+			top.dict[top.key] = value
+			if top.key > top.lastKey || len(top.dict) == 1 {
+				top.lastKey = top.key
+			}
+			top.hasKey = false
+		} else {
+			top.list = append(top.list, value)
+		}
+	}
+}
+
+func (d *BencodeDecoder) syntaxError(offset int64, err error) error {
+	return &BencodeSyntaxError{Offset: offset, Err: err}
+}
+
+func (d *BencodeDecoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, d.syntaxError(d.off, ErrBencodeUnexpectedEOF)
+		}
+		return 0, err
+	}
+	d.off++
+	if d.capturing {
+		d.capture = append(d.capture, c)
+	}
+	return c, nil
+}
+
+func (d *BencodeDecoder) peekByte() (byte, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if err := d.r.UnreadByte(); err != nil {
+		return 0, err
+	}
+	d.off--
+	if d.capturing {
+		d.capture = d.capture[:len(d.capture)-1]
+	}
+	return c, nil
+}
+
+// i<digits>e
+func (d *BencodeDecoder) readInteger() (int, error) {
+	start := d.off
+	if _, err := d.readByte(); err != nil {
+		return 0, err
+	}
+
+	digits := make([]byte, 0, bencodeMaxIntegerLength)
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == 'e' {
+			break
+		}
+		if !(c >= '0' && c <= '9') && !(c == '-' && len(digits) == 0) {
+			return 0, d.syntaxError(d.off-1, ErrBencodeInvalidInt)
+		}
+		if len(digits) == bencodeMaxIntegerLength {
+			return 0, d.syntaxError(start, ErrBencodeInvalidInt)
+		}
+		digits = append(digits, c)
+	}
+
+	unsigned := digits
+	if len(digits) > 0 && digits[0] == '-' {
+		unsigned = digits[1:]
+	}
+	switch {
+	case len(unsigned) == 0:
+		return 0, d.syntaxError(start, ErrBencodeInvalidInt)
+	case len(unsigned) > 1 && unsigned[0] == '0':
+		return 0, d.syntaxError(start, ErrBencodeLeadingZero)
+	case len(digits) == 2 && digits[0] == '-' && digits[1] == '0':
+		return 0, d.syntaxError(start, ErrBencodeNegativeZero)
+	}
+
+	i, err := strconv.ParseInt(string(digits), 10, strconv.IntSize)
+	if err != nil {
+		return 0, d.syntaxError(start, ErrBencodeInvalidInt)
+	}
+	return int(i), nil
+}
+
+// <length>:<bytes>
+func (d *BencodeDecoder) readString() (string, error) {
+	start := d.off
+	length := 0
+	digits := 0
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ':' && digits > 0 {
+			break
+		}
+		if c < '0' || c > '9' {
+			return "", d.syntaxError(d.off-1, ErrBencodeInvalidLength)
+		}
+		if digits == 1 && length == 0 {
+			return "", d.syntaxError(start, ErrBencodeLeadingZero)
+		}
+		length = length*10 + int(c-'0')
+		digits++
+		if length > d.MaxStringLength {
+			return "", d.syntaxError(start, ErrBencodeTooLong)
+		}
+	}
+
+	buf, err := d.readN(length)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readN grows the buffer while reading, a peer announcing a huge length does not make us allocate it upfront
+func (d *BencodeDecoder) readN(length int) ([]byte, error) {
+	const chunkSize = 64 * 1024
+	buf := make([]byte, 0, min(length, chunkSize))
+
+	r, ok := d.r.(io.Reader)
+	for len(buf) < length {
+		if !ok {
+			c, err := d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, c)
+			continue
+		}
+
+		chunk := min(length-len(buf), chunkSize)
+		buf = append(buf, make([]byte, chunk)...)
+		n, err := io.ReadFull(r, buf[len(buf)-chunk:])
+		d.off += int64(n)
+		if d.capturing {
+			d.capture = append(d.capture, buf[len(buf)-chunk:len(buf)-chunk+n]...)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, d.syntaxError(d.off, ErrBencodeUnexpectedEOF)
+			}
+			return nil, err
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,146 @@
+package bittorrent
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoderValues(t *testing.T) {
+	tests := []struct {
+		input  string
+		output interface{}
+	}{
+		{"0:", ""},
+		{"5:hello", "hello"},
+		{"i0e", 0},
+		{"i-42e", -42},
+		{"le", []interface{}{}},
+		{"li1el1:aee", []interface{}{1, []interface{}{"a"}}},
+		{"de", map[string]interface{}{}},
+		{"d1:ai1e1:bld1:cdeeee", map[string]interface{}{"a": 1, "b": []interface{}{map[string]interface{}{"c": map[string]interface{}{}}}}},
+	}
+
+	for _, v := range tests {
+		got, n, err := DecodeBencodeBytes([]byte(v.input))
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", v.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, v.output) {
+			t.Errorf("%q: got %#v want %#v", v.input, got, v.output)
+		}
+		if n != len(v.input) {
+			t.Errorf("%q: got offset %d want %d", v.input, n, len(v.input))
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		err    error
+		offset int64
+	}{
+		{"", ErrBencodeUnexpectedEOF, 0},
+		{"5:hell", ErrBencodeUnexpectedEOF, 6},
+		{"i12", ErrBencodeUnexpectedEOF, 3},
+		{"l", ErrBencodeUnexpectedEOF, 1},
+		{"d1:a", ErrBencodeUnexpectedEOF, 4},
+		{"i03e", ErrBencodeLeadingZero, 0},
+		{"li1ei-0ee", ErrBencodeNegativeZero, 4},
+		{"ie", ErrBencodeInvalidInt, 0},
+		{"i1-2e", ErrBencodeInvalidInt, 2},
+		{"i99999999999999999999e", ErrBencodeInvalidInt, 0},
+		{"05:hello", ErrBencodeLeadingZero, 0},
+		{"1x:a", ErrBencodeInvalidLength, 1},
+		{"d1:bi1e1:ai2ee", ErrBencodeUnsortedKeys, 7},
+		{"d1:ai1e1:ai2ee", ErrBencodeDuplicateKey, 7},
+		{"di1ei2ee", ErrBencodeNonStringKey, 1},
+		{"d1:ae", ErrBencodeMissingValue, 4},
+		{"e", ErrBencodeInvalidByte, 0},
+		{"lxe", ErrBencodeInvalidByte, 1},
+		{strings.Repeat("l", BencodeMaxDepthDefault+1), ErrBencodeTooDeep, BencodeMaxDepthDefault},
+		{"99999999999:", ErrBencodeTooLong, 0},
+	}
+
+	for _, v := range tests {
+		_, _, err := DecodeBencodeBytes([]byte(v.input))
+		var syntaxErr *BencodeSyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected BencodeSyntaxError, got %v", v.input, err)
+			continue
+		}
+		if !errors.Is(err, v.err) {
+			t.Errorf("%q: got %s want %s", v.input, err, v.err)
+		}
+		if syntaxErr.Offset != v.offset {
+			t.Errorf("%q: got offset %d want %d", v.input, syntaxErr.Offset, v.offset)
+		}
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	// values are read one byte at a time to make sure nothing relies on the full input being available
+	decoder := NewBencodeDecoder(iotest.OneByteReader(strings.NewReader("i1e4:spamd1:ai2ee")))
+	want := []interface{}{1, "spam", map[string]interface{}{"a": 2}}
+
+	for _, w := range want {
+		got, err := decoder.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("got %#v want %#v", got, w)
+		}
+	}
+
+	if _, err := decoder.Decode(); !errors.Is(err, ErrBencodeUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestDecoderAllowUnsortedKeys(t *testing.T) {
+	decoder := NewBencodeDecoder(strings.NewReader("d1:bi1e1:ai2ee"))
+	decoder.AllowUnsortedKeys = true
+
+	got, err := decoder.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"a": 2, "b": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v want %#v", got, want)
+	}
+
+	decoder = NewBencodeDecoder(strings.NewReader("d1:bi1e1:ai2e1:bi3ee"))
+	decoder.AllowUnsortedKeys = true
+	if _, err := decoder.Decode(); !errors.Is(err, ErrBencodeDuplicateKey) {
+		t.Errorf("expected duplicate key error, got %v", err)
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range []string{"i42e", "5:hello", "l4:spami7ee", "d3:cow3:moo4:spaml1:a1:bee", "d1:ad1:bleee", "i-0e", "01:"} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, n, err := DecodeBencodeBytes(data)
+		if err != nil {
+			var syntaxErr *BencodeSyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("expected BencodeSyntaxError, got %v", err)
+			}
+			if syntaxErr.Offset < 0 || syntaxErr.Offset > int64(len(data)) {
+				t.Fatalf("offset %d out of range", syntaxErr.Offset)
+			}
+			return
+		}
+		if n > len(data) {
+			t.Fatalf("consumed %d bytes of %d", n, len(data))
+		}
+		_ = value
+	})
+}
@@ -0,0 +1,151 @@
+package bittorrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// BencodeEncoder writes the canonical bencoding of values: dictionary keys are sorted by their raw bytes,
+// so encoding the same value always gives the same output (and the same hash).
+//
+// Supported are bool (i1e/i0e), all integer types, string, []byte, byte arrays, slices, arrays,
+// maps with string keys and structs (see MarshalBencode), pointers and interfaces are followed.
+type BencodeEncoder struct {
+	w io.Writer
+}
+
+func NewBencodeEncoder(w io.Writer) *BencodeEncoder {
+	return &BencodeEncoder{w: w}
+}
+
+// Encode writes v in a single Write call, nothing is written if v can not be encoded
+func (e *BencodeEncoder) Encode(v interface{}) error {
+	var buf bytes.Buffer
+	if err := encodeBencodeValue(&buf, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func EncodeBencode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewBencodeEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type BencodeUnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *BencodeUnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "bencode: unsupported value nil"
+	}
+	return fmt.Sprintf("bencode: unsupported type %s", e.Type)
+}
+
+func encodeBencodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return &BencodeUnsupportedTypeError{}
+	}
+
+	if v.Type() == bencodeRawMessageType {
+		if v.Len() == 0 {
+			return &BencodeUnsupportedTypeError{Type: v.Type()}
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.String:
+		encodeBencodeBytes(buf, []byte(v.String()))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			encodeBencodeBytes(buf, v.Bytes())
+			return nil
+		}
+		return encodeBencodeList(buf, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			encodeBencodeBytes(buf, b)
+			return nil
+		}
+		return encodeBencodeList(buf, v)
+	case reflect.Map:
+		return encodeBencodeMap(buf, v)
+	case reflect.Struct:
+		return encodeBencodeStruct(buf, v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &BencodeUnsupportedTypeError{Type: v.Type()}
+		}
+		return encodeBencodeValue(buf, v.Elem())
+	default:
+		return &BencodeUnsupportedTypeError{Type: v.Type()}
+	}
+
+	return nil
+}
+
+func encodeBencodeBytes(buf *bytes.Buffer, b []byte) {
+	buf.WriteString(strconv.Itoa(len(b)))
+	buf.WriteByte(':')
+	buf.Write(b)
+}
+
+func encodeBencodeList(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeBencodeValue(buf, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func encodeBencodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &BencodeUnsupportedTypeError{Type: v.Type()}
+	}
+
+	keys := v.MapKeys()
+	// Go compares strings byte-wise, which is exactly the order bencode requires
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	buf.WriteByte('d')
+	for _, key := range keys {
+		encodeBencodeBytes(buf, []byte(key.String()))
+		if err := encodeBencodeValue(buf, v.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
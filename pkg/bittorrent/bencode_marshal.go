@@ -0,0 +1,363 @@
+package bittorrent
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BencodeRawMessage is an already encoded value, it is written as-is when marshalling
+// and receives the raw bytes of the value when unmarshalling.
+type BencodeRawMessage []byte
+
+var bencodeRawMessageType = reflect.TypeOf(BencodeRawMessage(nil))
+
+// MarshalBencode encodes v like BencodeEncoder, additionally structs are encoded as dictionaries.
+//
+// Struct fields are keyed by the `bencode:"name"` tag, or by the field name without a tag.
+// The "omitempty" option skips zero values and a tag of "-" skips the field.
+func MarshalBencode(v interface{}) ([]byte, error) {
+	return EncodeBencode(v)
+}
+
+// UnmarshalBencode decodes data into the value pointed to by v, data must contain exactly one value.
+//
+// Dictionary keys that have no matching struct field are skipped. Keys are not required to be sorted,
+// use BencodeDecoder.DecodeInto for strict decoding.
+func UnmarshalBencode(data []byte, v interface{}) error {
+	decoder := NewBencodeDecoder(bytes.NewReader(data))
+	decoder.AllowUnsortedKeys = true
+	if err := decoder.DecodeInto(v); err != nil {
+		return err
+	}
+	if decoder.InputOffset() != int64(len(data)) {
+		return decoder.syntaxError(decoder.InputOffset(), ErrBencodeTrailingData)
+	}
+	return nil
+}
+
+// BencodeUnmarshalTypeError is returned when a value does not fit into the Go type
+type BencodeUnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *BencodeUnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+type bencodeField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var bencodeFieldCache sync.Map // map[reflect.Type][]bencodeField
+
+// bencodeFields returns the encoded fields of struct type t sorted by their key
+func bencodeFields(t reflect.Type) []bencodeField {
+	if fields, ok := bencodeFieldCache.Load(t); ok {
+		return fields.([]bencodeField)
+	}
+
+	fields := make([]bencodeField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, bencodeField{
+			name:      name,
+			index:     i,
+			omitEmpty: options == "omitempty",
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+
+	bencodeFieldCache.Store(t, fields)
+	return fields
+}
+
+func encodeBencodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('d')
+	for _, field := range bencodeFields(v.Type()) {
+		fv := v.Field(field.index)
+		if field.omitEmpty && isEmptyBencodeValue(fv) {
+			continue
+		}
+		encodeBencodeBytes(buf, []byte(field.name))
+		if err := encodeBencodeValue(buf, fv); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func isEmptyBencodeValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// DecodeInto decodes the next value into the value pointed to by v, see UnmarshalBencode
+func (d *BencodeDecoder) DecodeInto(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: DecodeInto requires a non-nil pointer, got %T", v)
+	}
+	return d.decodeValue(rv.Elem(), 0)
+}
+
+func (d *BencodeDecoder) decodeValue(v reflect.Value, depth int) error {
+	if depth >= d.MaxDepth {
+		return d.syntaxError(d.off, ErrBencodeTooDeep)
+	}
+
+	if v.Type() == bencodeRawMessageType {
+		raw, err := d.readRaw()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(v.Elem(), depth)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return &BencodeUnmarshalTypeError{Value: "value", Type: v.Type(), Offset: d.off}
+		}
+		value, err := d.Decode()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	start := d.off
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		i, err := d.readInteger()
+		if err != nil {
+			return err
+		}
+		return setBencodeInteger(v, i, start)
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		return setBencodeString(v, s, start)
+	case c == 'l':
+		return d.decodeList(v, depth)
+	case c == 'd':
+		return d.decodeDict(v, depth)
+	default:
+		return d.syntaxError(start, ErrBencodeInvalidByte)
+	}
+}
+
+func setBencodeInteger(v reflect.Value, i int, offset int64) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(i != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(int64(i)) {
+			return &BencodeUnmarshalTypeError{Value: fmt.Sprintf("integer %d", i), Type: v.Type(), Offset: offset}
+		}
+		v.SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return &BencodeUnmarshalTypeError{Value: fmt.Sprintf("integer %d", i), Type: v.Type(), Offset: offset}
+		}
+		v.SetUint(uint64(i))
+	default:
+		return &BencodeUnmarshalTypeError{Value: "integer", Type: v.Type(), Offset: offset}
+	}
+	return nil
+}
+
+func setBencodeString(v reflect.Value, s string, offset int64) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes([]byte(s))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return &BencodeUnmarshalTypeError{Value: fmt.Sprintf("string of length %d", len(s)), Type: v.Type(), Offset: offset}
+		}
+		reflect.Copy(v, reflect.ValueOf([]byte(s)))
+	default:
+		return &BencodeUnmarshalTypeError{Value: "string", Type: v.Type(), Offset: offset}
+	}
+	return nil
+}
+
+func (d *BencodeDecoder) decodeList(v reflect.Value, depth int) error {
+	start := d.off
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return &BencodeUnmarshalTypeError{Value: "list", Type: v.Type(), Offset: start}
+	}
+	_, _ = d.readByte()
+
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	for i := 0; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, _ = d.readByte()
+			if v.Kind() == reflect.Array && i != v.Len() {
+				return &BencodeUnmarshalTypeError{Value: fmt.Sprintf("list of length %d", i), Type: v.Type(), Offset: start}
+			}
+			return nil
+		}
+
+		if v.Kind() == reflect.Array {
+			if i >= v.Len() {
+				return &BencodeUnmarshalTypeError{Value: "longer list", Type: v.Type(), Offset: start}
+			}
+			if err := d.decodeValue(v.Index(i), depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := d.decodeValue(elem, depth+1); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+}
+
+func (d *BencodeDecoder) decodeDict(v reflect.Value, depth int) error {
+	start := d.off
+	var fields map[string]bencodeField
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case v.Kind() == reflect.Struct:
+		fields = make(map[string]bencodeField)
+		for _, field := range bencodeFields(v.Type()) {
+			fields[field.name] = field
+		}
+	default:
+		return &BencodeUnmarshalTypeError{Value: "dict", Type: v.Type(), Offset: start}
+	}
+	_, _ = d.readByte()
+
+	seen := make(map[string]struct{})
+	lastKey := ""
+	for {
+		keyStart := d.off
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, _ = d.readByte()
+			return nil
+		}
+		if c < '0' || c > '9' {
+			return d.syntaxError(keyStart, ErrBencodeNonStringKey)
+		}
+
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if _, ok := seen[key]; ok {
+			return d.syntaxError(keyStart, ErrBencodeDuplicateKey)
+		}
+		if len(seen) > 0 && key < lastKey && !d.AllowUnsortedKeys {
+			return d.syntaxError(keyStart, ErrBencodeUnsortedKeys)
+		}
+		seen[key] = struct{}{}
+		lastKey = max(lastKey, key)
+
+		if c, err := d.peekByte(); err != nil {
+			return err
+		} else if c == 'e' {
+			return d.syntaxError(d.off, ErrBencodeMissingValue)
+		}
+
+		if fields == nil {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decodeValue(elem, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		field, ok := fields[key]
+		if !ok {
+			// unknown keys are skipped, but they still have to be valid
+			if _, err := d.Decode(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeValue(v.Field(field.index), depth+1); err != nil {
+			return err
+		}
+	}
+}
+
+// readRaw returns the bytes of the next value
+func (d *BencodeDecoder) readRaw() ([]byte, error) {
+	wasCapturing := d.capturing
+	start := len(d.capture)
+	d.capturing = true
+	defer func() {
+		if !wasCapturing {
+			d.capturing = false
+			d.capture = d.capture[:0]
+		}
+	}()
+
+	if _, err := d.Decode(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), d.capture[start:]...), nil
+}
@@ -0,0 +1,169 @@
+package bittorrent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type marshalTestInner struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type marshalTestStruct struct {
+	Name     string             `bencode:"name"`
+	PieceLen int64              `bencode:"piece length"`
+	Hash     [4]byte            `bencode:"hash"`
+	Data     []byte             `bencode:"data,omitempty"`
+	Private  bool               `bencode:"private,omitempty"`
+	Files    []marshalTestInner `bencode:"files,omitempty"`
+	Extra    map[string]int     `bencode:"extra,omitempty"`
+	Raw      BencodeRawMessage  `bencode:"raw,omitempty"`
+	Ptr      *marshalTestInner  `bencode:"ptr,omitempty"`
+	Any      interface{}        `bencode:"any,omitempty"`
+	Skipped  string             `bencode:"-"`
+	Untagged uint16
+	internal int
+}
+
+func TestMarshalStruct(t *testing.T) {
+	v := marshalTestStruct{
+		Name:     "n",
+		PieceLen: 16,
+		Hash:     [4]byte{'a', 'b', 'c', 'd'},
+		Private:  true,
+		Files:    []marshalTestInner{{Length: 1, Path: []string{"a", "b"}}},
+		Extra:    map[string]int{"z": 1, "y": 2},
+		Raw:      BencodeRawMessage("li1ee"),
+		Skipped:  "not encoded",
+		Untagged: 3,
+		internal: 4,
+	}
+
+	got, err := MarshalBencode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "d8:Untaggedi3e5:extrad1:yi2e1:zi1ee5:filesld6:lengthi1e4:pathl1:a1:beee4:hash4:abcd4:name1:n12:piece lengthi16e7:privatei1e3:rawli1eee"
+	if string(got) != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	// keys are not sorted and "unknown" has no matching field
+	data := "d4:name1:n12:piece lengthi16e4:hash4:abcd4:data3:xyz7:privatei1e5:filesld6:lengthi1e4:pathl1:a1:beee" +
+		"5:extrad1:yi2ee3:rawd1:ai1ee3:ptrd6:lengthi5ee3:anyli1e1:xe7:unknownd1:xl1:yee8:Untaggedi3ee"
+
+	var got marshalTestStruct
+	if err := UnmarshalBencode([]byte(data), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := marshalTestStruct{
+		Name:     "n",
+		PieceLen: 16,
+		Hash:     [4]byte{'a', 'b', 'c', 'd'},
+		Data:     []byte("xyz"),
+		Private:  true,
+		Files:    []marshalTestInner{{Length: 1, Path: []string{"a", "b"}}},
+		Extra:    map[string]int{"y": 2},
+		Raw:      BencodeRawMessage("d1:ai1ee"),
+		Ptr:      &marshalTestInner{Length: 5},
+		Any:      []interface{}{1, "x"},
+		Untagged: 3,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	want := TorrentFileInfo{
+		Name:        "dir",
+		PieceLength: 1 << 18,
+		Pieces:      "01234567890123456789",
+		Files:       []TorrentFileEntry{{Length: 1, Path: []string{"a"}, Md5sum: "m"}},
+	}
+
+	data, err := MarshalBencode(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got TorrentFileInfo
+	if err := UnmarshalBencode(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var typeErr *BencodeUnmarshalTypeError
+	tests := []struct {
+		input string
+		check func(error) bool
+	}{
+		{"d4:name5:helloe", func(err error) bool { return err == nil }},
+		{"d4:namei1ee", func(err error) bool { return errors.As(err, &typeErr) && typeErr.Offset == 7 }},
+		{"d4:hash3:abce", func(err error) bool { return errors.As(err, &typeErr) }},
+		{"d12:piece lengthi-1ee", func(err error) bool { return err == nil }},
+		{"d8:Untaggedi-1ee", func(err error) bool { return errors.As(err, &typeErr) }},
+		{"d8:Untaggedi70000ee", func(err error) bool { return errors.As(err, &typeErr) }},
+		{"d4:name1:ae4:spam", func(err error) bool { return errors.Is(err, ErrBencodeTrailingData) }},
+		{"d4:name1:a4:name1:be", func(err error) bool { return errors.Is(err, ErrBencodeDuplicateKey) }},
+		{"d7:unknowni03ee", func(err error) bool { return errors.Is(err, ErrBencodeLeadingZero) }},
+		{"d5:files", func(err error) bool { return errors.Is(err, ErrBencodeUnexpectedEOF) }},
+	}
+
+	for _, v := range tests {
+		var s marshalTestStruct
+		if err := UnmarshalBencode([]byte(v.input), &s); !v.check(err) {
+			t.Errorf("%q: unexpected result %v", v.input, err)
+		}
+	}
+
+	if err := UnmarshalBencode([]byte("i1e"), marshalTestStruct{}); err == nil {
+		t.Errorf("expected error for non-pointer")
+	}
+}
+
+func TestExtendedMessageUnmarshalDict(t *testing.T) {
+	msg := NewExtendedMessage()
+	msg.SetExtensionMessageId(3)
+	header, err := MarshalBencode(MetadataMessage{MsgType: MetadataData, Piece: 0, TotalSize: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = addTestDict(t, msg, BencodeRawMessage(append(header, "d1:xe"...)))
+
+	var got MetadataMessage
+	payload, err := msg.UnmarshalDict(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MetadataMessage{MsgType: MetadataData, Piece: 0, TotalSize: 6}); got != want {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+	if string(payload) != "d1:xe" {
+		t.Errorf("got payload %q want %q", payload, "d1:xe")
+	}
+}
+
+func TestExtendedMessageAddDictError(t *testing.T) {
+	if _, err := NewExtendedMessage().AddDict(map[string]interface{}{"x": 1.5}); err == nil {
+		t.Error("expected an error for a value that can not be encoded")
+	}
+}
+
+// addTestDict appends d to msg and fails the test if d can not be encoded
+func addTestDict(t *testing.T, msg *ExtendedMessage, d interface{}) *ExtendedMessage {
+	t.Helper()
+	msg, err := msg.AddDict(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
@@ -1,6 +1,9 @@
 package bittorrent
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestEncodeInteger(t *testing.T) {
 	tests := []struct {
@@ -80,3 +83,93 @@ func TestEncodeDict(t *testing.T) {
 	}
 
 }
+
+func TestEncodeDictSortedKeys(t *testing.T) {
+	input := map[string]interface{}{
+		"ut_pex":      2,
+		"ut_metadata": 1,
+		"Z":           "upper case sorts first",
+		"\xff":        "raw bytes",
+		"a":           map[string]interface{}{"b": 1, "a": 0},
+	}
+	want := "d1:Z22:upper case sorts first1:ad1:ai0e1:bi1ee11:ut_metadatai1e6:ut_pexi2e1:\xff9:raw bytese"
+
+	// map iteration order is random, the output must not be
+	for i := 0; i < 20; i++ {
+		for name, encode := range map[string]func(interface{}) ([]byte, error){"EncodeBencode": EncodeBencode, "MarshalBencode": MarshalBencode} {
+			got, err := encode(input)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if string(got) != want {
+				t.Fatalf("%s: got %q want %q", name, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeTypedValues(t *testing.T) {
+	tests := []struct {
+		input  interface{}
+		output string
+	}{
+		{int64(-1 << 62), "i-4611686018427387904e"},
+		{uint64(1 << 63), "i9223372036854775808e"},
+		{uint8(7), "i7e"},
+		{true, "i1e"},
+		{false, "i0e"},
+		{[]byte("abc"), "3:abc"},
+		{[4]byte{'a', 'b', 'c', 'd'}, "4:abcd"},
+		{[]string{"a", "b"}, "l1:a1:be"},
+		{[][]int64{{1}, {}}, "lli1eelee"},
+		{map[string][]byte{"k": []byte("v")}, "d1:k1:ve"},
+		{map[string]interface{}{"n": []interface{}{uint16(1), []byte{}}}, "d1:nli1e0:ee"},
+	}
+
+	for _, v := range tests {
+		got, err := EncodeBencode(v.input)
+		if err != nil {
+			t.Errorf("%#v: unexpected error %s", v.input, err)
+			continue
+		}
+		if string(got) != v.output {
+			t.Errorf("got %q want %q", got, v.output)
+		}
+	}
+}
+
+func TestEncodeUnsupported(t *testing.T) {
+	tests := []interface{}{
+		nil,
+		3.14,
+		map[int]string{1: "a"},
+		[]interface{}{make(chan int)},
+		(*int)(nil),
+	}
+
+	for _, v := range tests {
+		if _, err := EncodeBencode(v); err == nil {
+			t.Errorf("%#v: expected error", v)
+		}
+	}
+}
+
+func TestEncoderWriter(t *testing.T) {
+	var buf strings.Builder
+	encoder := NewBencodeEncoder(&buf)
+
+	if err := encoder.Encode(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Encode([]interface{}{"x", 3.14}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := encoder.Encode(int64(5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed value must not leave partial output behind
+	if got, want := buf.String(), "d1:ai1eei5e"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
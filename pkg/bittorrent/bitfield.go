@@ -0,0 +1,54 @@
+package bittorrent
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Bitfield has one bit for every piece, the high bit of the first byte is piece 0
+type Bitfield []byte
+
+func NewBitfield(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+func (bitfield Bitfield) Has(idx int) bool {
+	if idx < 0 || idx/8 >= len(bitfield) {
+		return false
+	}
+	return bitfield[idx/8]&(0x80>>(idx%8)) != 0
+}
+
+func (bitfield Bitfield) Set(idx int) {
+	if idx < 0 || idx/8 >= len(bitfield) {
+		return
+	}
+	bitfield[idx/8] |= 0x80 >> (idx % 8)
+}
+
+func (bitfield Bitfield) Clear(idx int) {
+	if idx < 0 || idx/8 >= len(bitfield) {
+		return
+	}
+	bitfield[idx/8] &^= 0x80 >> (idx % 8)
+}
+
+// Count returns the number of pieces that are set
+func (bitfield Bitfield) Count() int {
+	n := 0
+	for _, b := range bitfield {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// Validate checks that the bitfield has the length for the number of pieces and that the spare bits are cleared
+func (bitfield Bitfield) Validate(pieces int) error {
+	if len(bitfield) != (pieces+7)/8 {
+		return fmt.Errorf("bitfield has %d bytes, expected %d for %d pieces", len(bitfield), (pieces+7)/8, pieces)
+	}
+	if spare := pieces % 8; spare != 0 && bitfield[len(bitfield)-1]&(0xff>>spare) != 0 {
+		return fmt.Errorf("bitfield has spare bits set: %08b", bitfield[len(bitfield)-1])
+	}
+	return nil
+}
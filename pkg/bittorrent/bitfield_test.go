@@ -0,0 +1,141 @@
+package bittorrent
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBitfieldValidate(t *testing.T) {
+	tests := []struct {
+		bitfield Bitfield
+		pieces   int
+		valid    bool
+	}{
+		{Bitfield{0xff, 0xe0}, 11, true},
+		{Bitfield{0xff, 0xf0}, 11, false},
+		{Bitfield{0xff}, 11, false},
+		{Bitfield{0xff, 0x00, 0x00}, 11, false},
+		{Bitfield{0xff}, 8, true},
+		{Bitfield{}, 0, true},
+	}
+	for _, v := range tests {
+		if err := v.bitfield.Validate(v.pieces); (err == nil) != v.valid {
+			t.Errorf("%08b with %d pieces: valid %t, got %v", v.bitfield, v.pieces, v.valid, err)
+		}
+	}
+}
+
+func TestPeerStateBitfieldBeforePieceCount(t *testing.T) {
+	state := NewPeerState()
+	if err := state.SetBitfield(Bitfield{0x80, 0x40}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetHave(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetPieceCount(10); err != nil {
+		t.Fatal(err)
+	}
+	for idx, has := range map[int]bool{0: true, 3: true, 9: true, 1: false} {
+		if state.Has(idx) != has {
+			t.Errorf("piece %d: has %t", idx, !has)
+		}
+	}
+	if err := state.SetHave(10); err == nil {
+		t.Error("HAVE beyond the last piece was accepted")
+	}
+
+	// the spare bits are checked once the number of pieces is known
+	state = NewPeerState()
+	state.SetBitfield(Bitfield{0x80, 0x20})
+	if err := state.SetPieceCount(10); err == nil {
+		t.Error("bitfield with spare bits set was accepted")
+	}
+
+	// HAVE messages of a magnet link may refer to pieces beyond the end
+	state = NewPeerState()
+	state.SetHave(12)
+	if err := state.SetPieceCount(10); err == nil {
+		t.Error("HAVE beyond the last piece was accepted")
+	}
+}
+
+func TestHandleMessageInvalidBitfield(t *testing.T) {
+	handler := NewPeerStateHandler()
+	handler.PeerState.SetPieceCount(4)
+
+	if _, err := handler.HandleMessage(NewBitfieldMessage(Bitfield{0x90}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !handler.PeerState.Has(0) || !handler.PeerState.Has(3) || handler.PeerState.Has(1) {
+		t.Error("bitfield was not recorded")
+	}
+	if _, err := handler.HandleMessage(NewHaveMessage(1), nil); err != nil || !handler.PeerState.Has(1) {
+		t.Errorf("HAVE was not recorded: %v", err)
+	}
+
+	if _, err := handler.HandleMessage(NewBitfieldMessage(Bitfield{0x98}), nil); err == nil {
+		t.Error("bitfield with spare bits set was accepted")
+	}
+	if _, err := handler.HandleMessage(NewHaveMessage(4), nil); err == nil {
+		t.Error("HAVE beyond the last piece was accepted")
+	}
+}
+
+func TestPeerWorkerOnlyTakesAvailablePieces(t *testing.T) {
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	seed, listener := newTestSeed(t, data)
+	// the seed has piece 2 only
+	seed.SetHave(2)
+
+	torrent := newSeedTestTorrent(t, data, nil)
+	storage, err := NewFileStorage(filepath.Join(t.TempDir(), "out.bin"), &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := torrent.Info.PieceCount()
+	pieces := make([]*Piece, count)
+	done := make(chan *Piece, count)
+	errs := make(chan error, count)
+	for i := range pieces {
+		pieces[i] = torrent.Info.NewPiece(i)
+		pieces[i].Storage = storage
+	}
+	picker := NewPiecePicker(count, pieces)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go PeerWorker(ctx, listener.Addr().String(), torrent, picker, done, errs)
+
+	receive := func() *Piece {
+		select {
+		case piece := <-done:
+			return piece
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("download timed out")
+		}
+		return nil
+	}
+	if piece := receive(); piece.Idx != 2 {
+		t.Fatalf("downloaded piece %d, the peer has piece 2 only", piece.Idx)
+	}
+
+	// the piece announced with HAVE is downloaded next
+	seed.SetHave(0)
+	if piece := receive(); piece.Idx != 0 {
+		t.Fatalf("downloaded piece %d after HAVE 0", piece.Idx)
+	}
+	if remaining := picker.Remaining(); remaining != 2 {
+		t.Errorf("%d pieces remaining, want 2", remaining)
+	}
+	if picker.Availability(0) != 1 || picker.Availability(1) != 0 {
+		t.Errorf("availability %d %d, want 1 0", picker.Availability(0), picker.Availability(1))
+	}
+}
@@ -1,25 +1,23 @@
 package bittorrent
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"time"
+	"sync"
+	"sync/atomic"
 )
 
 // TODO: refactor torrent file argument out
-func PeerWorker(ctx context.Context, address string, torrent *TorrentFile, todo <-chan *Piece, done chan<- *Piece, errs chan<- error) {
+func PeerWorker(ctx context.Context, address string, torrent *TorrentFile, picker *PiecePicker, done chan<- *Piece, errs chan<- error) {
 	log.Printf("%s: starting..\n", address)
 	// Connection to peer
 	conn, err := net.Dial("tcp", address)
@@ -29,10 +27,14 @@ func PeerWorker(ctx context.Context, address string, torrent *TorrentFile, todo
 	}
 	defer conn.Close()
 
+	// the reader stops when the worker returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// FIXME: what is the best way to receive errors?
 	handler := NewPeerStateHandler()
 
-	go HandleIncomingMessages(conn, handler.Incoming, handler.Errs)
+	go HandleIncomingMessages(ctx, conn, handler.Incoming, handler.Errs)
 
 	infoHash, err := torrent.InfoHash()
 	if err != nil {
@@ -40,78 +42,31 @@ func PeerWorker(ctx context.Context, address string, torrent *TorrentFile, todo
 		return
 	}
 	// handshake should be done immediately
-	handler.Outgoing <- *NewHandshakeMessage(torrent.Progress.PeerID, infoHash)
+	handshake := NewHandshakeMessage(torrent.Progress.PeerID, infoHash)
+	handshake.AsHandshake().SetExtensions()
+	handler.Outgoing <- *handshake
 
-	PeerWorkerInitialized(ctx, address, torrent, conn, handler, todo, done, errs)
+	PeerWorkerInitialized(ctx, address, torrent, conn, handler, picker, done, errs)
 }
 
-func PeerWorkerInitialized(ctx context.Context, address string, torrent *TorrentFile, conn net.Conn, handler *PeerStateHandler, todo <-chan *Piece, done chan<- *Piece, errs chan<- error) {
+// PeerWorkerInitialized downloads the pieces of picker from a connection whose handshake was sent already,
+// see peerSession. The caller owns conn and the reader of its messages. The error sent to errs wraps io.EOF
+// when the peer closed the connection.
+func PeerWorkerInitialized(ctx context.Context, address string, torrent *TorrentFile, conn net.Conn, handler *PeerStateHandler, picker *PiecePicker, done chan<- *Piece, errs chan<- error) {
 	log.Printf("%s: initialized..\n", address)
 
-	// FIXME: should this be protected by mutex?
-	var piece *Piece
-
-	// TODO: add keepalive message
-	// case <-time.Tick(time.Second * 1):
-	for {
+	session := &peerSession{
+		address: address,
+		torrent: torrent,
+		conn:    conn,
+		handler: handler,
+		picker:  picker,
+		done:    done,
+	}
+	if err := session.run(ctx); err != nil {
 		select {
+		case errs <- fmt.Errorf("%s: %w", address, err):
 		case <-ctx.Done():
-			// FIXME: do we need to clean up here? Or is this always the worst case scenario?
-			log.Printf("%s: context was canceled", address)
-			return
-		case outMsg := <-handler.Outgoing:
-			// FIXME: is there a case when didnt send all?
-			_, err := outMsg.WriteTo(conn)
-			if err != nil {
-				errs <- fmt.Errorf("%s: failed to send: %s", address, err)
-				return
-			}
-		case inMsg := <-handler.Incoming:
-			// HandleMessage Incoming messages
-			outMsg := handler.HandleMessage(&inMsg, piece)
-			if outMsg != nil {
-				handler.Outgoing <- *outMsg
-			}
-
-			// check if everything is downloaded
-			if piece.Buffer.Len() == piece.Len {
-
-				err := piece.SaveToFile()
-				if err != nil {
-					errs <- fmt.Errorf("%s: save fail idx=%d: %s", address, piece.Idx, err)
-					return
-				}
-
-				piece.Done = true
-				done <- piece
-				piece = nil
-			}
-
-		case err := <-handler.Errs:
-			// HandleMessage errors
-			errs <- fmt.Errorf("%s: error: %s", address, err)
-			if piece != nil {
-				piece.Done = false
-				done <- piece
-				piece = nil
-			}
-
-			return
-		default:
-			// is this a busy loop?
-			if piece == nil {
-				p, ok := <-todo
-				if ok {
-					piece = p
-					log.Printf("%s: starting downloading piece: idx=%d length=%d buf=%d\n", address, piece.Idx, piece.Len, piece.Buffer.Len())
-					// fake keep_alive message so that download begins
-					handler.Incoming <- *NewKeepAliveMessage()
-				} else {
-					time.Sleep(100 * time.Millisecond)
-				}
-			} else {
-				time.Sleep(100 * time.Millisecond)
-			}
 		}
 	}
 }
@@ -164,208 +119,326 @@ const (
 	OffsetMsgPieceIndex = OffsetMsgReqIndex
 	OffsetMsgPieceBegin = OffsetMsgReqBegin
 	OffsetMsgPieceBlock = OffsetMsgReqLength
+	OffsetMsgHaveIndex  = OffsetMsgReqIndex
+	OffsetMsgBitfield   = OffsetMsgReqIndex
+	LenMsgHave          = OffsetMsgHaveIndex + LenMsgInteger
 )
 
 type TorrentFile struct {
-	FilePath string
-	Announce string
-	Info     TorrentFileInfo
-	Progress TorrentProgress
+	FilePath string `bencode:"-"`
+	Announce string `bencode:"announce"`
+	// AnnounceList are the tiers of trackers (BEP 12), when present Announce is ignored
+	AnnounceList [][]string      `bencode:"announce-list,omitempty"`
+	Info         TorrentFileInfo `bencode:"-"`
+	// RawInfo is the info dict exactly as it was encoded, the info hash is calculated from it
+	RawInfo BencodeRawMessage `bencode:"info"`
+	// PieceLayers maps the pieces root of every v2 file larger than a piece to the concatenated piece hashes
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+	Progress    TorrentProgress   `bencode:"-"`
+	Trackers    *TrackerList      `bencode:"-"`
+	// Swarm is set while downloading, the peer workers exchange its peers with ut_pex unless the torrent is private
+	Swarm *Swarm `bencode:"-"`
+	// Choker is set while seeding, the peer workers add the bytes they receive to the download rate of their peer
+	Choker *Choker `bencode:"-"`
+
+	infoHash   [20]byte
+	infoHashV2 [32]byte
 }
 
 type TorrentFileInfo struct {
-	Length      int
-	Name        string
-	PieceLength int
-	Pieces      string
+	// Length is the total length of the torrent content, for multi-file torrents it is the sum of all Files.
+	// It is computed by validate and not part of the info dict, see FileLength.
+	Length int `bencode:"-"`
+	// FileLength is the "length" of single-file torrents
+	FileLength  int    `bencode:"length,omitempty"`
+	Name        string `bencode:"name"`
+	PieceLength int    `bencode:"piece length"`
+	Pieces      string `bencode:"pieces"`
+	// Private is 1 for private torrents (BEP 27), their peers only come from the trackers
+	Private int `bencode:"private,omitempty"`
+	// Files is nil for single-file torrents, for v2-only torrents it is generated from FileTree
+	Files []TorrentFileEntry `bencode:"files,omitempty"`
+	// MetaVersion is 2 for v2 and hybrid torrents
+	MetaVersion int                    `bencode:"meta version,omitempty"`
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
+	// PieceLayers are not part of the info dict, they are copied from the torrent file
+	PieceLayers map[string]string `bencode:"-"`
+
+	filesV2 []TorrentFileEntry
+	// received holds the piece hashes of v2 files that are not in PieceLayers, they are requested from the peers
+	received *receivedLayers
 }
 
-type TorrentProgress struct {
-	PeerID     [20]byte
-	Port       int
-	Uploaded   int
-	Downloaded int
-	Left       int
-	Compact    int
+type TorrentFileEntry struct {
+	Length int `bencode:"length"`
+	// Path components relative to the torrent root directory
+	Path   []string `bencode:"path"`
+	Md5sum string   `bencode:"md5sum,omitempty"`
+	// Attr contains 'p' for pad files
+	Attr string `bencode:"attr,omitempty"`
+	// PiecesRoot is the v2 merkle root of the file, empty for v1 files and empty files
+	PiecesRoot string `bencode:"-"`
+}
+
+func (info *TorrentFileInfo) IsMultiFile() bool {
+	return info.Files != nil
+}
+
+// IsPrivate reports whether the DHT, peer exchange and local service discovery must not be used (BEP 27)
+func (info *TorrentFileInfo) IsPrivate() bool {
+	return info.Private == 1
 }
 
-func getInfoValue[T comparable](info map[string]interface{}, key string, valueType T) (T, error) {
-	value, ok := info[key]
-	if !ok {
-		return valueType, fmt.Errorf("info.%s: no \"%s\" field, map=%v", key, key, info)
+// pexSwarm returns the Swarm to exchange with ut_pex, private torrents take their peers only from the trackers
+func (torrent *TorrentFile) pexSwarm() *Swarm {
+	if torrent.Info.IsPrivate() {
+		return nil
 	}
-	val, ok := value.(T)
-	if !ok {
-		return valueType, fmt.Errorf("info.%s: invalid \"%s\" field, map=%v", key, key, info)
+	return torrent.Swarm
+}
+
+func (info *TorrentFileInfo) PieceCount() int {
+	if !info.HasV1() {
+		return info.v2PieceCount()
 	}
-	return val, nil
+	return len(info.Pieces) / 20
 }
 
-func (torrent *TorrentFile) InfoHash() ([20]byte, error) {
-	// because we know that torrent file is valid, we can just use the file itself
-	data, err := os.ReadFile(torrent.FilePath)
-	if err != nil {
-		return [20]byte{}, err
+func (info *TorrentFileInfo) PieceLen(idx int) int {
+	if !info.HasV1() {
+		return info.v2PieceLen(idx)
+	}
+	if idx == info.PieceCount()-1 && info.Length%info.PieceLength != 0 {
+		return info.Length % info.PieceLength
+	}
+	return info.PieceLength
+}
+
+// PieceHash returns the SHA-1 hash of the piece, it is zero for v2-only torrents
+func (info *TorrentFileInfo) PieceHash(idx int) [20]byte {
+	if !info.HasV1() {
+		return [20]byte{}
+	}
+	return [20]byte([]byte(info.Pieces[idx*20 : idx*20+20]))
+}
+
+// NewPiece returns the piece idx with its length and hash filled in, the caller decides where it is saved
+func (info *TorrentFileInfo) NewPiece(idx int) *Piece {
+	piece := &Piece{
+		Idx:    idx,
+		Len:    info.PieceLen(idx),
+		Offset: int64(idx) * int64(info.PieceLength),
+		Hash:   info.PieceHash(idx),
+	}
+	info.setPieceV2(piece)
+	return piece
+}
+
+// setPieceV2 sets the merkle root of a v2 piece once it is known
+func (info *TorrentFileInfo) setPieceV2(piece *Piece) {
+	if !info.IsV2() {
+		return
+	}
+	if root, leaves, ok := info.PieceHashV2(piece.Idx); ok {
+		piece.V2 = &PieceV2{Root: root, Leaves: leaves, Len: info.v2PieceLen(piece.Idx)}
 	}
+}
+
+type TorrentProgress struct {
+	PeerID [20]byte
+	Port   int
+	// Uploaded, Downloaded and Left are updated by the peer workers while the announcer reads them
+	Uploaded   atomic.Int64
+	Downloaded atomic.Int64
+	Left       atomic.Int64
+	Compact    int
+}
 
-	// 4:infod<INFO_CONTENTS>e
-	infoStart := bytes.Index(data, []byte("4:info")) + 6
-	if infoStart < 0 {
+// InfoHash returns the v1 info hash, for v2-only torrents it is the v2 info hash truncated to 20 bytes
+// as used in the handshake and by trackers
+func (torrent *TorrentFile) InfoHash() ([20]byte, error) {
+	if torrent.RawInfo == nil {
 		return [20]byte{}, fmt.Errorf("TorrentFile.info: no info in torrent file")
 	}
-	return sha1.Sum(data[infoStart : len(data)-1]), nil
+	return torrent.infoHash, nil
+}
+
+// InfoHashV2 returns the SHA-256 of the info dict, ok is false for v1-only torrents
+func (torrent *TorrentFile) InfoHashV2() (hash [32]byte, ok bool) {
+	return torrent.infoHashV2, torrent.RawInfo != nil && torrent.Info.IsV2()
 }
 
 func NewTorrentFile(filePath string, port int) (*TorrentFile, error) {
-	f, err := os.Open(filePath)
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	stat, err := f.Stat()
+	torrent, err := NewTorrentFileFromBytes(data, port)
 	if err != nil {
 		return nil, err
 	}
-	stat.Size()
-	torrent := &TorrentFile{FilePath: filePath}
+	torrent.FilePath = filePath
 
-	buf := make([]byte, stat.Size())
-	size, err := f.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-	if len(buf) != size {
-		return nil, fmt.Errorf("did not read full torrent file, file Len: %d, read: %d", size, len(buf))
-	}
+	return torrent, nil
+}
 
-	d, _, err := DecodeBencodeDict(string(buf))
-	if err != nil {
+// NewTorrentFileFromBytes parses the contents of a torrent file
+func NewTorrentFileFromBytes(data []byte, port int) (*TorrentFile, error) {
+	torrent := &TorrentFile{}
+	if err := UnmarshalBencode(data, torrent); err != nil {
 		return nil, err
 	}
-
-	value, ok := d["announce"]
-	if !ok {
+	if torrent.Announce == "" && len(torrent.AnnounceList) == 0 {
 		return nil, fmt.Errorf("\"announce\" not found in torrent file")
 	}
-	announce, ok := value.(string)
-	if !ok {
-		return nil, fmt.Errorf("\"announce\" in torrent file is not BencodeString")
-	}
-	torrent.Announce = announce
-
-	value, ok = d["info"]
-	if !ok {
+	if torrent.RawInfo == nil {
 		return nil, fmt.Errorf("\"info\" not found in torrent file")
 	}
-	info, ok := value.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("\"info\" in torrent file is not BencodeDict")
-	}
 
-	torrent.Info.Length, err = getInfoValue(info, "length", torrent.Info.Length)
-	if err != nil {
-		return nil, err
+	return torrent, torrent.init(port)
+}
+
+// NewTorrentFileFromInfo is used when only the info dict is known, for example when it was received with ut_metadata
+func NewTorrentFileFromInfo(rawInfo []byte, announce string, port int) (*TorrentFile, error) {
+	torrent := &TorrentFile{
+		Announce: announce,
+		RawInfo:  BencodeRawMessage(rawInfo),
 	}
 
-	torrent.Info.Name, err = getInfoValue(info, "name", torrent.Info.Name)
-	if err != nil {
-		return nil, err
+	return torrent, torrent.init(port)
+}
+
+func (torrent *TorrentFile) init(port int) error {
+	if err := UnmarshalBencode(torrent.RawInfo, &torrent.Info); err != nil {
+		return err
+	}
+	torrent.Info.PieceLayers = torrent.PieceLayers
+	if err := torrent.Info.validate(); err != nil {
+		return err
 	}
 
-	torrent.Info.PieceLength, err = getInfoValue(info, "piece length", torrent.Info.PieceLength)
-	if err != nil {
-		return nil, err
+	if torrent.Info.HasV1() {
+		torrent.infoHash = sha1.Sum(torrent.RawInfo)
+	}
+	if torrent.Info.IsV2() {
+		torrent.infoHashV2 = sha256.Sum256(torrent.RawInfo)
+		if !torrent.Info.HasV1() {
+			copy(torrent.infoHash[:], torrent.infoHashV2[:])
+		}
 	}
 
-	torrent.Info.Pieces, err = getInfoValue(info, "pieces", torrent.Info.Pieces)
-	if err != nil {
-		return nil, err
+	var err error
+	if len(torrent.AnnounceList) != 0 {
+		torrent.Trackers = NewTrackerList(torrent.AnnounceList)
+	} else {
+		torrent.Trackers = NewTrackerList([][]string{{torrent.Announce}})
 	}
 
+	left := 0
+	for i := 0; i < torrent.Info.PieceCount(); i++ {
+		left += torrent.Info.PieceLen(i)
+	}
+	torrent.Progress.Left.Store(int64(left))
 	torrent.Progress.Compact = 1
 	torrent.Progress.Port = port
 	_, err = rand.Read(torrent.Progress.PeerID[:])
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate peer_id: %s\n", err)
+		return fmt.Errorf("failed to generate peer_id: %s\n", err)
 	}
 
-	return torrent, nil
+	return nil
 }
 
-func (torrent *TorrentFile) newTrackerRequestURL() (string, error) {
-	infoHash, err := torrent.InfoHash()
-	if err != nil {
-		return "", err
+// NewTorrentFileInfo parses the bencoded info dictionary of a torrent file or of ut_metadata
+func NewTorrentFileInfo(data []byte) (TorrentFileInfo, error) {
+	var fileInfo TorrentFileInfo
+	if err := UnmarshalBencode(data, &fileInfo); err != nil {
+		return fileInfo, err
 	}
-
-	trackerParams := url.Values{}
-	trackerParams.Set("info_hash", string(infoHash[:]))
-	trackerParams.Set("peer_id", string(torrent.Progress.PeerID[:]))
-	trackerParams.Set("port", strconv.Itoa(torrent.Progress.Port))
-	trackerParams.Set("uploaded", strconv.Itoa(torrent.Progress.Uploaded))
-	trackerParams.Set("downloaded", strconv.Itoa(torrent.Progress.Downloaded))
-	// TODO: this should be calculated in the future
-	trackerParams.Set("left", strconv.Itoa(torrent.Info.Length))
-	trackerParams.Set("compact", strconv.Itoa(torrent.Progress.Compact))
-
-	trackerRequestURL := fmt.Sprintf("%s?%s", torrent.Announce, trackerParams.Encode())
-	return trackerRequestURL, nil
+	return fileInfo, fileInfo.validate()
 }
 
-func (torrent *TorrentFile) GetTrackerResponse() (*TrackerResponse, error) {
-	trackerRequestURL, err := torrent.newTrackerRequestURL()
-	if err != nil {
-		return nil, err
+// validate checks the required fields and computes Length
+func (info *TorrentFileInfo) validate() error {
+	if info.Name == "" {
+		return fmt.Errorf("info.name: no \"name\" field")
 	}
-	//fmt.Println(trackerRequestURL)
-	resp, err := http.Get(trackerRequestURL)
-	if err != nil {
-		return nil, err
+
+	if info.PieceLength <= 0 {
+		return fmt.Errorf("info.piece length: invalid value %d", info.PieceLength)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	switch info.MetaVersion {
+	case 0:
+	case 2:
+		if err := info.validateV2(); err != nil {
+			return err
+		}
+		if !info.HasV1() {
+			return nil
+		}
+	default:
+		return fmt.Errorf("info.meta version: unsupported version %d", info.MetaVersion)
 	}
 
-	trackerResponse, _, err := DecodeBencodeDict(string(body))
-	if err != nil {
-		return nil, err
+	if len(info.Pieces)%20 != 0 {
+		return fmt.Errorf("info.pieces: length %d is not a multiple of 20", len(info.Pieces))
 	}
 
-	response := &TrackerResponse{Peers: make([]TrackerPeer, 0)}
-	peers, err := getInfoValue(trackerResponse, "peers", "")
-	if err != nil {
-		return nil, err
+	if info.IsMultiFile() {
+		info.Length = 0
+		for i, file := range info.Files {
+			if file.Length < 0 {
+				return fmt.Errorf("info.files[%d].length: invalid value %d", i, file.Length)
+			}
+			if len(file.Path) == 0 {
+				return fmt.Errorf("info.files[%d].path: expected non-empty list", i)
+			}
+			info.Length += file.Length
+		}
+	} else {
+		info.Length = info.FileLength
 	}
 
-	for i := 0; i < len(peers); i += 6 {
-		response.Peers = append(response.Peers, TrackerPeer{Ip: net.IPv4(peers[i], peers[i+1], peers[i+2], peers[i+3]), Port: int(binary.BigEndian.Uint16([]byte(peers[i+4:])))})
+	if info.Length < 0 {
+		return fmt.Errorf("info.length: invalid value %d", info.Length)
+	}
+	if expected := (info.Length + info.PieceLength - 1) / info.PieceLength; expected != info.PieceCount() {
+		return fmt.Errorf("info.pieces: expected %d pieces, got %d", expected, info.PieceCount())
 	}
 
-	// optional
-	response.Interval, err = getInfoValue(trackerResponse, "interval", response.Interval)
-	if err != nil {
-		response.Interval = -1
+	if info.IsHybrid() {
+		return info.validateHybrid()
 	}
 
-	return response, nil
+	return nil
 }
 
-type TrackerResponse struct {
-	Interval int
-	Peers    []TrackerPeer
-}
+func (torrent *TorrentFile) newAnnounceRequest() (*AnnounceRequest, error) {
+	infoHash, err := torrent.InfoHash()
+	if err != nil {
+		return nil, err
+	}
 
-type TrackerPeer struct {
-	Ip   net.IP
-	Port int
+	return &AnnounceRequest{
+		InfoHash:   infoHash,
+		PeerID:     torrent.Progress.PeerID,
+		Port:       torrent.Progress.Port,
+		Uploaded:   int(torrent.Progress.Uploaded.Load()),
+		Downloaded: int(torrent.Progress.Downloaded.Load()),
+		Left:       int(torrent.Progress.Left.Load()),
+		Compact:    torrent.Progress.Compact,
+	}, nil
 }
 
-func (peer TrackerPeer) String() string {
-	return fmt.Sprintf("%s:%d", peer.Ip, peer.Port)
+func (torrent *TorrentFile) GetTrackerResponse() (*TrackerResponse, error) {
+	request, err := torrent.newAnnounceRequest()
+	if err != nil {
+		return nil, err
+	}
+	response, _, err := torrent.Trackers.Announce(context.Background(), request)
+	return response, err
 }
 
 type MessageType uint8
@@ -381,10 +454,13 @@ const (
 	PIECE
 	CANCEL
 	PORT
-	EXTENDED   MessageType = 20
-	KEEP_ALIVE MessageType = 100
-	HANDSHAKE  MessageType = 101
-	INVALID    MessageType = 102
+	EXTENDED     MessageType = 20
+	HASH_REQUEST MessageType = 21
+	HASHES       MessageType = 22
+	HASH_REJECT  MessageType = 23
+	KEEP_ALIVE   MessageType = 100
+	HANDSHAKE    MessageType = 101
+	INVALID      MessageType = 102
 )
 
 var MessageTypeNames = map[MessageType]string{
@@ -399,6 +475,9 @@ var MessageTypeNames = map[MessageType]string{
 	CANCEL:         "CANCEL",
 	PORT:           "PORT",
 	EXTENDED:       "EXTENDED",
+	HASH_REQUEST:   "HASH_REQUEST",
+	HASHES:         "HASHES",
+	HASH_REJECT:    "HASH_REJECT",
 	KEEP_ALIVE:     "KEEP_ALIVE",
 	HANDSHAKE:      "HANDSHAKE",
 	INVALID:        "INVALID",
@@ -410,7 +489,6 @@ const (
 	LEN_MESSAGE_INDEX        = 4
 	LEN_MESSAGE_BEGIN        = 4
 	LEN_PIECE_BLOCK_STANDARD = 16 * 1024
-	LEN_MESSAGE_MAX          = LEN_PREFIX + LEN_MESSAGE_ID + LEN_MESSAGE_INDEX + LEN_MESSAGE_BEGIN + LEN_PIECE_BLOCK_STANDARD
 	LEN_HANDSHAKE            = 68
 )
 
@@ -420,7 +498,10 @@ const (
 )
 
 func (t MessageType) String() string {
-	return MessageTypeNames[t]
+	if name, ok := MessageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%d)", t)
 }
 
 var (
@@ -490,49 +571,163 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
-func ContainsMessage(b []byte) (bool, int) {
-	if len(b) < LEN_PREFIX {
-		return false, 0
+type Piece struct {
+	Idx  int
+	Len  int
+	Done bool
+	// Path is used when Storage is nil, the piece is then saved as a separate file
+	Path string
+	// Storage and Offset define where the piece is saved within the torrent content
+	Storage io.WriterAt
+	Offset  int64
+	// Hash is zero for v2-only torrents
+	Hash [20]byte
+	// V2 is set for v2 and hybrid torrents when the merkle root of the piece is known
+	V2       *PieceV2
+	PeerId   [20]byte
+	InfoHash [20]byte
+	// Data is the content of the piece, blocks are placed at their offset as they arrive
+	Data []byte
+
+	// mu guards Data and the blocks, in endgame mode several peers put the blocks of the piece
+	mu sync.Mutex
+	// blocks has a bit for every received block of LEN_PIECE_BLOCK_STANDARD bytes
+	blocks Bitfield
+	// finishing is set for the peer that saves the complete piece
+	finishing bool
+}
+
+type PieceV2 struct {
+	Root [32]byte
+	// Leaves is the number of 16 KiB blocks of the merkle tree, missing blocks are zero hashes
+	Leaves int
+	// Len excludes the padding of hybrid torrents that follows the end of the file
+	Len int
+}
+
+// BlockCount returns the number of blocks of the piece, the last one may be shorter than LEN_PIECE_BLOCK_STANDARD
+func (piece *Piece) BlockCount() int {
+	return (piece.Len + LEN_PIECE_BLOCK_STANDARD - 1) / LEN_PIECE_BLOCK_STANDARD
+}
+
+// BlockLen returns the length of the block at begin
+func (piece *Piece) BlockLen(begin int) int {
+	return min(LEN_PIECE_BLOCK_STANDARD, piece.Len-begin)
+}
+
+func (piece *Piece) HasBlock(begin int) bool {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	return piece.blocks.Has(begin / LEN_PIECE_BLOCK_STANDARD)
+}
+
+// PutBlock copies the block to its offset. Blocks have to start at a block boundary, have the length
+// of the block and must not be received twice.
+func (piece *Piece) PutBlock(begin int, block []byte) error {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	if begin < 0 || begin >= piece.Len || begin%LEN_PIECE_BLOCK_STANDARD != 0 {
+		return fmt.Errorf("piece %d: invalid block begin %d", piece.Idx, begin)
+	}
+	if len(block) != piece.BlockLen(begin) {
+		return fmt.Errorf("piece %d: block at %d has length %d, expected %d", piece.Idx, begin, len(block), piece.BlockLen(begin))
+	}
+	if piece.blocks.Has(begin / LEN_PIECE_BLOCK_STANDARD) {
+		return fmt.Errorf("piece %d: block at %d was already received", piece.Idx, begin)
 	}
 
-	// FIXME: this might not always be the case
-	if b[0] == 19 && len(b) >= LEN_HANDSHAKE {
-		return true, LEN_HANDSHAKE
+	if piece.blocks == nil {
+		piece.blocks = NewBitfield(piece.BlockCount())
+	}
+	if len(piece.Data) != piece.Len {
+		piece.Data = make([]byte, piece.Len)
 	}
+	copy(piece.Data[begin:], block)
+	piece.blocks.Set(begin / LEN_PIECE_BLOCK_STANDARD)
+	return nil
+}
+
+// Complete reports whether all blocks were received
+func (piece *Piece) Complete() bool {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	return piece.blocks.Count() == piece.BlockCount()
+}
 
-	length := int(binary.BigEndian.Uint32(b[0:LEN_PREFIX]))
+// finish reports whether the caller is the first to finish the complete piece, only that peer saves it
+func (piece *Piece) finish() bool {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
 
-	if len(b) < length+LEN_PREFIX {
-		return false, 0
+	if piece.finishing || piece.blocks.Count() != piece.BlockCount() {
+		return false
 	}
+	piece.finishing = true
+	return true
+}
 
-	return true, LEN_PREFIX + length
+// Reset forgets the received blocks, for example to download the piece again after it failed
+func (piece *Piece) Reset() {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	piece.Data = nil
+	piece.blocks = nil
+	piece.finishing = false
 }
 
-type Piece struct {
-	Idx      int
-	Len      int
-	Done     bool
-	Path     string
-	Hash     [20]byte
-	PeerId   [20]byte
-	InfoHash [20]byte
-	Buffer   bytes.Buffer
+// data returns Data, it is no longer written once the piece is complete
+func (piece *Piece) data() []byte {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	return piece.Data
+}
+
+// Verify checks the downloaded data against the v1 and the v2 hash, whichever are known
+func (piece *Piece) Verify() error {
+	data := piece.data()
+
+	if piece.V2 != nil {
+		if len(data) < piece.V2.Len || !VerifyMerkle(data[:piece.V2.Len], piece.V2.Root, piece.V2.Leaves) {
+			return fmt.Errorf("merkle root mismatch: expected %x", piece.V2.Root)
+		}
+	} else if piece.Hash == [20]byte{} {
+		return fmt.Errorf("no hash known for piece %d", piece.Idx)
+	}
+
+	if piece.Hash != [20]byte{} {
+		if receivedHash := sha1.Sum(data); receivedHash != piece.Hash {
+			return fmt.Errorf("hash mismatch: expected %x, received %x", piece.Hash, receivedHash)
+		}
+	}
+
+	return nil
 }
 
 func (piece *Piece) SaveToFile() error {
-	receivedHash := sha1.Sum(piece.Buffer.Bytes())
+	if err := piece.Verify(); err != nil {
+		return err
+	}
 
-	if receivedHash != piece.Hash {
-		return fmt.Errorf("hash mismatch: expected %x, received %x", piece.Hash, receivedHash)
+	data := piece.data()
+	if piece.Storage != nil {
+		if _, err := piece.Storage.WriteAt(data, piece.Offset); err != nil {
+			return fmt.Errorf("failed to write piece to storage: %s", err)
+		}
+		return nil
 	}
+
 	output, err := os.Create(piece.Path)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %s\n", err)
 	}
 	defer output.Close()
 
-	if _, err = output.Write(piece.Buffer.Bytes()); err != nil {
+	if _, err = output.Write(data); err != nil {
 		return fmt.Errorf("failed to create output file: %s\n", err)
 	}
 
@@ -544,6 +739,9 @@ type PeerStateHandler struct {
 	Incoming  chan Message
 	Errs      chan error
 	PeerState *PeerState
+	Pipeline  *RequestPipeline
+	// Picker receives the pieces that the peer announces, it may be nil
+	Picker *PiecePicker
 }
 
 func NewPeerStateHandler() *PeerStateHandler {
@@ -552,78 +750,149 @@ func NewPeerStateHandler() *PeerStateHandler {
 		Incoming:  make(chan Message, 10),
 		Errs:      make(chan error, 2),
 		PeerState: NewPeerState(),
+		Pipeline:  NewRequestPipeline(),
+	}
+}
+
+// HandleExtendedMessage records the extension handshake and adds the peers of ut_pex messages to swarm
+func (handler *PeerStateHandler) HandleExtendedMessage(msg *ExtendedMessage, swarm *Swarm) error {
+	if msg.IsHandshake() {
+		var handshake ExtensionHandshake
+		if _, err := msg.UnmarshalDict(&handshake); err != nil {
+			return fmt.Errorf("extension handshake: %s", err)
+		}
+		handler.PeerState.Extensions = handshake.M
+		return nil
+	}
+
+	// the peer uses the ids of our extension handshake
+	switch ExtensionName(msg.ExtensionMessageId()) {
+	case PexExtensionName:
+		pex, err := ParsePexMessage(msg)
+		if err != nil {
+			return err
+		}
+		added, _, err := pex.Peers()
+		if err != nil {
+			return err
+		}
+		if swarm != nil {
+			peers := make([]TrackerPeer, len(added))
+			for i, peer := range added {
+				peers[i] = peer.TrackerPeer
+			}
+			swarm.AddPeers(peers)
+		}
 	}
+	return nil
 }
 
 // HandleMessage should be called only AFTER the Handshake message was sent!
-// TODO: we need to pass Piece information so that HandleMessage() can ask for blocks?
-func (handler *PeerStateHandler) HandleMessage(msg *Message, piece *Piece) *Message {
-	// do handshake first
-	// TODO: when using iota you need default case?!
-	//log.Printf("Handling message type: %s", msg.Type())
-	switch t := msg.Type(); t {
-	case HANDSHAKE:
+// It returns the messages to send, the requests for the blocks of pieces are pipelined.
+// An error is returned for an invalid message, the connection should be closed then.
+func (handler *PeerStateHandler) HandleMessage(msg *Message, pieces []*Piece) ([]*Message, error) {
+	if msg.Type() == HANDSHAKE {
 		handler.PeerState.Done_handshake = true
-	case UNCHOKE:
+		return handler.Requests(pieces), nil
+	}
+
+	decoded, err := DecodeMessage(msg)
+	if errors.Is(err, ErrUnknownMessage) {
+		// EXTENDED messages are handled by HandleExtendedMessage, unknown messages are ignored
+		return handler.Requests(pieces), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch m := decoded.(type) {
+	case UnchokeMsg:
 		handler.PeerState.peer_choking = false
-	case CHOKE:
+	case ChokeMsg:
 		handler.PeerState.peer_choking = true
-	case PIECE:
-		if piece != nil {
-			// add to the buffer
-			//log.Printf("HandleMessage: received piece - cur=%d recv=%d", piece.Buffer.Len(), Len(msg.AsPiece().Block()))
-
-			piece.Buffer.Write(msg.AsPiece().Block())
-		} else {
-			//log.Printf("HandleMessage: received %q but no active piece!", t)
-			return nil
+		handler.Pipeline.Choked()
+	case BitfieldMsg:
+		previous := handler.PeerState.pieces
+		if err := handler.PeerState.SetBitfield(m.Bitfield); err != nil {
+			return nil, err
+		}
+		if handler.Picker != nil {
+			handler.Picker.RemovePeer(previous)
+			handler.Picker.AddPeer(handler.PeerState.pieces)
+		}
+	case HaveMsg:
+		had := handler.PeerState.Has(m.Index)
+		if err := handler.PeerState.SetHave(m.Index); err != nil {
+			return nil, err
+		}
+		if handler.Picker != nil && !had {
+			handler.Picker.Have(m.Index)
+		}
+	case PieceMsg:
+		var piece *Piece
+		for _, p := range pieces {
+			if p.Idx == m.Index {
+				piece = p
+			}
+		}
+		if piece == nil {
+			log.Printf("dropped block: piece %d is not downloaded", m.Index)
+		} else if err := handler.Pipeline.Received(piece, m.Index, m.Begin, m.Block); err != nil {
+			log.Printf("dropped block: %s", err)
+		} else if handler.Picker != nil {
+			// other peers of the piece cancel their request of the block
+			handler.Picker.Received(piece)
 		}
 	}
 
-	// TODO: should send these messages only when handshake is done
+	return handler.Requests(pieces), nil
+}
+
+// Requests returns the messages that download pieces: INTERESTED first, the pipelined block requests once the
+// peer unchoked us, in the order of pieces. Without pieces NOT_INTERESTED is returned if we were interested.
+func (handler *PeerStateHandler) Requests(pieces []*Piece) []*Message {
 	if !handler.PeerState.Done_handshake {
-		//panic("Handshake message was not received!")
-		// FIXME: is it ok to wait for handshake?
 		return nil
 	}
 
-	if piece == nil {
-		// TODO: here we should set ourselves not_interested
-		return nil
-	} else {
-		// TODO: what to do if peer_choking?
-		if !handler.PeerState.am_interested {
-			handler.PeerState.am_interested = true
-			//log.Printf("Sending interested")
-			return NewInterestedMessage()
-		}
-
-		// TODO: is this ok to wait for unchoke? or should we initiate ourselves?
-		if handler.PeerState.peer_choking {
-			return nil
+	if len(pieces) == 0 {
+		if handler.PeerState.am_interested {
+			handler.PeerState.am_interested = false
+			return []*Message{NewNotInterestedMessage()}
 		}
+		return nil
+	}
 
-		if piece.Buffer.Len() < piece.Len {
-			blockLength := LEN_PIECE_BLOCK_STANDARD
-			if piece.Buffer.Len()+blockLength > piece.Len {
-				blockLength = piece.Len - piece.Buffer.Len()
-			}
-
-			//log.Printf("sending request: idx=%d begin=%d length=%d", piece.Idx, piece.Buffer.Len(), blockLength)
+	var msgs []*Message
+	if !handler.PeerState.am_interested {
+		handler.PeerState.am_interested = true
+		msgs = append(msgs, NewInterestedMessage())
+	}
 
-			return NewRequestMessage(piece.Idx, piece.Buffer.Len(), blockLength)
-		}
+	// the peer unchokes us when it wants to, it may still be unchoked from the previous piece
+	if handler.PeerState.peer_choking {
+		return msgs
 	}
 
-	return nil
+	for _, piece := range pieces {
+		msgs = append(msgs, handler.Pipeline.Requests(piece)...)
+	}
+	return msgs
 }
 
 type PeerState struct {
-	Done_handshake  bool
+	Done_handshake bool
+	// Extensions maps the extension names of the peer's extension handshake to its message ids
+	Extensions      map[string]int
 	am_choking      bool
 	am_interested   bool
 	peer_choking    bool
 	peer_interested bool
+	// pieces is the bitfield of the peer, it is updated by HAVE messages
+	pieces Bitfield
+	// pieceCount is zero until the info of the torrent is known, the bitfield is validated then
+	pieceCount       int
+	bitfieldReceived bool
 }
 
 func NewPeerState() *PeerState {
@@ -633,50 +902,66 @@ func NewPeerState() *PeerState {
 	}
 }
 
-func HandleIncomingMessages(conn net.Conn, in chan<- Message, errs chan<- error) {
-	// FIXME: context is required here for graceful shutdown
-	buf := make([]byte, LEN_MESSAGE_MAX)
-	tail := 0
-	for {
-		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+// SetPieceCount validates the pieces that were announced before the number of pieces was known
+func (state *PeerState) SetPieceCount(count int) error {
+	if state.bitfieldReceived {
+		if err := state.pieces.Validate(count); err != nil {
+			return err
+		}
+	}
 
-		n, err := conn.Read(buf[tail:])
-		if err != nil {
-			var netErr net.Error
-			if errors.As(err, &netErr) && netErr.Timeout() {
-				// just retry
-				continue
-			}
-			errs <- fmt.Errorf("read err: %s", err)
-			return
+	pieces := NewBitfield(count)
+	for idx := 0; idx < len(state.pieces)*8; idx++ {
+		if !state.pieces.Has(idx) {
+			continue
 		}
-		tail += n
-
-		//log.Printf("Incoming message: tail=%d", tail)
-
-		// TODO: this is very inefficient
-		head := 0
-		for head < tail {
-			ok, length := ContainsMessage(buf[head:tail])
-			if !ok {
-				// if were not at the start, we need to copy
-				//log.Printf("No msg: head=%d tail=%d", head, tail)
-				if head != 0 {
-					copy(buf, buf[head:tail])
-				}
-				tail -= head
-				// wait for more Data
-				break
-			}
-			//log.Printf("containsMessage, head=%d, tail=%d, Len=%d", head, tail, length)
-			in <- MessageFromBytes(buf[head : head+length])
-			head += length
+		if idx >= count {
+			return fmt.Errorf("peer has invalid piece %d", idx)
 		}
+		pieces.Set(idx)
+	}
+	state.pieces = pieces
+	state.pieceCount = count
+	return nil
+}
 
-		if head == tail {
-			tail = 0
+// SetBitfield replaces the pieces of the peer with the bitfield of a BITFIELD message
+func (state *PeerState) SetBitfield(bitfield Bitfield) error {
+	if state.pieceCount != 0 {
+		if err := bitfield.Validate(state.pieceCount); err != nil {
+			return err
 		}
 	}
+	state.pieces = append(Bitfield(nil), bitfield...)
+	state.bitfieldReceived = true
+	return nil
+}
+
+// SetHave adds the piece of a HAVE message to the pieces of the peer
+func (state *PeerState) SetHave(idx int) error {
+	if idx < 0 || (state.pieceCount != 0 && idx >= state.pieceCount) {
+		return fmt.Errorf("peer has invalid piece %d", idx)
+	}
+	if idx/8 >= len(state.pieces) {
+		pieces := NewBitfield(idx + 1)
+		copy(pieces, state.pieces)
+		state.pieces = pieces
+	}
+	state.pieces.Set(idx)
+	return nil
+}
+
+// Has reports whether the peer announced the piece with BITFIELD or HAVE
+func (state *PeerState) Has(idx int) bool {
+	return state.pieces.Has(idx)
+}
+
+// HandleIncomingMessages reads the handshake and the messages of conn until ctx is canceled or reading fails,
+// see MessageReader.Run. The messages are limited to DefaultMaxMessageLength.
+func HandleIncomingMessages(ctx context.Context, conn net.Conn, in chan<- Message, errs chan<- error) {
+	reader := NewMessageReader(conn)
+	reader.ExpectHandshake = true
+	reader.Run(ctx, in, errs)
 }
 
 func NewHandshakeMessage(peerId [20]byte, infoHash [20]byte) *Message {
@@ -694,42 +979,46 @@ func NewHandshakeMessage(peerId [20]byte, infoHash [20]byte) *Message {
 	return msg
 }
 
+// The constructors below encode the typed messages of codec.go
+
 func NewInterestedMessage() *Message {
-	msg := &Message{
-		Data: []byte{0, 0, 0, 1, byte(INTERESTED)},
-		Len:  5,
-	}
+	return InterestedMsg{}.Encode()
+}
 
-	return msg
+func NewNotInterestedMessage() *Message {
+	return NotInterestedMsg{}.Encode()
 }
 
 func NewRequestMessage(index, begin, length int) *Message {
-	const (
-		offsetIndex  = LEN_PREFIX + LEN_MESSAGE_ID
-		offsetBegin  = offsetIndex + 4
-		offsetLength = offsetBegin + 4
-		msgLength    = offsetLength + 4
-	)
+	return RequestMsg{Index: index, Begin: begin, Length: length}.Encode()
+}
 
-	msg := &Message{
-		Data: make([]byte, msgLength),
-		Len:  msgLength,
-	}
-	// Len=0013
-	msg.Data[3] = msgLength - 4
-	msg.Data[4] = byte(REQUEST)
-	binary.BigEndian.PutUint32(msg.Data[offsetIndex:], uint32(index))
-	binary.BigEndian.PutUint32(msg.Data[offsetBegin:], uint32(begin))
-	binary.BigEndian.PutUint32(msg.Data[offsetLength:], uint32(length))
+func NewCancelMessage(index, begin, length int) *Message {
+	return CancelMsg{Index: index, Begin: begin, Length: length}.Encode()
+}
 
-	return msg
+func NewChokeMessage() *Message {
+	return ChokeMsg{}.Encode()
+}
+
+func NewUnchokeMessage() *Message {
+	return UnchokeMsg{}.Encode()
+}
+
+func NewHaveMessage(index int) *Message {
+	return HaveMsg{Index: index}.Encode()
+}
+
+func NewBitfieldMessage(bitfield Bitfield) *Message {
+	return BitfieldMsg{Bitfield: bitfield}.Encode()
+}
+
+func NewPieceMessage(index, begin int, block []byte) *Message {
+	return PieceMsg{Index: index, Begin: begin, Block: block}.Encode()
 }
 
 func NewKeepAliveMessage() *Message {
-	return &Message{
-		Data: make([]byte, 4),
-		Len:  4,
-	}
+	return KeepAliveMsg{}.Encode()
 }
 
 func NewExtendedMessage() *ExtendedMessage {
@@ -741,25 +1030,6 @@ func NewExtendedMessage() *ExtendedMessage {
 	return &ExtendedMessage{Message: msg}
 }
 
-type PieceMessage struct {
-	Message
-}
-
-// TODO: implement other methods
-func (p *PieceMessage) Block() []byte {
-	const (
-		index = LEN_PREFIX + LEN_MESSAGE_ID
-		begin = index + 4
-		block = begin + 4
-	)
-
-	return p.Data[block:p.Len]
-}
-
-func (m *Message) AsPiece() *PieceMessage {
-	return &PieceMessage{Message: *m}
-}
-
 type HandshakeMessage struct {
 	Message
 }
@@ -774,10 +1044,25 @@ func (handshake *HandshakeMessage) HasExtensions() bool {
 	return (handshake.Data[offsetExtensionByte] & 0x10) == 0x10
 }
 
+// Validate checks the protocol of the handshake and that the peer serves the torrent with infoHash
+func (handshake *HandshakeMessage) Validate(infoHash [20]byte) error {
+	if string(handshake.Data[OffsetHandshakePstr:OffsetHandshakeReserved]) != "BitTorrent protocol" {
+		return errors.New("invalid handshake: unknown protocol")
+	}
+	if got := handshake.InfoHash(); got != infoHash {
+		return fmt.Errorf("invalid handshake: info hash %x, expected %x", got, infoHash)
+	}
+	return nil
+}
+
 func (handshake *HandshakeMessage) PeerId() [20]byte {
 	return [20]byte(handshake.Data[OffsetHandshakePeerId : OffsetHandshakePeerId+20])
 }
 
+func (handshake *HandshakeMessage) InfoHash() [20]byte {
+	return [20]byte(handshake.Data[OffsetHandshakeInfoHash : OffsetHandshakeInfoHash+20])
+}
+
 func (m *Message) AsHandshake() *HandshakeMessage {
 	return &HandshakeMessage{Message: *m}
 }
@@ -806,23 +1091,17 @@ func (m *ExtendedMessage) ExtensionDict() []byte {
 	return m.Data[OFF_EXTENDED_DICT:m.Len]
 }
 
+// AddDict appends the bencoded d, an error is returned if d can not be encoded
 // TODO: why here I need to give the pointer back, otherwise no changes are visible after calling it?
-func (m *ExtendedMessage) AddDict(d map[string]interface{}) *ExtendedMessage {
-	encodedD := BencodeDict(d)
+func (m *ExtendedMessage) AddDict(d interface{}) (*ExtendedMessage, error) {
+	encodedD, err := EncodeBencode(d)
+	if err != nil {
+		return nil, fmt.Errorf("extended message: %w", err)
+	}
 	m.Len = 6 + len(encodedD)
-	//fmt.Printf("Encoded Len: %d\n", m.Len)
 	// FIXME: this is where the slice is changed, thus not being a reference anymore to the original
 	m.Data = append(m.Data, encodedD...)
-
-	//decoded, err := DecodeBencode(string(m.ExtensionDict()))
-	//if err != nil {
-	//	panic("Failed to decode dict:" + err.Error())
-	//}
-	//fmt.Printf("Encoded l=%d s: %q\n", Len(encodedD), encodedD)
-	//fmt.Printf("Encoded dict: %q\n", decoded)
 	binary.BigEndian.PutUint32(m.Data, uint32(2+len(encodedD)))
-	//fmt.Printf("%x ", m.Data)
-	//fmt.Printf("Encoded: %x \n", m.Data)
 
-	return m
+	return m, nil
 }
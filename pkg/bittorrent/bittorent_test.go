@@ -0,0 +1,128 @@
+package bittorrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+)
+
+func TestTorrentFileInfoHash(t *testing.T) {
+	tests := []struct {
+		path string
+		hash string
+	}{
+		{"../../sample.torrent", "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"},
+		// "url-list" follows "info"
+		{"../../big-buck-bunny.torrent", "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c"},
+	}
+
+	for _, v := range tests {
+		torrent, err := NewTorrentFile(v.path, 1234)
+		if err != nil {
+			t.Fatalf("%s: %s", v.path, err)
+		}
+		hash, err := torrent.InfoHash()
+		if err != nil {
+			t.Fatalf("%s: %s", v.path, err)
+		}
+		if got := hex.EncodeToString(hash[:]); got != v.hash {
+			t.Errorf("%s: got %s want %s", v.path, got, v.hash)
+		}
+	}
+}
+
+func TestTorrentFileInfoHashAnyKeyOrder(t *testing.T) {
+	// keys are deliberately not sorted: "4:info" appears in the comment before the real info dict,
+	// and info is followed by another key
+	info := "d6:lengthi3e4:name1:a12:piece lengthi4e6:pieces20:01234567890123456789e"
+	data := "d7:comment10:4:infod1:x8:announce9:http://a/4:info" + info + "8:url-listl8:http://bee"
+
+	torrent, err := NewTorrentFileFromBytes([]byte(data), 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := torrent.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha1.Sum([]byte(info)); hash != want {
+		t.Errorf("got %x want %x", hash, want)
+	}
+	if string(torrent.RawInfo) != info {
+		t.Errorf("got raw info %q want %q", torrent.RawInfo, info)
+	}
+	if torrent.Info.Length != 3 || torrent.Info.Name != "a" {
+		t.Errorf("unexpected info %+v", torrent.Info)
+	}
+}
+
+func TestTorrentFilePrivate(t *testing.T) {
+	for _, v := range []struct {
+		info    string
+		private bool
+	}{
+		{"d6:lengthi3e4:name1:a12:piece lengthi4e6:pieces20:01234567890123456789e", false},
+		{"d6:lengthi3e4:name1:a12:piece lengthi4e6:pieces20:012345678901234567897:privatei1ee", true},
+		{"d6:lengthi3e4:name1:a12:piece lengthi4e6:pieces20:012345678901234567897:privatei0ee", false},
+	} {
+		info, err := NewTorrentFileInfo([]byte(v.info))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsPrivate() != v.private {
+			t.Errorf("%s: private %t, want %t", v.info, info.IsPrivate(), v.private)
+		}
+	}
+}
+
+func TestNewTorrentFileMissingInfo(t *testing.T) {
+	if _, err := NewTorrentFileFromBytes([]byte("d8:announce9:http://a/e"), 1234); err == nil {
+		t.Errorf("expected error for missing info")
+	}
+}
+
+func TestPiecePutBlock(t *testing.T) {
+	piece := &Piece{Idx: 2, Len: 2*LEN_PIECE_BLOCK_STANDARD + 10}
+	if piece.BlockCount() != 3 || piece.BlockLen(2*LEN_PIECE_BLOCK_STANDARD) != 10 {
+		t.Fatalf("block count %d, last block length %d", piece.BlockCount(), piece.BlockLen(2*LEN_PIECE_BLOCK_STANDARD))
+	}
+
+	last := []byte("0123456789")
+	if err := piece.PutBlock(2*LEN_PIECE_BLOCK_STANDARD, last); err != nil {
+		t.Fatal(err)
+	}
+	if string(piece.Data[2*LEN_PIECE_BLOCK_STANDARD:]) != string(last) {
+		t.Error("block was not placed at its offset")
+	}
+
+	invalid := []struct {
+		name  string
+		begin int
+		block []byte
+	}{
+		{"unaligned", 100, make([]byte, LEN_PIECE_BLOCK_STANDARD)},
+		{"beyond the end", 3 * LEN_PIECE_BLOCK_STANDARD, last},
+		{"short", 0, make([]byte, 100)},
+		{"duplicate", 2 * LEN_PIECE_BLOCK_STANDARD, last},
+	}
+	for _, v := range invalid {
+		if err := piece.PutBlock(v.begin, v.block); err == nil {
+			t.Errorf("%s block was accepted", v.name)
+		}
+	}
+
+	piece.PutBlock(LEN_PIECE_BLOCK_STANDARD, make([]byte, LEN_PIECE_BLOCK_STANDARD))
+	if piece.Complete() {
+		t.Error("piece is complete with a missing block")
+	}
+	piece.PutBlock(0, make([]byte, LEN_PIECE_BLOCK_STANDARD))
+	if !piece.Complete() {
+		t.Error("piece is not complete after all blocks")
+	}
+
+	piece.Reset()
+	if piece.Complete() || piece.HasBlock(0) {
+		t.Error("piece keeps its blocks after a reset")
+	}
+}
@@ -0,0 +1,224 @@
+package bittorrent
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ChokeInterval is the time between two choking decisions
+	ChokeInterval = 10 * time.Second
+	// OptimisticUnchokeInterval is the time after which the optimistic unchoke moves on to another peer
+	OptimisticUnchokeInterval = 30 * time.Second
+	// DefaultUploadSlots is the number of peers that are unchoked for their rate, the optimistic unchoke is extra
+	DefaultUploadSlots = 4
+	// chokerNewPeerAge is the age of connections that are three times as likely to be unchoked optimistically
+	chokerNewPeerAge = time.Minute
+)
+
+// ChokerPeer is a connection whose choking is decided by the Choker
+type ChokerPeer struct {
+	// Downloaded and Uploaded count the block bytes received from and sent to the peer
+	Downloaded atomic.Int64
+	Uploaded   atomic.Int64
+
+	// choke receives the latest decision of the choker
+	choke chan bool
+	// host is the IP of the peer, "" when unknown
+	host string
+
+	// guarded by Choker.mu
+	interested     bool
+	choked         bool
+	connected      time.Time
+	lastDownloaded int64
+	lastUploaded   int64
+	rate           int64
+}
+
+// Choke receives true when the peer has to be choked and false when it can be unchoked,
+// only the latest decision is kept
+func (peer *ChokerPeer) Choke() <-chan bool {
+	return peer.choke
+}
+
+// Choker implements tit-for-tat: every ChokeInterval the interested peers that gave us the most data are
+// unchoked, or the peers that took the most data when we are seeding. One more peer is unchoked optimistically,
+// it changes every OptimisticUnchokeInterval so that new peers get a chance to show their rate.
+//
+// We download on our own connections to the peers, they request from us on theirs. Both are added, and the
+// download rate of a connection is the rate of all connections of its host.
+// It is safe for concurrent use.
+type Choker struct {
+	// UploadSlots is the number of peers that are unchoked for their rate
+	UploadSlots int
+	// Seeding reports whether all pieces are available, it may be nil
+	Seeding func() bool
+
+	mu         sync.Mutex
+	peers      []*ChokerPeer
+	optimistic *ChokerPeer
+	rounds     int
+}
+
+func NewChoker(uploadSlots int) *Choker {
+	return &Choker{UploadSlots: uploadSlots}
+}
+
+// Add registers a new connection to host, the IP of the peer. It starts choked and not interested.
+func (choker *Choker) Add(host string) *ChokerPeer {
+	peer := &ChokerPeer{
+		choke:     make(chan bool, 1),
+		host:      host,
+		choked:    true,
+		connected: time.Now(),
+	}
+
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+	choker.peers = append(choker.peers, peer)
+	return peer
+}
+
+func (choker *Choker) Remove(peer *ChokerPeer) {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	for i, p := range choker.peers {
+		if p == peer {
+			choker.peers = append(choker.peers[:i], choker.peers[i+1:]...)
+			break
+		}
+	}
+	if choker.optimistic == peer {
+		choker.optimistic = nil
+	}
+}
+
+// SetInterested records the interest of the peer. An interested peer is unchoked right away
+// when not all slots are used, so it does not have to wait for the next round.
+func (choker *Choker) SetInterested(peer *ChokerPeer, interested bool) {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	peer.interested = interested
+	if !interested || !peer.choked {
+		return
+	}
+
+	unchoked := 0
+	for _, p := range choker.peers {
+		if !p.choked && p.interested {
+			unchoked++
+		}
+	}
+	if unchoked < choker.UploadSlots+1 {
+		choker.setChoked(peer, false)
+	}
+}
+
+// Run makes a choking decision every ChokeInterval until ctx is canceled
+func (choker *Choker) Run(ctx context.Context) {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			choker.Rechoke()
+		}
+	}
+}
+
+// Rechoke makes a choking decision, every third call also moves the optimistic unchoke
+func (choker *Choker) Rechoke() {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	seeding := choker.Seeding != nil && choker.Seeding()
+	hostRates := make(map[string]int64)
+	var interested []*ChokerPeer
+	for _, peer := range choker.peers {
+		downloaded, uploaded := peer.Downloaded.Load(), peer.Uploaded.Load()
+		if seeding {
+			peer.rate = uploaded - peer.lastUploaded
+		} else {
+			peer.rate = downloaded - peer.lastDownloaded
+			if peer.host != "" {
+				hostRates[peer.host] += peer.rate
+			}
+		}
+		peer.lastDownloaded, peer.lastUploaded = downloaded, uploaded
+
+		if peer.interested {
+			interested = append(interested, peer)
+		}
+	}
+	if !seeding {
+		for _, peer := range interested {
+			if peer.host != "" {
+				peer.rate = hostRates[peer.host]
+			}
+		}
+	}
+
+	sort.SliceStable(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+	unchoke := make(map[*ChokerPeer]bool)
+	for _, peer := range interested[:min(choker.UploadSlots, len(interested))] {
+		unchoke[peer] = true
+	}
+
+	rotate := choker.rounds%int(OptimisticUnchokeInterval/ChokeInterval) == 0
+	choker.rounds++
+	if rotate || choker.optimistic == nil || unchoke[choker.optimistic] || !choker.optimistic.interested {
+		choker.optimistic = choker.pickOptimistic(interested, unchoke)
+	}
+	if choker.optimistic != nil {
+		unchoke[choker.optimistic] = true
+	}
+
+	for _, peer := range choker.peers {
+		choker.setChoked(peer, !unchoke[peer])
+	}
+}
+
+// pickOptimistic chooses a random interested peer that is not unchoked for its rate,
+// new connections are three times as likely to be chosen
+func (choker *Choker) pickOptimistic(interested []*ChokerPeer, unchoke map[*ChokerPeer]bool) *ChokerPeer {
+	var candidates []*ChokerPeer
+	for _, peer := range interested {
+		if unchoke[peer] || (peer == choker.optimistic && len(interested)-len(unchoke) > 1) {
+			continue
+		}
+		candidates = append(candidates, peer)
+		if time.Since(peer.connected) < chokerNewPeerAge {
+			candidates = append(candidates, peer, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (choker *Choker) setChoked(peer *ChokerPeer, choked bool) {
+	if peer.choked == choked {
+		return
+	}
+	peer.choked = choked
+
+	// replace a decision the connection did not receive yet
+	select {
+	case <-peer.choke:
+	default:
+	}
+	peer.choke <- choked
+}
@@ -0,0 +1,175 @@
+package bittorrent
+
+import (
+	"testing"
+)
+
+// chokerDecision returns the latest decision for the peer, keep is returned when there is none
+func chokerDecision(peer *ChokerPeer, keep bool) bool {
+	select {
+	case choke := <-peer.Choke():
+		return choke
+	default:
+		return keep
+	}
+}
+
+func newTestChokerPeers(choker *Choker, n int) []*ChokerPeer {
+	peers := make([]*ChokerPeer, n)
+	for i := range peers {
+		peers[i] = choker.Add("")
+	}
+	return peers
+}
+
+func TestChokerTitForTat(t *testing.T) {
+	choker := NewChoker(2)
+	peers := newTestChokerPeers(choker, 6)
+	for i, peer := range peers {
+		// peer 5 is not interested although it has the best rate
+		if i != 5 {
+			choker.mu.Lock()
+			peer.interested = true
+			choker.mu.Unlock()
+		}
+		peer.Downloaded.Add(int64(i * 1000))
+	}
+
+	choker.Rechoke()
+
+	choked := make([]bool, len(peers))
+	for i, peer := range peers {
+		choked[i] = chokerDecision(peer, true)
+	}
+	if choked[3] || choked[4] {
+		t.Errorf("the best interested peers are choked: %v", choked)
+	}
+	if !choked[5] {
+		t.Errorf("the uninterested peer is unchoked")
+	}
+	optimistic := 0
+	for i := 0; i < 3; i++ {
+		if !choked[i] {
+			optimistic++
+		}
+	}
+	if optimistic != 1 || choker.optimistic == nil || choker.optimistic == peers[3] || choker.optimistic == peers[4] {
+		t.Errorf("expected one optimistic unchoke among the slow peers, choked %v", choked)
+	}
+
+	// the rates of the next round only count the new data
+	peers[0].Downloaded.Add(10000)
+	peers[1].Downloaded.Add(9000)
+	choker.Rechoke()
+	for i, peer := range peers {
+		choked[i] = chokerDecision(peer, choked[i])
+	}
+	if choked[0] || choked[1] {
+		t.Errorf("the peers with the best recent rate are choked: %v", choked)
+	}
+}
+
+func TestChokerSeedingRanksByUpload(t *testing.T) {
+	choker := NewChoker(1)
+	choker.Seeding = func() bool { return true }
+	peers := newTestChokerPeers(choker, 3)
+	for _, peer := range peers {
+		choker.SetInterested(peer, true)
+		chokerDecision(peer, true)
+	}
+	// peer 0 gives us data, peer 2 takes the most
+	peers[0].Downloaded.Add(100000)
+	peers[2].Uploaded.Add(5000)
+	peers[1].Uploaded.Add(1000)
+
+	choker.Rechoke()
+	if peers[2].choked {
+		t.Error("the peer that downloads the most is choked while seeding")
+	}
+	unchoked := 0
+	for _, peer := range choker.peers {
+		if !peer.choked {
+			unchoked++
+		}
+	}
+	if unchoked != 2 {
+		t.Errorf("%d peers unchoked, want the slot and the optimistic unchoke", unchoked)
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	choker := NewChoker(0)
+	peers := newTestChokerPeers(choker, 4)
+	for _, peer := range peers {
+		choker.mu.Lock()
+		peer.interested = true
+		choker.mu.Unlock()
+	}
+
+	rounds := int(OptimisticUnchokeInterval / ChokeInterval)
+	choker.Rechoke()
+	first := choker.optimistic
+	for i := 1; i < rounds; i++ {
+		choker.Rechoke()
+		if choker.optimistic != first {
+			t.Fatalf("optimistic unchoke changed after %d rounds", i)
+		}
+	}
+	choker.Rechoke()
+	if choker.optimistic == first {
+		t.Error("optimistic unchoke did not rotate")
+	}
+
+	// a removed optimistic peer is replaced in the next round
+	choker.Remove(choker.optimistic)
+	choker.Rechoke()
+	if choker.optimistic == nil {
+		t.Error("no optimistic unchoke after the peer was removed")
+	}
+}
+
+func TestChokerInterestedUsesFreeSlots(t *testing.T) {
+	choker := NewChoker(1)
+	peers := newTestChokerPeers(choker, 3)
+
+	// one slot and the optimistic unchoke are free
+	choker.SetInterested(peers[0], true)
+	choker.SetInterested(peers[1], true)
+	choker.SetInterested(peers[2], true)
+	if chokerDecision(peers[0], true) || chokerDecision(peers[1], true) {
+		t.Error("interested peers were not unchoked while slots are free")
+	}
+	if !chokerDecision(peers[2], true) {
+		t.Error("interested peer was unchoked although all slots are used")
+	}
+
+	// peers that lose interest are choked in the next round
+	choker.SetInterested(peers[0], false)
+	choker.Rechoke()
+	if !chokerDecision(peers[0], false) {
+		t.Error("uninterested peer is still unchoked")
+	}
+}
+
+func TestChokerHostDownloadRate(t *testing.T) {
+	choker := NewChoker(1)
+	upload := choker.Add("10.0.0.1")
+	other := choker.Add("10.0.0.2")
+	choker.SetInterested(upload, true)
+	choker.SetInterested(other, true)
+	chokerDecision(upload, true)
+	chokerDecision(other, true)
+
+	// the blocks are received on our download connection to the first host
+	download := choker.Add("10.0.0.1")
+	download.Downloaded.Add(50000)
+	other.Downloaded.Add(1000)
+
+	choker.Rechoke()
+	if upload.rate != 50000 || other.rate != 1000 {
+		t.Errorf("got rates %d and %d, want 50000 and 1000", upload.rate, other.rate)
+	}
+	if choker.optimistic != other || upload.choked {
+		t.Error("the host we download from is not unchoked for its rate")
+	}
+}
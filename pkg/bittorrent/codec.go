@@ -0,0 +1,292 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	lenMsgNoPayload = LEN_PREFIX + LEN_MESSAGE_ID
+	lenMsgRequest   = LEN_PREFIX + LenMsgReq
+	lenMsgPort      = LEN_PREFIX + LEN_MESSAGE_ID + 2
+	// HASH_REQUEST, HASHES and HASH_REJECT start with the pieces root and four integers
+	lenMsgHashRequest = lenMsgNoPayload + 32 + 4*LenMsgInteger
+	offsetMsgHashRoot = OffsetMsgId + LenMsgMessageId
+	offsetMsgHashes   = lenMsgHashRequest
+)
+
+var (
+	ErrInvalidMessage = fmt.Errorf("invalid message")
+	// ErrUnknownMessage is returned for messages without a codec, BEP 3 asks to ignore unknown messages
+	ErrUnknownMessage = fmt.Errorf("unknown message")
+)
+
+// PeerMessage is a decoded message of the peer wire protocol of BEP 3, or one of the BEP 5 and BEP 52 additions
+type PeerMessage interface {
+	Type() MessageType
+	// Encode returns the message with its length prefix
+	Encode() *Message
+}
+
+type KeepAliveMsg struct{}
+type ChokeMsg struct{}
+type UnchokeMsg struct{}
+type InterestedMsg struct{}
+type NotInterestedMsg struct{}
+
+type HaveMsg struct {
+	Index int
+}
+
+type BitfieldMsg struct {
+	Bitfield Bitfield
+}
+
+type RequestMsg struct {
+	Index, Begin, Length int
+}
+
+type PieceMsg struct {
+	Index, Begin int
+	Block        []byte
+}
+
+type CancelMsg struct {
+	Index, Begin, Length int
+}
+
+// PortMsg announces the DHT port of the peer (BEP 5)
+type PortMsg struct {
+	Port uint16
+}
+
+// HashRequestMsg asks for Length hashes of the merkle tree of the file with PiecesRoot, starting at Index of
+// the layer BaseLayer (0 are the 16 KiB blocks), with the uncle hashes of ProofLayers layers above it (BEP 52)
+type HashRequestMsg struct {
+	PiecesRoot                            [32]byte
+	BaseLayer, Index, Length, ProofLayers int
+}
+
+// HashesMsg answers a HashRequestMsg, the requested hashes are followed by the uncle hashes from the lowest
+// layer up. Uncles of the layers that are covered by the requested hashes are left out.
+type HashesMsg struct {
+	PiecesRoot                            [32]byte
+	BaseLayer, Index, Length, ProofLayers int
+	Hashes                                [][32]byte
+}
+
+// HashRejectMsg is sent for a HashRequestMsg that is not answered
+type HashRejectMsg struct {
+	PiecesRoot                            [32]byte
+	BaseLayer, Index, Length, ProofLayers int
+}
+
+func (KeepAliveMsg) Type() MessageType     { return KEEP_ALIVE }
+func (ChokeMsg) Type() MessageType         { return CHOKE }
+func (UnchokeMsg) Type() MessageType       { return UNCHOKE }
+func (InterestedMsg) Type() MessageType    { return INTERESTED }
+func (NotInterestedMsg) Type() MessageType { return NOT_INTERESTED }
+func (HaveMsg) Type() MessageType          { return HAVE }
+func (BitfieldMsg) Type() MessageType      { return BITFIELD }
+func (RequestMsg) Type() MessageType       { return REQUEST }
+func (PieceMsg) Type() MessageType         { return PIECE }
+func (CancelMsg) Type() MessageType        { return CANCEL }
+func (PortMsg) Type() MessageType          { return PORT }
+func (HashRequestMsg) Type() MessageType   { return HASH_REQUEST }
+func (HashesMsg) Type() MessageType        { return HASHES }
+func (HashRejectMsg) Type() MessageType    { return HASH_REJECT }
+
+func (KeepAliveMsg) Encode() *Message {
+	return &Message{Data: make([]byte, LEN_PREFIX), Len: LEN_PREFIX}
+}
+
+func (m ChokeMsg) Encode() *Message         { return encodeMessage(m.Type(), 0) }
+func (m UnchokeMsg) Encode() *Message       { return encodeMessage(m.Type(), 0) }
+func (m InterestedMsg) Encode() *Message    { return encodeMessage(m.Type(), 0) }
+func (m NotInterestedMsg) Encode() *Message { return encodeMessage(m.Type(), 0) }
+
+func (m HaveMsg) Encode() *Message {
+	msg := encodeMessage(m.Type(), LenMsgInteger)
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgHaveIndex:], uint32(m.Index))
+	return msg
+}
+
+func (m BitfieldMsg) Encode() *Message {
+	msg := encodeMessage(m.Type(), len(m.Bitfield))
+	copy(msg.Data[OffsetMsgBitfield:], m.Bitfield)
+	return msg
+}
+
+func (m RequestMsg) Encode() *Message {
+	return encodeBlockRequest(m.Type(), m.Index, m.Begin, m.Length)
+}
+
+func (m CancelMsg) Encode() *Message {
+	return encodeBlockRequest(m.Type(), m.Index, m.Begin, m.Length)
+}
+
+func (m PieceMsg) Encode() *Message {
+	msg := encodeMessage(m.Type(), 2*LenMsgInteger+len(m.Block))
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgPieceIndex:], uint32(m.Index))
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgPieceBegin:], uint32(m.Begin))
+	copy(msg.Data[OffsetMsgPieceBlock:], m.Block)
+	return msg
+}
+
+func (m PortMsg) Encode() *Message {
+	msg := encodeMessage(m.Type(), 2)
+	binary.BigEndian.PutUint16(msg.Data[OffsetMsgId+LenMsgMessageId:], m.Port)
+	return msg
+}
+
+func (m HashRequestMsg) Encode() *Message {
+	return encodeHashRequest(m.Type(), HashRequestMsg(m), 0)
+}
+
+func (m HashesMsg) Encode() *Message {
+	request := HashRequestMsg{PiecesRoot: m.PiecesRoot, BaseLayer: m.BaseLayer, Index: m.Index, Length: m.Length, ProofLayers: m.ProofLayers}
+	msg := encodeHashRequest(m.Type(), request, 32*len(m.Hashes))
+	for i, hash := range m.Hashes {
+		copy(msg.Data[offsetMsgHashes+32*i:], hash[:])
+	}
+	return msg
+}
+
+func (m HashRejectMsg) Encode() *Message {
+	return encodeHashRequest(m.Type(), HashRequestMsg(m), 0)
+}
+
+// encodeMessage returns a message of type t with the length prefix set and room for the payload
+func encodeMessage(t MessageType, payload int) *Message {
+	msg := &Message{
+		Data: make([]byte, lenMsgNoPayload+payload),
+		Len:  lenMsgNoPayload + payload,
+	}
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgLenPrefix:], uint32(LEN_MESSAGE_ID+payload))
+	msg.Data[OffsetMsgId] = byte(t)
+	return msg
+}
+
+func encodeBlockRequest(t MessageType, index, begin, length int) *Message {
+	msg := encodeMessage(t, 3*LenMsgInteger)
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgReqIndex:], uint32(index))
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgReqBegin:], uint32(begin))
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgReqLength:], uint32(length))
+	return msg
+}
+
+func encodeHashRequest(t MessageType, request HashRequestMsg, hashes int) *Message {
+	msg := encodeMessage(t, lenMsgHashRequest-lenMsgNoPayload+hashes)
+	copy(msg.Data[offsetMsgHashRoot:], request.PiecesRoot[:])
+	for i, value := range []int{request.BaseLayer, request.Index, request.Length, request.ProofLayers} {
+		binary.BigEndian.PutUint32(msg.Data[offsetMsgHashRoot+32+i*LenMsgInteger:], uint32(value))
+	}
+	return msg
+}
+
+// DecodeMessage decodes a PeerMessage, the length of every message type is checked.
+// The handshake, EXTENDED and unknown messages fail with ErrUnknownMessage, messages with an invalid length
+// with ErrInvalidMessage. The decoded BITFIELD and PIECE refer to the data of msg.
+func DecodeMessage(msg *Message) (PeerMessage, error) {
+	t := msg.Type()
+	checkLen := func(valid bool) error {
+		if !valid {
+			return fmt.Errorf("%w: %s of length %d", ErrInvalidMessage, t, msg.Len)
+		}
+		return nil
+	}
+	noPayload := func(m PeerMessage) (PeerMessage, error) {
+		if err := checkLen(msg.Len == lenMsgNoPayload); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	integer := func(offset int) int {
+		return int(binary.BigEndian.Uint32(msg.Data[offset:]))
+	}
+
+	switch t {
+	case KEEP_ALIVE:
+		// the id of KEEP_ALIVE is not on the wire, a message with that id is not a keep-alive
+		if err := checkLen(msg.Len == LEN_PREFIX); err != nil {
+			return nil, err
+		}
+		return KeepAliveMsg{}, nil
+	case CHOKE:
+		return noPayload(ChokeMsg{})
+	case UNCHOKE:
+		return noPayload(UnchokeMsg{})
+	case INTERESTED:
+		return noPayload(InterestedMsg{})
+	case NOT_INTERESTED:
+		return noPayload(NotInterestedMsg{})
+	case HAVE:
+		if err := checkLen(msg.Len == LenMsgHave); err != nil {
+			return nil, err
+		}
+		return HaveMsg{Index: integer(OffsetMsgHaveIndex)}, nil
+	case BITFIELD:
+		return BitfieldMsg{Bitfield: Bitfield(msg.Data[OffsetMsgBitfield:msg.Len])}, nil
+	case REQUEST, CANCEL:
+		if err := checkLen(msg.Len == lenMsgRequest); err != nil {
+			return nil, err
+		}
+		index, begin, length := integer(OffsetMsgReqIndex), integer(OffsetMsgReqBegin), integer(OffsetMsgReqLength)
+		if t == CANCEL {
+			return CancelMsg{Index: index, Begin: begin, Length: length}, nil
+		}
+		return RequestMsg{Index: index, Begin: begin, Length: length}, nil
+	case PIECE:
+		if err := checkLen(msg.Len >= OffsetMsgPieceBlock); err != nil {
+			return nil, err
+		}
+		return PieceMsg{
+			Index: integer(OffsetMsgPieceIndex),
+			Begin: integer(OffsetMsgPieceBegin),
+			Block: msg.Data[OffsetMsgPieceBlock:msg.Len],
+		}, nil
+	case PORT:
+		if err := checkLen(msg.Len == lenMsgPort); err != nil {
+			return nil, err
+		}
+		return PortMsg{Port: binary.BigEndian.Uint16(msg.Data[OffsetMsgId+LenMsgMessageId:])}, nil
+	case HASH_REQUEST, HASH_REJECT:
+		if err := checkLen(msg.Len == lenMsgHashRequest); err != nil {
+			return nil, err
+		}
+		request := decodeHashRequest(msg)
+		if t == HASH_REJECT {
+			return HashRejectMsg(request), nil
+		}
+		return request, nil
+	case HASHES:
+		if err := checkLen(msg.Len >= lenMsgHashRequest && (msg.Len-lenMsgHashRequest)%32 == 0); err != nil {
+			return nil, err
+		}
+		request := decodeHashRequest(msg)
+		hashes := make([][32]byte, (msg.Len-lenMsgHashRequest)/32)
+		for i := range hashes {
+			copy(hashes[i][:], msg.Data[offsetMsgHashes+32*i:])
+		}
+		return HashesMsg{
+			PiecesRoot:  request.PiecesRoot,
+			BaseLayer:   request.BaseLayer,
+			Index:       request.Index,
+			Length:      request.Length,
+			ProofLayers: request.ProofLayers,
+			Hashes:      hashes,
+		}, nil
+	case INVALID:
+		return nil, fmt.Errorf("%w: length prefix does not match the length %d", ErrInvalidMessage, msg.Len)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownMessage, t)
+}
+
+func decodeHashRequest(msg *Message) HashRequestMsg {
+	integer := func(i int) int {
+		return int(binary.BigEndian.Uint32(msg.Data[offsetMsgHashRoot+32+i*LenMsgInteger:]))
+	}
+	request := HashRequestMsg{BaseLayer: integer(0), Index: integer(1), Length: integer(2), ProofLayers: integer(3)}
+	copy(request.PiecesRoot[:], msg.Data[offsetMsgHashRoot:])
+	return request
+}
@@ -0,0 +1,142 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testPeerMessages = []PeerMessage{
+	KeepAliveMsg{},
+	ChokeMsg{},
+	UnchokeMsg{},
+	InterestedMsg{},
+	NotInterestedMsg{},
+	HaveMsg{Index: 7},
+	BitfieldMsg{Bitfield: Bitfield{0xa5, 0x80}},
+	RequestMsg{Index: 1, Begin: 16384, Length: 16384},
+	PieceMsg{Index: 2, Begin: 32768, Block: []byte{1, 2, 3}},
+	CancelMsg{Index: 3, Begin: 0, Length: 1024},
+	PortMsg{Port: 6881},
+	HashRequestMsg{PiecesRoot: [32]byte{1}, BaseLayer: 1, Index: 4, Length: 4, ProofLayers: 3},
+	HashesMsg{PiecesRoot: [32]byte{2}, BaseLayer: 1, Index: 0, Length: 2, ProofLayers: 1, Hashes: [][32]byte{{3}, {4}}},
+	HashRejectMsg{PiecesRoot: [32]byte{5}, BaseLayer: 2, Index: 8, Length: 8, ProofLayers: 0},
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, want := range testPeerMessages {
+		msg := want.Encode()
+		if msg.Type() != want.Type() {
+			t.Errorf("%T: encoded as %s", want, msg.Type())
+		}
+		got, err := DecodeMessage(msg)
+		if err != nil {
+			t.Errorf("%T: %s", want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: decoded %+v, expected %+v", want, got, want)
+		}
+	}
+}
+
+func TestDecodeMessageInvalidLength(t *testing.T) {
+	// the length prefix matches, the payload does not fit the type
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"id of KEEP_ALIVE", encodeMessage(KEEP_ALIVE, 0)},
+		{"CHOKE with payload", encodeMessage(CHOKE, 1)},
+		{"INTERESTED with payload", encodeMessage(INTERESTED, 4)},
+		{"HAVE of length 8", encodeMessage(HAVE, 3)},
+		{"HAVE of length 10", encodeMessage(HAVE, 5)},
+		{"REQUEST of length 16", encodeMessage(REQUEST, 11)},
+		{"CANCEL of length 18", encodeMessage(CANCEL, 13)},
+		{"PIECE without begin", encodeMessage(PIECE, 4)},
+		{"PORT of length 6", encodeMessage(PORT, 1)},
+		{"HASH_REQUEST without proof layers", encodeMessage(HASH_REQUEST, 44)},
+		{"HASHES with a partial hash", encodeMessage(HASHES, 48+31)},
+		{"prefix longer than the message", &Message{Data: []byte{0, 0, 0, 5, byte(HAVE), 0, 0}, Len: 7}},
+	}
+	for _, test := range tests {
+		if _, err := DecodeMessage(test.msg); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: expected ErrInvalidMessage, got %v", test.name, err)
+		}
+	}
+
+	// an empty bitfield and an empty block are valid
+	if _, err := DecodeMessage(encodeMessage(BITFIELD, 0)); err != nil {
+		t.Errorf("empty BITFIELD: %s", err)
+	}
+	if _, err := DecodeMessage(encodeMessage(PIECE, 8)); err != nil {
+		t.Errorf("empty PIECE: %s", err)
+	}
+}
+
+func TestDecodeMessageUnknown(t *testing.T) {
+	msgs := []*Message{
+		NewHandshakeMessage([20]byte{1}, [20]byte{2}),
+		&NewExtendedMessage().Message,
+		encodeMessage(MessageType(0x42), 3),
+	}
+	for _, msg := range msgs {
+		if _, err := DecodeMessage(msg); !errors.Is(err, ErrUnknownMessage) {
+			t.Errorf("%s: expected ErrUnknownMessage, got %v", msg.Type(), err)
+		}
+	}
+}
+
+func TestHandleMessageInvalidLength(t *testing.T) {
+	handler := NewPeerStateHandler()
+	handler.PeerState.SetPieceCount(4)
+	have := withLength(NewHaveMessage(1), 8)
+	if _, err := handler.HandleMessage(have, nil); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("expected ErrInvalidMessage for a HAVE of length 8, got %v", err)
+	}
+	piece := withLength(NewPieceMessage(0, 0, nil), 12)
+	if _, err := handler.HandleMessage(piece, nil); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("expected ErrInvalidMessage for a PIECE of length 12, got %v", err)
+	}
+}
+
+// withLength cuts msg to the given length and fixes its length prefix
+func withLength(msg *Message, length int) *Message {
+	binary.BigEndian.PutUint32(msg.Data[OffsetMsgLenPrefix:], uint32(length-LEN_PREFIX))
+	return &Message{Data: msg.Data[:length], Len: length}
+}
+
+// FuzzMessageRoundTrip frames arbitrary payloads, every message that decodes must encode to the same bytes
+func FuzzMessageRoundTrip(f *testing.F) {
+	for _, msg := range testPeerMessages {
+		encoded := msg.Encode()
+		f.Add(encoded.Data[LEN_PREFIX:encoded.Len])
+	}
+	f.Add([]byte{byte(HAVE), 0, 0, 1})
+	f.Add([]byte{byte(KEEP_ALIVE)})
+	f.Add([]byte{byte(REQUEST), 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 4})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		data := make([]byte, LEN_PREFIX+len(payload))
+		binary.BigEndian.PutUint32(data, uint32(len(payload)))
+		copy(data[LEN_PREFIX:], payload)
+		msg := &Message{Data: data, Len: len(data)}
+
+		decoded, err := DecodeMessage(msg)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidMessage) && !errors.Is(err, ErrUnknownMessage) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if decoded.Type() != msg.Type() {
+			t.Fatalf("decoded %s as %s", msg.Type(), decoded.Type())
+		}
+		encoded := decoded.Encode()
+		if !bytes.Equal(encoded.Data[:encoded.Len], data) {
+			t.Fatalf("%T: encoded %x, expected %x", decoded, encoded.Data[:encoded.Len], data)
+		}
+	})
+}
@@ -0,0 +1,593 @@
+package bittorrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mainline DHT (BEP 5): a Kademlia node that speaks KRPC, bencoded dicts in UDP packets
+
+const (
+	// DHTQueryTimeout is how long a node has to answer a query
+	DHTQueryTimeout = 2 * time.Second
+	// DHTAnnounceInterval is how often Run looks up and announces the torrent
+	DHTAnnounceInterval = 15 * time.Minute
+	// dhtAlpha is the number of concurrent queries of a lookup
+	dhtAlpha = 3
+	// dhtTokenRotation is how often the token secret changes, tokens of the previous secret are accepted too
+	dhtTokenRotation = 5 * time.Minute
+	// dhtMaxPeers is the number of peers stored per info hash
+	dhtMaxPeers = 100
+
+	KRPCErrorGeneric  = 201
+	KRPCErrorServer   = 202
+	KRPCErrorProtocol = 203
+	KRPCErrorMethod   = 204
+)
+
+var DefaultDHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// KRPCError is the error response of a query
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (err *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", err.Code, err.Message)
+}
+
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A *krpcArgs     `bencode:"a,omitempty"`
+	R *krpcReturn   `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+}
+
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// pendingQuery waits for the response of addr to a query
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan *krpcMessage
+}
+
+// DHT is a node of the mainline DHT, it answers queries of other nodes until it is closed
+type DHT struct {
+	ID      NodeID
+	Timeout time.Duration
+	// BootstrapNodes are used when the routing table is empty
+	BootstrapNodes []string
+
+	conn  *net.UDPConn
+	table *routingTable
+
+	mu            sync.Mutex
+	transactionID uint16
+	pending       map[string]pendingQuery
+	peers         map[[20]byte][]TrackerPeer
+	secret        [16]byte
+	prevSecret    [16]byte
+	secretChanged time.Time
+	closed        chan struct{}
+}
+
+// NewDHT listens on the UDP address, for example ":6881"
+func NewDHT(address string) (*DHT, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dht := &DHT{
+		ID:             NewRandomNodeID(),
+		Timeout:        DHTQueryTimeout,
+		BootstrapNodes: DefaultDHTBootstrapNodes,
+		conn:           conn,
+		pending:        make(map[string]pendingQuery),
+		peers:          make(map[[20]byte][]TrackerPeer),
+		secretChanged:  time.Now(),
+		closed:         make(chan struct{}),
+	}
+	dht.table = newRoutingTable(dht.ID)
+	rand.Read(dht.secret[:])
+	dht.prevSecret = dht.secret
+
+	go dht.readLoop()
+	return dht, nil
+}
+
+func (dht *DHT) Addr() *net.UDPAddr {
+	return dht.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (dht *DHT) Close() error {
+	return dht.conn.Close()
+}
+
+// Nodes returns the number of nodes in the routing table
+func (dht *DHT) Nodes() int {
+	return dht.table.Len()
+}
+
+// Bootstrap fills the routing table by looking up the own id, starting with the given nodes
+func (dht *DHT) Bootstrap(ctx context.Context, addresses []string) error {
+	var errs []error
+	for _, address := range addresses {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := dht.Ping(ctx, addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", address, err))
+		}
+	}
+	if dht.table.Len() == 0 {
+		return fmt.Errorf("dht bootstrap: no node responded: %w", errors.Join(errs...))
+	}
+
+	_, _, err := dht.lookup(ctx, dht.ID, false)
+	return err
+}
+
+func (dht *DHT) bootstrapIfEmpty(ctx context.Context) error {
+	if dht.table.Len() != 0 {
+		return nil
+	}
+	return dht.Bootstrap(ctx, dht.BootstrapNodes)
+}
+
+// Ping queries the node at addr and adds it to the routing table
+func (dht *DHT) Ping(ctx context.Context, addr *net.UDPAddr) (NodeID, error) {
+	r, err := dht.query(ctx, addr, "ping", &krpcArgs{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return NodeID([]byte(r.ID)), nil
+}
+
+// FindNode asks the node at addr for the nodes closest to target
+func (dht *DHT) FindNode(ctx context.Context, addr *net.UDPAddr, target NodeID) ([]DHTNode, error) {
+	r, err := dht.query(ctx, addr, "find_node", &krpcArgs{Target: string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	return ParseCompactNodes([]byte(r.Nodes))
+}
+
+// GetPeers asks the node at addr for peers of the torrent, it returns closer nodes when it knows none.
+// The token is required to announce to the node.
+func (dht *DHT) GetPeers(ctx context.Context, addr *net.UDPAddr, infoHash [20]byte) (peers []TrackerPeer, nodes []DHTNode, token string, err error) {
+	r, err := dht.query(ctx, addr, "get_peers", &krpcArgs{InfoHash: string(infoHash[:])})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	for _, value := range r.Values {
+		compact, err := ParseCompactPeers([]byte(value))
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("get_peers: values: %w", err)
+		}
+		peers = append(peers, compact...)
+	}
+	if nodes, err = ParseCompactNodes([]byte(r.Nodes)); err != nil {
+		return nil, nil, "", fmt.Errorf("get_peers: %w", err)
+	}
+	return peers, nodes, r.Token, nil
+}
+
+// AnnouncePeer tells the node at addr that we download the torrent on port
+func (dht *DHT) AnnouncePeer(ctx context.Context, addr *net.UDPAddr, infoHash [20]byte, port int, token string) error {
+	_, err := dht.query(ctx, addr, "announce_peer", &krpcArgs{InfoHash: string(infoHash[:]), Port: port, Token: token})
+	return err
+}
+
+// lookupNode is a node of an iterative lookup
+type lookupNode struct {
+	DHTNode
+	queried   bool
+	responded bool
+	token     string
+}
+
+// lookup queries the nodes closest to target until no closer nodes are found, for get_peers it also
+// returns the peers. The returned nodes are the closest that responded.
+func (dht *DHT) lookup(ctx context.Context, target NodeID, getPeers bool) ([]lookupNode, []TrackerPeer, error) {
+	closest := dht.table.Closest(target, DHTBucketSize)
+	if len(closest) == 0 {
+		return nil, nil, fmt.Errorf("dht: routing table is empty")
+	}
+
+	seen := make(map[string]bool)
+	var shortlist []*lookupNode
+	add := func(nodes []DHTNode) {
+		for _, node := range nodes {
+			if node.ID == dht.ID || seen[node.Addr.String()] {
+				continue
+			}
+			seen[node.Addr.String()] = true
+			shortlist = append(shortlist, &lookupNode{DHTNode: node})
+		}
+	}
+	add(closest)
+
+	var peers []TrackerPeer
+	for ctx.Err() == nil {
+		sortLookupNodes(shortlist, target)
+
+		// the next round queries the closest nodes that were not queried yet
+		var round []*lookupNode
+		for _, node := range shortlist[:min(DHTBucketSize, len(shortlist))] {
+			if !node.queried && len(round) < dhtAlpha {
+				node.queried = true
+				round = append(round, node)
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		type result struct {
+			node  *lookupNode
+			peers []TrackerPeer
+			nodes []DHTNode
+			token string
+			err   error
+		}
+		results := make(chan result, len(round))
+		for _, node := range round {
+			go func(node *lookupNode) {
+				var res result
+				res.node = node
+				if getPeers {
+					infoHash := [20]byte(target)
+					res.peers, res.nodes, res.token, res.err = dht.GetPeers(ctx, node.Addr, infoHash)
+				} else {
+					res.nodes, res.err = dht.FindNode(ctx, node.Addr, target)
+				}
+				results <- res
+			}(node)
+		}
+
+		for range round {
+			res := <-results
+			if res.err != nil {
+				dht.table.Failed(res.node.ID)
+				continue
+			}
+			res.node.responded = true
+			res.node.token = res.token
+			peers = append(peers, res.peers...)
+			add(res.nodes)
+		}
+
+		// nodes that did not respond make room for the next closest nodes
+		alive := shortlist[:0]
+		for _, node := range shortlist {
+			if !node.queried || node.responded {
+				alive = append(alive, node)
+			}
+		}
+		shortlist = alive
+	}
+
+	var responded []lookupNode
+	for _, node := range shortlist {
+		if node.responded && len(responded) < DHTBucketSize {
+			responded = append(responded, *node)
+		}
+	}
+	if ctx.Err() != nil {
+		return responded, peers, ctx.Err()
+	}
+	return responded, peers, nil
+}
+
+func sortLookupNodes(nodes []*lookupNode, target NodeID) {
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i].ID.Distance(target), nodes[j].ID.Distance(target)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
+
+// FindPeers looks up the peers of the torrent
+func (dht *DHT) FindPeers(ctx context.Context, infoHash [20]byte) ([]TrackerPeer, error) {
+	if err := dht.bootstrapIfEmpty(ctx); err != nil {
+		return nil, err
+	}
+	_, peers, err := dht.lookup(ctx, NodeID(infoHash), true)
+	return dedupPeers(peers), err
+}
+
+// Announce looks up the peers of the torrent and announces port to the closest nodes
+func (dht *DHT) Announce(ctx context.Context, infoHash [20]byte, port int) ([]TrackerPeer, error) {
+	if err := dht.bootstrapIfEmpty(ctx); err != nil {
+		return nil, err
+	}
+	nodes, peers, err := dht.lookup(ctx, NodeID(infoHash), true)
+	if err != nil {
+		return dedupPeers(peers), err
+	}
+
+	for _, node := range nodes {
+		if node.token == "" {
+			continue
+		}
+		if err := dht.AnnouncePeer(ctx, node.Addr, infoHash, port, node.token); err != nil {
+			log.Printf("dht: announce_peer to %s failed: %s", node, err)
+		}
+	}
+	return dedupPeers(peers), nil
+}
+
+// Run is the DHT peer source of a torrent: it announces every DHTAnnounceInterval and adds the peers to the swarm
+func (dht *DHT) Run(ctx context.Context, infoHash [20]byte, port int, swarm *Swarm) {
+	for {
+		peers, err := dht.Announce(ctx, infoHash, port)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("dht: announce failed: %s", err)
+		}
+		swarm.AddPeers(peers)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(DHTAnnounceInterval):
+		}
+	}
+}
+
+func dedupPeers(peers []TrackerPeer) []TrackerPeer {
+	seen := make(map[string]bool)
+	result := peers[:0]
+	for _, peer := range peers {
+		if !seen[peer.String()] {
+			seen[peer.String()] = true
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+func (dht *DHT) query(ctx context.Context, addr *net.UDPAddr, method string, args *krpcArgs) (*krpcReturn, error) {
+	args.ID = string(dht.ID[:])
+
+	dht.mu.Lock()
+	dht.transactionID++
+	t := string(binary.BigEndian.AppendUint16(nil, dht.transactionID))
+	response := make(chan *krpcMessage, 1)
+	dht.pending[t] = pendingQuery{addr: addr, response: response}
+	dht.mu.Unlock()
+
+	defer func() {
+		dht.mu.Lock()
+		delete(dht.pending, t)
+		dht.mu.Unlock()
+	}()
+
+	if err := dht.send(addr, &krpcMessage{T: t, Y: "q", Q: method, A: args}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(dht.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-dht.closed:
+		return nil, net.ErrClosed
+	case <-timer.C:
+		return nil, fmt.Errorf("dht: %s to %s timed out", method, addr)
+	case msg := <-response:
+		if msg.Y == "e" {
+			return nil, newKRPCError(msg.E)
+		}
+		if msg.R == nil || len(msg.R.ID) != 20 {
+			return nil, fmt.Errorf("dht: invalid response to %s from %s", method, addr)
+		}
+		dht.table.Insert(DHTNode{ID: NodeID([]byte(msg.R.ID)), Addr: addr})
+		return msg.R, nil
+	}
+}
+
+func newKRPCError(e []interface{}) error {
+	err := &KRPCError{Code: KRPCErrorGeneric}
+	if len(e) > 0 {
+		if code, ok := e[0].(int); ok {
+			err.Code = code
+		}
+	}
+	if len(e) > 1 {
+		if message, ok := e[1].(string); ok {
+			err.Message = message
+		}
+	}
+	return err
+}
+
+func (dht *DHT) send(addr *net.UDPAddr, msg *krpcMessage) error {
+	packet, err := MarshalBencode(msg)
+	if err != nil {
+		return err
+	}
+	_, err = dht.conn.WriteToUDP(packet, addr)
+	return err
+}
+
+func (dht *DHT) readLoop() {
+	defer close(dht.closed)
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := dht.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		var msg krpcMessage
+		if err := UnmarshalBencode(buf[:n], &msg); err != nil {
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			dht.handleQuery(addr, &msg)
+		case "r", "e":
+			dht.mu.Lock()
+			query, ok := dht.pending[msg.T]
+			dht.mu.Unlock()
+			// a response with a known transaction id from another address is not trusted
+			if ok && query.addr.IP.Equal(addr.IP) && query.addr.Port == addr.Port {
+				select {
+				case query.response <- &msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (dht *DHT) handleQuery(addr *net.UDPAddr, msg *krpcMessage) {
+	if msg.A == nil || len(msg.A.ID) != 20 {
+		dht.sendError(addr, msg.T, KRPCErrorProtocol, "invalid arguments")
+		return
+	}
+	sender := NodeID([]byte(msg.A.ID))
+	r := &krpcReturn{ID: string(dht.ID[:])}
+
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		if len(msg.A.Target) != 20 {
+			dht.sendError(addr, msg.T, KRPCErrorProtocol, "invalid target")
+			return
+		}
+		r.Nodes = string(CompactNodes(dht.table.Closest(NodeID([]byte(msg.A.Target)), DHTBucketSize)))
+	case "get_peers":
+		if len(msg.A.InfoHash) != 20 {
+			dht.sendError(addr, msg.T, KRPCErrorProtocol, "invalid info_hash")
+			return
+		}
+		infoHash := [20]byte([]byte(msg.A.InfoHash))
+		r.Token = dht.token(addr.IP, time.Now())
+		if peers := dht.storedPeers(infoHash); len(peers) > 0 {
+			compact := CompactPeers(peers)
+			for i := 0; i < len(compact); i += 6 {
+				r.Values = append(r.Values, string(compact[i:i+6]))
+			}
+		} else {
+			r.Nodes = string(CompactNodes(dht.table.Closest(NodeID(infoHash), DHTBucketSize)))
+		}
+	case "announce_peer":
+		if len(msg.A.InfoHash) != 20 || !dht.validToken(msg.A.Token, addr.IP) {
+			dht.sendError(addr, msg.T, KRPCErrorProtocol, "invalid token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			dht.sendError(addr, msg.T, KRPCErrorProtocol, "invalid port")
+			return
+		}
+		dht.storePeer([20]byte([]byte(msg.A.InfoHash)), TrackerPeer{Ip: addr.IP, Port: port})
+	default:
+		dht.sendError(addr, msg.T, KRPCErrorMethod, "method unknown")
+		return
+	}
+
+	dht.table.Insert(DHTNode{ID: sender, Addr: addr})
+	dht.send(addr, &krpcMessage{T: msg.T, Y: "r", R: r})
+}
+
+func (dht *DHT) sendError(addr *net.UDPAddr, t string, code int, message string) {
+	dht.send(addr, &krpcMessage{T: t, Y: "e", E: []interface{}{code, message}})
+}
+
+// token is the SHA-1 of the querying IP and a secret that changes every dhtTokenRotation
+func (dht *DHT) token(ip net.IP, now time.Time) string {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
+	if now.Sub(dht.secretChanged) >= dhtTokenRotation {
+		dht.prevSecret = dht.secret
+		rand.Read(dht.secret[:])
+		dht.secretChanged = now
+	}
+	return tokenFor(ip, dht.secret)
+}
+
+func (dht *DHT) validToken(token string, ip net.IP) bool {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	return token != "" && (token == tokenFor(ip, dht.secret) || token == tokenFor(ip, dht.prevSecret))
+}
+
+func tokenFor(ip net.IP, secret [16]byte) string {
+	hash := sha1.Sum(append(append([]byte(nil), ip.To16()...), secret[:]...))
+	return string(hash[:8])
+}
+
+func (dht *DHT) storePeer(infoHash [20]byte, peer TrackerPeer) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
+	peers := dht.peers[infoHash]
+	for i, known := range peers {
+		if known.String() == peer.String() {
+			peers = append(peers[:i], peers[i+1:]...)
+			break
+		}
+	}
+	// the oldest peers are dropped first
+	if len(peers) >= dhtMaxPeers {
+		peers = peers[1:]
+	}
+	dht.peers[infoHash] = append(peers, peer)
+}
+
+func (dht *DHT) storedPeers(infoHash [20]byte) []TrackerPeer {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	return append([]TrackerPeer(nil), dht.peers[infoHash]...)
+}
@@ -0,0 +1,192 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DHTBucketSize is K of Kademlia, the number of nodes per bucket and the number of closest nodes of a lookup
+const DHTBucketSize = 8
+
+// dhtMaxFailures is the number of queries a node may fail before it is replaced by a new node
+const dhtMaxFailures = 2
+
+type NodeID [20]byte
+
+func NewRandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+// Distance is the XOR metric of Kademlia, distances compare as big-endian numbers
+func (id NodeID) Distance(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// commonPrefixLen is the number of leading bits id and other share, 160 when they are equal
+func (id NodeID) commonPrefixLen(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+type DHTNode struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+func (node DHTNode) String() string {
+	return fmt.Sprintf("%x@%s", node.ID[:4], node.Addr)
+}
+
+const compactNodeLen = 26
+
+// ParseCompactNodes parses the "nodes" string of KRPC responses: 20 byte id, 4 byte IPv4 address and port
+func ParseCompactNodes(nodes []byte) ([]DHTNode, error) {
+	if len(nodes)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("compact nodes: length %d is not a multiple of %d", len(nodes), compactNodeLen)
+	}
+
+	result := make([]DHTNode, 0, len(nodes)/compactNodeLen)
+	for i := 0; i < len(nodes); i += compactNodeLen {
+		var node DHTNode
+		copy(node.ID[:], nodes[i:])
+		node.Addr = &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), nodes[i+20:i+24]...)),
+			Port: int(binary.BigEndian.Uint16(nodes[i+24:])),
+		}
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+// CompactNodes encodes the IPv4 nodes, others are skipped
+func CompactNodes(nodes []DHTNode) []byte {
+	result := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		result = append(result, node.ID[:]...)
+		result = append(result, ip...)
+		result = binary.BigEndian.AppendUint16(result, uint16(node.Addr.Port))
+	}
+	return result
+}
+
+type routingTableEntry struct {
+	DHTNode
+	lastSeen time.Time
+	failures int
+}
+
+// routingTable keeps up to DHTBucketSize nodes for every length of the prefix shared with the own id.
+// Nodes that responded recently are kept, a full bucket only accepts a new node in place of a failing one.
+type routingTable struct {
+	self NodeID
+
+	mu      sync.Mutex
+	buckets [161][]*routingTableEntry
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+// Insert adds the node or marks it as seen
+func (table *routingTable) Insert(node DHTNode) {
+	if node.ID == table.self {
+		return
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	i := table.self.commonPrefixLen(node.ID)
+	bucket := table.buckets[i]
+	for j, entry := range bucket {
+		if entry.ID == node.ID {
+			entry.Addr = node.Addr
+			entry.lastSeen = time.Now()
+			entry.failures = 0
+			// the most recently seen nodes are at the end
+			table.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), entry)
+			return
+		}
+	}
+
+	entry := &routingTableEntry{DHTNode: node, lastSeen: time.Now()}
+	if len(bucket) < DHTBucketSize {
+		table.buckets[i] = append(bucket, entry)
+		return
+	}
+	for j, old := range bucket {
+		if old.failures >= dhtMaxFailures {
+			table.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), entry)
+			return
+		}
+	}
+}
+
+// Failed records a query to the node that was not answered
+func (table *routingTable) Failed(id NodeID) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	for _, entry := range table.buckets[table.self.commonPrefixLen(id)] {
+		if entry.ID == id {
+			entry.failures++
+		}
+	}
+}
+
+// Closest returns up to n good nodes sorted by their distance to target
+func (table *routingTable) Closest(target NodeID, n int) []DHTNode {
+	table.mu.Lock()
+	var nodes []DHTNode
+	for _, bucket := range table.buckets {
+		for _, entry := range bucket {
+			if entry.failures < dhtMaxFailures {
+				nodes = append(nodes, entry.DHTNode)
+			}
+		}
+	}
+	table.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	return nodes[:min(n, len(nodes))]
+}
+
+func (table *routingTable) Len() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	n := 0
+	for _, bucket := range table.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(nodes []DHTNode, target NodeID) {
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i].ID.Distance(target), nodes[j].ID.Distance(target)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
@@ -0,0 +1,277 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestDHTNetwork starts n nodes on loopback, all bootstrapped from the first node
+func newTestDHTNetwork(t *testing.T, n int) []*DHT {
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		dht, err := NewDHT("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dht.Timeout = 500 * time.Millisecond
+		t.Cleanup(func() { dht.Close() })
+		nodes[i] = dht
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, dht := range nodes[1:] {
+		if err := dht.Bootstrap(ctx, []string{nodes[0].Addr().String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+func TestDHTPing(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 2)
+
+	id, err := nodes[0].Ping(context.Background(), nodes[1].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nodes[1].ID {
+		t.Errorf("got id %x want %x", id, nodes[1].ID)
+	}
+	if nodes[0].Nodes() != 1 || nodes[1].Nodes() != 1 {
+		t.Errorf("expected the nodes to know each other, got %d and %d", nodes[0].Nodes(), nodes[1].Nodes())
+	}
+}
+
+func TestDHTPingIgnoresOtherAddress(t *testing.T) {
+	dht, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+	dht.Timeout = 2 * time.Second
+
+	node, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	nodeID, spoofedID := NewRandomNodeID(), NewRandomNodeID()
+	go func() {
+		buf := make([]byte, 65536)
+		n, addr, err := node.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query krpcMessage
+		if err := UnmarshalBencode(buf[:n], &query); err != nil {
+			return
+		}
+		// the spoofed response with the same transaction id arrives first
+		for _, reply := range []struct {
+			conn *net.UDPConn
+			id   NodeID
+		}{{spoofer, spoofedID}, {node, nodeID}} {
+			packet, _ := MarshalBencode(&krpcMessage{T: query.T, Y: "r", R: &krpcReturn{ID: string(reply.id[:])}})
+			reply.conn.WriteToUDP(packet, addr)
+		}
+	}()
+
+	id, err := dht.Ping(context.Background(), node.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nodeID {
+		t.Errorf("got id %x want %x", id, nodeID)
+	}
+}
+
+func TestDHTFindNode(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 10)
+
+	// the first node learned about all others from their bootstrap
+	found, err := nodes[1].FindNode(context.Background(), nodes[0].Addr(), nodes[5].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 || found[0].ID != nodes[5].ID || found[0].Addr.Port != nodes[5].Addr().Port {
+		t.Errorf("expected %s to be the closest node, got %v", nodes[5].Addr(), found)
+	}
+}
+
+func TestDHTAnnounceAndFindPeers(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 12)
+	infoHash := [20]byte{0xab, 0xcd}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := nodes[3].Announce(ctx, infoHash, 7000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[4].Announce(ctx, infoHash, 7001); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[9].FindPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, peer := range peers {
+		got[peer.String()] = true
+	}
+	if len(got) != 2 || !got["127.0.0.1:7000"] || !got["127.0.0.1:7001"] {
+		t.Errorf("unexpected peers %v", peers)
+	}
+
+	swarm := NewSwarm()
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		nodes[7].Run(runCtx, infoHash, 7002, swarm)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-swarm.Peers:
+		case <-ctx.Done():
+			t.Fatal("no peers from Run")
+		}
+	}
+	stop()
+	<-done
+}
+
+func TestDHTAnnounceInvalidToken(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 2)
+
+	err := nodes[1].AnnouncePeer(context.Background(), nodes[0].Addr(), [20]byte{1}, 7000, "wrong")
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != KRPCErrorProtocol {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDHTToken(t *testing.T) {
+	dht := &DHT{secretChanged: time.Now()}
+	ip := net.IPv4(10, 0, 0, 1)
+
+	token := dht.token(ip, time.Now())
+	if !dht.validToken(token, ip) || dht.validToken(token, net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("token must only be valid for the same ip")
+	}
+	// the previous secret is still accepted after one rotation
+	dht.token(ip, time.Now().Add(dhtTokenRotation))
+	if !dht.validToken(token, ip) {
+		t.Errorf("token must be valid after one rotation")
+	}
+	dht.token(ip, time.Now().Add(2*dhtTokenRotation))
+	if dht.validToken(token, ip) {
+		t.Errorf("token must expire after two rotations")
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := NodeID{}
+	table := newRoutingTable(self)
+
+	// all nodes share no prefix with self, only DHTBucketSize of them fit into the bucket
+	for i := 0; i < DHTBucketSize+2; i++ {
+		table.Insert(DHTNode{ID: NodeID{0x80, byte(i)}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1}})
+	}
+	table.Insert(DHTNode{ID: NodeID{0x01}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 1}})
+	if table.Len() != DHTBucketSize+1 {
+		t.Errorf("got %d nodes want %d", table.Len(), DHTBucketSize+1)
+	}
+
+	closest := table.Closest(NodeID{0x80, 0x03}, 2)
+	if len(closest) != 2 || closest[0].ID != (NodeID{0x80, 0x03}) || closest[1].ID != (NodeID{0x80, 0x02}) {
+		t.Errorf("unexpected closest nodes %v", closest)
+	}
+
+	// failing nodes are replaced
+	for i := 0; i < dhtMaxFailures; i++ {
+		table.Failed(NodeID{0x80, 0x00})
+	}
+	table.Insert(DHTNode{ID: NodeID{0x80, 0xff}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 255), Port: 1}})
+	if closest := table.Closest(NodeID{0x80, 0xff}, 1); closest[0].ID != (NodeID{0x80, 0xff}) {
+		t.Errorf("expected the failing node to be replaced, got %v", closest)
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []DHTNode{{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}}}
+	parsed, err := ParseCompactNodes(CompactNodes(nodes))
+	if err != nil || len(parsed) != 1 || parsed[0].ID != nodes[0].ID || parsed[0].Addr.String() != "10.0.0.1:6881" {
+		t.Errorf("unexpected nodes %v %v", parsed, err)
+	}
+	if _, err := ParseCompactNodes(make([]byte, 25)); err == nil {
+		t.Errorf("expected error for truncated node")
+	}
+}
+
+func TestMagnetLinkFindPeersDHT(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 4)
+	infoHash := [20]byte{0xd6, 0x9f}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := nodes[1].Announce(ctx, infoHash, 7000); err != nil {
+		t.Fatal(err)
+	}
+
+	// no "tr", the new node bootstraps from the first node
+	magnetLink, err := NewMagnetLink("magnet:?xt=urn:btih:d69f000000000000000000000000000000000000", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startDHT := func() (*DHT, error) {
+		dht, err := NewDHT("127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		dht.BootstrapNodes = []string{nodes[0].Addr().String()}
+		return dht, nil
+	}
+
+	peers, dht, err := magnetLink.FindPeers(ctx, startDHT)
+	if dht != nil {
+		defer dht.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:7000" {
+		t.Errorf("unexpected peers %v", peers)
+	}
+}
+
+func TestMagnetLinkFindPeersTrackerFirst(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, "d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	magnetLink, err := NewMagnetLink("magnet:?xt=urn:btih:d69f000000000000000000000000000000000000&tr="+url.QueryEscape(tracker.URL), 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the dht is not started when the trackers know peers
+	startDHT := func() (*DHT, error) {
+		t.Error("dht was started")
+		return nil, errors.New("unexpected")
+	}
+	peers, dht, err := magnetLink.FindPeers(context.Background(), startDHT)
+	if err != nil || dht != nil {
+		t.Fatalf("unexpected dht %v, error %v", dht, err)
+	}
+	if len(peers) != 1 || peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("unexpected peers %v", peers)
+	}
+}
@@ -0,0 +1,67 @@
+package bittorrent
+
+import (
+	"bytes"
+)
+
+// Extension protocol (BEP 10) and metadata exchange (BEP 9) messages
+
+// ExtensionHandshake is sent as the extended message with id 0
+type ExtensionHandshake struct {
+	// M maps the supported extension names to the message ids the sender wants to receive
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	Port         int            `bencode:"p,omitempty"`
+	Version      string         `bencode:"v,omitempty"`
+}
+
+const (
+	MetadataExtensionName = "ut_metadata"
+	// MetadataExtensionId is the id of ut_metadata in our extension handshake
+	MetadataExtensionId = 1
+)
+
+// NewExtensionHandshake returns our extension handshake, it is the same on every connection so that the ids
+// the peer agreed on never change. Incoming extended messages are dispatched with ExtensionName.
+func NewExtensionHandshake() ExtensionHandshake {
+	return ExtensionHandshake{
+		M: map[string]int{
+			MetadataExtensionName: MetadataExtensionId,
+			PexExtensionName:      PexExtensionId,
+		},
+	}
+}
+
+// ExtensionName returns the name of the extension we advertised with id, "" for unknown ids
+func ExtensionName(id byte) string {
+	for name, advertised := range NewExtensionHandshake().M {
+		if advertised == int(id) {
+			return name
+		}
+	}
+	return ""
+}
+
+const (
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+// MetadataMessage is the ut_metadata header, for MetadataData the piece of the info dict follows the header
+type MetadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// UnmarshalDict decodes the bencoded dict of the message into v and returns the bytes that follow it
+func (m *ExtendedMessage) UnmarshalDict(v interface{}) ([]byte, error) {
+	payload := m.ExtensionDict()
+	decoder := NewBencodeDecoder(bytes.NewReader(payload))
+	decoder.AllowUnsortedKeys = true
+	if err := decoder.DecodeInto(v); err != nil {
+		return nil, err
+	}
+	return payload[decoder.InputOffset():], nil
+}
@@ -0,0 +1,122 @@
+package bittorrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultMaxMessageLength caps the messages of peers, it fits the bitfield of a torrent with 8 million pieces
+	// and PIECE messages of the largest blocks that are requested in practice
+	DefaultMaxMessageLength = 1024 * 1024
+)
+
+var (
+	ErrMessageTooLong = fmt.Errorf("message too long")
+)
+
+// MessageReader splits the stream of a connection into messages. The length prefix is read first, the buffer
+// grows to the announced length up to MaxLength, longer messages fail with ErrMessageTooLong.
+//
+// The handshake has no length prefix, it is only read as the first frame when ExpectHandshake is set.
+type MessageReader struct {
+	MaxLength int
+	// ExpectHandshake is set until the handshake was read, the messages follow it
+	ExpectHandshake bool
+
+	conn net.Conn
+	// buf starts with the size of the handshake and grows to the largest message read
+	buf []byte
+}
+
+func NewMessageReader(conn net.Conn) *MessageReader {
+	return &MessageReader{
+		MaxLength: DefaultMaxMessageLength,
+		conn:      conn,
+		buf:       make([]byte, LEN_HANDSHAKE),
+	}
+}
+
+// ReadHandshake reads the handshake, it is the first frame of a connection
+func (reader *MessageReader) ReadHandshake() (Message, error) {
+	reader.ExpectHandshake = false
+	if _, err := io.ReadFull(reader.conn, reader.buf[:LEN_HANDSHAKE]); err != nil {
+		return Message{}, err
+	}
+	if pstrlen := reader.buf[OffsetHandshakePstrlen]; pstrlen != 19 {
+		return Message{}, fmt.Errorf("invalid handshake: protocol length %d", pstrlen)
+	}
+	return MessageFromBytes(reader.buf[:LEN_HANDSHAKE]), nil
+}
+
+// ReadMessage returns the next message, io.EOF when the connection was closed between two messages.
+// The handshake is returned first when ExpectHandshake is set.
+func (reader *MessageReader) ReadMessage() (Message, error) {
+	if reader.ExpectHandshake {
+		return reader.ReadHandshake()
+	}
+
+	if _, err := io.ReadFull(reader.conn, reader.buf[:LEN_PREFIX]); err != nil {
+		return Message{}, err
+	}
+
+	announced := binary.BigEndian.Uint32(reader.buf[:LEN_PREFIX])
+	if announced > uint32(reader.MaxLength) {
+		return Message{}, fmt.Errorf("%w: announced %d bytes, the maximum is %d", ErrMessageTooLong, announced, reader.MaxLength)
+	}
+	length := LEN_PREFIX + int(announced)
+
+	if length > len(reader.buf) {
+		buf := make([]byte, max(length, min(2*len(reader.buf), LEN_PREFIX+reader.MaxLength)))
+		copy(buf, reader.buf[:LEN_PREFIX])
+		reader.buf = buf
+	}
+	if _, err := io.ReadFull(reader.conn, reader.buf[LEN_PREFIX:length]); err != nil {
+		if errors.Is(err, io.EOF) {
+			// the connection was closed within the message
+			err = io.ErrUnexpectedEOF
+		}
+		return Message{}, err
+	}
+
+	return MessageFromBytes(reader.buf[:length]), nil
+}
+
+// Run sends the messages to in until ctx is canceled or reading fails.
+// io.EOF is sent to errs when the peer closed the connection, other errors are wrapped.
+// Nothing is sent after ctx is canceled, so the reader never blocks on a session that is gone.
+func (reader *MessageReader) Run(ctx context.Context, in chan<- Message, errs chan<- error) {
+	// a canceled context interrupts the blocked read
+	stop := context.AfterFunc(ctx, func() {
+		_ = reader.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if err != io.EOF {
+				err = fmt.Errorf("read err: %w", err)
+			}
+			select {
+			case errs <- err:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		select {
+		case in <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package bittorrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// writeTestFrames writes the messages to a pipe in chunks of n bytes, so that frames are split across reads
+func writeTestFrames(t *testing.T, n int, msgs ...*Message) net.Conn {
+	t.Helper()
+
+	conn, peerConn := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	var stream []byte
+	for _, msg := range msgs {
+		stream = append(stream, msg.Data[:msg.Len]...)
+	}
+	go func() {
+		defer peerConn.Close()
+		for len(stream) > 0 {
+			chunk := stream[:min(n, len(stream))]
+			if _, err := peerConn.Write(chunk); err != nil {
+				return
+			}
+			stream = stream[len(chunk):]
+		}
+	}()
+	return conn
+}
+
+func TestMessageReaderLargeMessages(t *testing.T) {
+	bitfield := make(Bitfield, 100*1024)
+	bitfield[0] = 0xa5
+	block := bytes.Repeat([]byte{7}, 128*1024)
+	conn := writeTestFrames(t, 1000,
+		NewHandshakeMessage([20]byte{1}, [20]byte{2}),
+		NewBitfieldMessage(bitfield),
+		NewKeepAliveMessage(),
+		NewPieceMessage(3, 0, block),
+		NewInterestedMessage(),
+	)
+
+	reader := NewMessageReader(conn)
+	reader.ExpectHandshake = true
+	want := []MessageType{HANDSHAKE, BITFIELD, KEEP_ALIVE, PIECE, INTERESTED}
+	for _, wantType := range want {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading %s: %s", wantType, err)
+		}
+		if msg.Type() != wantType {
+			t.Fatalf("expected %s, got %s", wantType, msg.Type())
+		}
+		switch wantType {
+		case BITFIELD:
+			if !bytes.Equal(decodeTestMessage(t, &msg).(BitfieldMsg).Bitfield, bitfield) {
+				t.Error("bitfield differs")
+			}
+		case PIECE:
+			if !bytes.Equal(decodeTestMessage(t, &msg).(PieceMsg).Block, block) {
+				t.Error("block differs")
+			}
+		}
+	}
+	if _, err := reader.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF at the end, got %v", err)
+	}
+}
+
+func TestMessageReaderTooLong(t *testing.T) {
+	conn := writeTestFrames(t, 4096, &Message{Data: []byte{0x7f, 0xff, 0xff, 0xff, byte(PIECE)}, Len: 5})
+	if _, err := NewMessageReader(conn).ReadMessage(); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("expected ErrMessageTooLong, got %v", err)
+	}
+
+	// the cap is configurable
+	conn = writeTestFrames(t, 4096, NewBitfieldMessage(make(Bitfield, 2000)))
+	reader := NewMessageReader(conn)
+	reader.MaxLength = 1000
+	if _, err := reader.ReadMessage(); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("expected ErrMessageTooLong with a cap of 1000, got %v", err)
+	}
+
+	// the session is told why the reader stopped
+	conn = writeTestFrames(t, 4096, NewHandshakeMessage([20]byte{1}, [20]byte{2}), &Message{Data: []byte{0x01, 0, 0, 0, byte(BITFIELD)}, Len: 5})
+	errs := make(chan error, 1)
+	go HandleIncomingMessages(context.Background(), conn, make(chan Message, 1), errs)
+	if err := <-errs; !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("expected ErrMessageTooLong from the reader, got %v", err)
+	}
+}
+
+func TestMessageReaderHandshakeOnlyFirst(t *testing.T) {
+	// the length prefix starts with 19 like the handshake
+	absurd := &Message{Data: []byte{19, 0xff, 0xff, 0xff, byte(PIECE)}, Len: 5}
+
+	conn := writeTestFrames(t, 4096, NewHandshakeMessage([20]byte{1}, [20]byte{2}), absurd)
+	reader := NewMessageReader(conn)
+	reader.ExpectHandshake = true
+	if msg, err := reader.ReadMessage(); err != nil || msg.Type() != HANDSHAKE {
+		t.Fatalf("expected the handshake, got %s %v", msg.Type(), err)
+	}
+	if _, err := reader.ReadMessage(); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("expected ErrMessageTooLong after the handshake, got %v", err)
+	}
+
+	// without the handshake, as for the connections of the PeerListener
+	conn = writeTestFrames(t, 4096, absurd)
+	if _, err := NewMessageReader(conn).ReadMessage(); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("expected ErrMessageTooLong, got %v", err)
+	}
+
+	// the first frame must be a handshake
+	conn = writeTestFrames(t, 4096, NewPieceMessage(0, 0, make([]byte, 100)))
+	reader = NewMessageReader(conn)
+	reader.ExpectHandshake = true
+	if _, err := reader.ReadMessage(); err == nil {
+		t.Error("expected an error for a message instead of the handshake")
+	}
+}
+
+func TestMessageReaderTruncated(t *testing.T) {
+	msg := NewPieceMessage(0, 0, make([]byte, 1000))
+	msg.Len -= 10
+	conn := writeTestFrames(t, 4096, msg)
+	if _, err := NewMessageReader(conn).ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
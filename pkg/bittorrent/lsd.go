@@ -0,0 +1,216 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery (BEP 14)
+
+const (
+	LSDMulticastAddr  = "239.192.152.143:6771"
+	LSDMulticastAddr6 = "[ff15::efc0:988f]:6771"
+	// LSDAnnounceInterval is the time between two announces of a torrent
+	LSDAnnounceInterval = 5 * time.Minute
+)
+
+// LSDAnnounce is a BT-SEARCH message, it is sent to the multicast group
+type LSDAnnounce struct {
+	Host       string
+	Port       int
+	InfoHashes [][20]byte
+	// Cookie lets the sender recognize its own announces, it is optional
+	Cookie string
+}
+
+func (announce *LSDAnnounce) Bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", announce.Host, announce.Port)
+	for _, infoHash := range announce.InfoHashes {
+		fmt.Fprintf(&buf, "Infohash: %x\r\n", infoHash)
+	}
+	if announce.Cookie != "" {
+		fmt.Fprintf(&buf, "cookie: %s\r\n", announce.Cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// ParseLSDAnnounce parses a BT-SEARCH message, header names are case-insensitive
+func ParseLSDAnnounce(data []byte) (*LSDAnnounce, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("lsd: %s", err)
+	}
+	if line != "BT-SEARCH * HTTP/1.1" {
+		return nil, fmt.Errorf("lsd: unexpected request line %q", line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && !(errors.Is(err, io.EOF) && len(header) > 0) {
+		return nil, fmt.Errorf("lsd: %s", err)
+	}
+
+	announce := &LSDAnnounce{
+		Host:   header.Get("Host"),
+		Cookie: header.Get("Cookie"),
+	}
+	if announce.Port, err = strconv.Atoi(header.Get("Port")); err != nil || announce.Port <= 0 || announce.Port > 65535 {
+		return nil, fmt.Errorf("lsd: invalid port %q", header.Get("Port"))
+	}
+	for _, value := range header.Values("Infohash") {
+		var infoHash [20]byte
+		if n, err := hex.Decode(infoHash[:], []byte(strings.TrimSpace(value))); err != nil || n != len(infoHash) {
+			return nil, fmt.Errorf("lsd: invalid infohash %q", value)
+		}
+		announce.InfoHashes = append(announce.InfoHashes, infoHash)
+	}
+	if len(announce.InfoHashes) == 0 {
+		return nil, fmt.Errorf("lsd: no infohash")
+	}
+	return announce, nil
+}
+
+// LSD announces torrents to the multicast group of the local network and listens for the announces of other peers
+type LSD struct {
+	Interval time.Duration
+
+	group    *net.UDPAddr
+	listener *net.UDPConn
+	conn     *net.UDPConn
+	cookie   string
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*Swarm
+	closed chan struct{}
+}
+
+// NewLSD joins the multicast group, for example LSDMulticastAddr or LSDMulticastAddr6
+func NewLSD(group string) (*LSD, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp6"
+	if addr.IP.To4() != nil {
+		network = "udp4"
+	}
+
+	listener, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if addr.Port == 0 {
+		addr.Port = listener.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	var cookie [8]byte
+	rand.Read(cookie[:])
+
+	lsd := &LSD{
+		Interval: LSDAnnounceInterval,
+		group:    addr,
+		listener: listener,
+		conn:     conn,
+		cookie:   hex.EncodeToString(cookie[:]),
+		swarms:   make(map[[20]byte]*Swarm),
+		closed:   make(chan struct{}),
+	}
+	go lsd.readLoop()
+	return lsd, nil
+}
+
+// Group returns the multicast address, its port is the listening port when the group was given with port 0
+func (lsd *LSD) Group() *net.UDPAddr {
+	return lsd.group
+}
+
+func (lsd *LSD) Close() error {
+	lsd.conn.Close()
+	return lsd.listener.Close()
+}
+
+// Announce sends a single announce of the torrents, port is the port of our peer connections
+func (lsd *LSD) Announce(port int, infoHashes ...[20]byte) error {
+	announce := LSDAnnounce{
+		Host:       lsd.group.String(),
+		Port:       port,
+		InfoHashes: infoHashes,
+		Cookie:     lsd.cookie,
+	}
+	_, err := lsd.conn.WriteToUDP(announce.Bytes(), lsd.group)
+	return err
+}
+
+// Run is the LSD peer source of a torrent: it announces every Interval and adds the announcing peers to the swarm
+func (lsd *LSD) Run(ctx context.Context, infoHash [20]byte, port int, swarm *Swarm) {
+	lsd.mu.Lock()
+	lsd.swarms[infoHash] = swarm
+	lsd.mu.Unlock()
+
+	defer func() {
+		lsd.mu.Lock()
+		delete(lsd.swarms, infoHash)
+		lsd.mu.Unlock()
+	}()
+
+	for {
+		if err := lsd.Announce(port, infoHash); err != nil {
+			log.Printf("lsd: announce failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lsd.Interval):
+		}
+	}
+}
+
+func (lsd *LSD) readLoop() {
+	defer close(lsd.closed)
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := lsd.listener.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		announce, err := ParseLSDAnnounce(buf[:n])
+		if err != nil || announce.Cookie == lsd.cookie {
+			continue
+		}
+
+		peer := TrackerPeer{Ip: addr.IP, Port: announce.Port}
+		for _, infoHash := range announce.InfoHashes {
+			lsd.mu.Lock()
+			swarm := lsd.swarms[infoHash]
+			lsd.mu.Unlock()
+			if swarm != nil {
+				swarm.AddPeers([]TrackerPeer{peer})
+			}
+		}
+	}
+}
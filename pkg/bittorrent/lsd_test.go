@@ -0,0 +1,103 @@
+package bittorrent
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLSDAnnounceRoundTrip(t *testing.T) {
+	announce := LSDAnnounce{
+		Host:       LSDMulticastAddr,
+		Port:       6881,
+		InfoHashes: [][20]byte{{1, 2, 3}, {4, 5, 6}},
+		Cookie:     "abc",
+	}
+	got, err := ParseLSDAnnounce(announce.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, announce) {
+		t.Errorf("got %+v, want %+v", *got, announce)
+	}
+}
+
+func TestParseLSDAnnounce(t *testing.T) {
+	// header names of other clients differ in case and the trailing empty lines are optional
+	got, err := ParseLSDAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nhost: 239.192.152.143:6771\r\nPORT: 7000\r\ninfohash: 0102030000000000000000000000000000000000\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Port != 7000 || len(got.InfoHashes) != 1 || got.InfoHashes[0] != [20]byte{1, 2, 3} || got.Cookie != "" {
+		t.Errorf("got %+v", got)
+	}
+
+	invalid := []string{
+		"M-SEARCH * HTTP/1.1\r\nPort: 7000\r\nInfohash: 0102030000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: 0102030000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: 0102030000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 7000\r\nInfohash: 010203\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 7000\r\n\r\n",
+	}
+	for _, data := range invalid {
+		if _, err := ParseLSDAnnounce([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+// newTestLSDs joins n LSDs to the same multicast group on a free port
+func newTestLSDs(t *testing.T, group string, n int) []*LSD {
+	t.Helper()
+
+	var lsds []*LSD
+	for i := 0; i < n; i++ {
+		lsd, err := NewLSD(group)
+		if err != nil {
+			t.Skipf("multicast is not available: %s", err)
+		}
+		t.Cleanup(func() { lsd.Close() })
+		lsd.Interval = 50 * time.Millisecond
+		lsds = append(lsds, lsd)
+		group = lsd.Group().String()
+	}
+	return lsds
+}
+
+func TestLSDRun(t *testing.T) {
+	for _, group := range []string{"239.192.152.143:0", "[ff15::efc0:988f]:0"} {
+		t.Run(group, func(t *testing.T) {
+			lsds := newTestLSDs(t, group, 2)
+			infoHash := [20]byte{1}
+			other := [20]byte{2}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			swarms := []*Swarm{NewSwarm(), NewSwarm()}
+			otherSwarm := NewSwarm()
+			go lsds[0].Run(ctx, infoHash, 7000, swarms[0])
+			go lsds[1].Run(ctx, infoHash, 7001, swarms[1])
+			go lsds[1].Run(ctx, other, 7001, otherSwarm)
+
+			for i, swarm := range swarms {
+				// every LSD only finds the other one
+				wantPort := 7001 - i
+				select {
+				case peer := <-swarm.Peers:
+					if peer.Port != wantPort {
+						t.Errorf("lsd %d: got peer %s, want port %d", i, peer, wantPort)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("lsd %d: no peer found", i)
+				}
+			}
+
+			time.Sleep(200 * time.Millisecond)
+			if swarms[0].Len() != 1 || swarms[1].Len() != 1 || otherSwarm.Len() != 0 {
+				t.Errorf("swarm sizes %d %d %d, want 1 1 0", swarms[0].Len(), swarms[1].Len(), otherSwarm.Len())
+			}
+		})
+	}
+}
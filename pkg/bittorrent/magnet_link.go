@@ -1,15 +1,11 @@
 package bittorrent
 
 import (
+	"context"
 	"crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 )
 
@@ -21,6 +17,8 @@ type MagnetLink struct {
 	Downloaded int
 	Left       int
 	Compact    int
+	// Trackers contains every "tr" parameter as its own tier
+	Trackers *TrackerList
 }
 
 func NewMagnetLink(rawURL string, port int) (*MagnetLink, error) {
@@ -39,6 +37,12 @@ func NewMagnetLink(rawURL string, port int) (*MagnetLink, error) {
 		Port:      port,
 	}
 
+	var tiers [][]string
+	for _, tr := range magnetLink.TrackerUrls() {
+		tiers = append(tiers, []string{tr})
+	}
+	magnetLink.Trackers = NewTrackerList(tiers)
+
 	_, err = rand.Read(magnetLink.PeerId[:])
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate peer_id: %s", err)
@@ -51,17 +55,33 @@ func (m *MagnetLink) TrackerUrl() string {
 	return m.magnetURL.Query().Get("tr")
 }
 
-func (m *MagnetLink) InfoHashString() string {
-	urn := "urn:btih:"
-	infoHash, found := strings.CutPrefix(m.magnetURL.Query().Get("xt"), urn)
-	if !found {
-		return ""
+func (m *MagnetLink) TrackerUrls() []string {
+	return m.magnetURL.Query()["tr"]
+}
+
+// xt returns the value of the first "xt" parameter with the given urn prefix, hybrid torrents have two
+func (m *MagnetLink) xt(urn string) string {
+	for _, xt := range m.magnetURL.Query()["xt"] {
+		if infoHash, found := strings.CutPrefix(xt, urn); found {
+			return infoHash
+		}
 	}
-	return infoHash
+	return ""
 }
 
+func (m *MagnetLink) InfoHashString() string {
+	return m.xt("urn:btih:")
+}
+
+// InfoHash returns the v1 info hash, for v2-only magnet links it is the truncated v2 info hash
 func (m *MagnetLink) InfoHash() ([20]byte, error) {
 	var hash [20]byte
+	if m.InfoHashString() == "" {
+		if hashV2, err := m.InfoHashV2(); err == nil {
+			copy(hash[:], hashV2[:])
+			return hash, nil
+		}
+	}
 	_, err := hex.Decode(hash[:], []byte(m.InfoHashString()))
 	if err != nil {
 		return hash, err
@@ -69,68 +89,73 @@ func (m *MagnetLink) InfoHash() ([20]byte, error) {
 	return hash, nil
 }
 
-func (m *MagnetLink) newTrackerRequestURL() (string, error) {
-	infoHash, err := m.InfoHash()
-	if err != nil {
-		return "", err
-	}
-
-	trackerParams := url.Values{}
-	trackerParams.Set("info_hash", string(infoHash[:]))
-	trackerParams.Set("peer_id", string(m.PeerId[:]))
-	trackerParams.Set("port", strconv.Itoa(m.Port))
-	trackerParams.Set("uploaded", strconv.Itoa(m.Uploaded))
-	trackerParams.Set("downloaded", strconv.Itoa(m.Downloaded))
-	// TODO: this should be calculated in the future if provided in magnetURL
-	//trackerParams.Set("left", strconv.Itoa(m.Left))
-	trackerParams.Set("left", strconv.Itoa(1))
-	trackerParams.Set("compact", strconv.Itoa(m.Compact))
-
-	trackerRequestURL := fmt.Sprintf("%s?%s", m.TrackerUrl(), trackerParams.Encode())
-	return trackerRequestURL, nil
-}
-
-func (m *MagnetLink) GetTrackerResponse() (*TrackerResponse, error) {
-	trackerRequestURL, err := m.newTrackerRequestURL()
+// InfoHashV2 decodes "xt=urn:btmh:" which is a multihash, 0x12 0x20 is the prefix of SHA-256
+func (m *MagnetLink) InfoHashV2() ([32]byte, error) {
+	var hash [32]byte
+	multihash, err := hex.DecodeString(m.xt("urn:btmh:"))
 	if err != nil {
-		return nil, err
+		return hash, err
 	}
-	//fmt.Println(trackerRequestURL)
-	resp, err := http.Get(trackerRequestURL)
-	if err != nil {
-		return nil, err
+	if len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+		return hash, fmt.Errorf("xt: expected a sha2-256 multihash")
 	}
-	defer resp.Body.Close()
+	copy(hash[:], multihash[2:])
+	return hash, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+func (m *MagnetLink) newAnnounceRequest() (*AnnounceRequest, error) {
+	infoHash, err := m.InfoHash()
 	if err != nil {
 		return nil, err
 	}
 
-	//fmt.Printf("%s\n", string(body))
+	return &AnnounceRequest{
+		InfoHash:   infoHash,
+		PeerID:     m.PeerId,
+		Port:       m.Port,
+		Uploaded:   m.Uploaded,
+		Downloaded: m.Downloaded,
+		// TODO: this should be calculated in the future if provided in magnetURL
+		Left:    1,
+		Compact: m.Compact,
+	}, nil
+}
 
-	// TODO: this whole thing needs to be refactored. Do not expect specific values in the response
-	trackerResponse, _, err := DecodeBencodeDict(string(body))
+// FindPeers asks the trackers for peers, when they know none (or there are no trackers) it starts the DHT with
+// startDHT and asks it. The DHT is nil if it was not needed, the caller closes it otherwise.
+func (m *MagnetLink) FindPeers(ctx context.Context, startDHT func() (*DHT, error)) ([]TrackerPeer, *DHT, error) {
+	request, err := m.newAnnounceRequest()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	//fmt.Printf("%v", trackerResponse)
+	response, _, trackerErr := m.Trackers.Announce(ctx, request)
+	if trackerErr == nil && len(response.Peers) > 0 {
+		return response.Peers, nil, nil
+	}
+	if startDHT == nil {
+		return nil, nil, fmt.Errorf("no peers from trackers: %v", trackerErr)
+	}
 
-	response := &TrackerResponse{Peers: make([]TrackerPeer, 0)}
-	peers, err := getInfoValue(trackerResponse, "peers", "")
+	dht, err := startDHT()
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("no peers from trackers (%v), failed to start dht: %w", trackerErr, err)
 	}
-
-	for i := 0; i < len(peers); i += 6 {
-		response.Peers = append(response.Peers, TrackerPeer{Ip: net.IPv4(peers[i], peers[i+1], peers[i+2], peers[i+3]), Port: int(binary.BigEndian.Uint16([]byte(peers[i+4:])))})
+	peers, err := dht.FindPeers(ctx, request.InfoHash)
+	if err != nil {
+		return nil, dht, fmt.Errorf("no peers from trackers (%v) or dht: %w", trackerErr, err)
+	}
+	if len(peers) == 0 {
+		return nil, dht, fmt.Errorf("no peers from trackers (%v) or dht", trackerErr)
 	}
+	return peers, dht, nil
+}
 
-	response.Interval, err = getInfoValue(trackerResponse, "interval", response.Interval)
+func (m *MagnetLink) GetTrackerResponse() (*TrackerResponse, error) {
+	request, err := m.newAnnounceRequest()
 	if err != nil {
-		response.Interval = -1
+		return nil, err
 	}
-
-	return response, nil
+	response, _, err := m.Trackers.Announce(context.Background(), request)
+	return response, err
 }
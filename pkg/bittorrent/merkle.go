@@ -0,0 +1,122 @@
+package bittorrent
+
+import (
+	"crypto/sha256"
+)
+
+// BitTorrent v2 (BEP 52) hashes every file as a SHA-256 merkle tree over 16 KiB blocks.
+// Leaves beyond the end of the file are zero hashes, the tree is always a full binary tree.
+
+const MerkleBlockSize = 16 * 1024
+
+// MerkleBlockHashes returns the leaf hashes of data, the last block may be shorter than MerkleBlockSize
+func MerkleBlockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+MerkleBlockSize-1)/MerkleBlockSize)
+	for start := 0; start < len(data); start += MerkleBlockSize {
+		end := min(start+MerkleBlockSize, len(data))
+		hashes = append(hashes, sha256.Sum256(data[start:end]))
+	}
+	return hashes
+}
+
+// MerklePadHash returns the root of a subtree of the given height that only contains zero leaves
+func MerklePadHash(height int) [32]byte {
+	var hash [32]byte
+	for i := 0; i < height; i++ {
+		hash = merkleParent(hash, hash)
+	}
+	return hash
+}
+
+// MerkleRoot computes the root of hashes padded to width (a power of two) with pad
+func MerkleRoot(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = merkleParent(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+func merkleParent(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// VerifyMerkle checks that data hashes to root when its block hashes are padded to leaves
+func VerifyMerkle(data []byte, root [32]byte, leaves int) bool {
+	hashes := MerkleBlockHashes(data)
+	if len(hashes) > leaves || leaves <= 0 {
+		return false
+	}
+	return MerkleRoot(hashes, leaves, [32]byte{}) == root
+}
+
+// MerkleFileLeaves returns the number of leaves of the tree of a file, blocks rounded up to a power of two
+func MerkleFileLeaves(length int) int {
+	return nextPowerOfTwo((length + MerkleBlockSize - 1) / MerkleBlockSize)
+}
+
+// PiecesRootFromLayer computes the file root from its piece layer, pieceLength is a power of two >= MerkleBlockSize
+func PiecesRootFromLayer(layer [][32]byte, pieceLength int) [32]byte {
+	return MerkleRoot(layer, nextPowerOfTwo(len(layer)), MerklePadHash(log2(pieceLength/MerkleBlockSize)))
+}
+
+// MerkleProof returns the uncle hashes of the node idx of layer from the lowest layer up to the root,
+// the width of layer is a power of two
+func MerkleProof(layer [][32]byte, idx int) [][32]byte {
+	var uncles [][32]byte
+	layer = append([][32]byte(nil), layer...)
+	for len(layer) > 1 {
+		uncles = append(uncles, layer[idx^1])
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = merkleParent(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+		idx /= 2
+	}
+	return uncles
+}
+
+// MerkleRootFromProof computes the root from the node idx of a layer and its uncle hashes, see MerkleProof
+func MerkleRootFromProof(node [32]byte, idx int, uncles [][32]byte) [32]byte {
+	for _, uncle := range uncles {
+		if idx%2 == 0 {
+			node = merkleParent(node, uncle)
+		} else {
+			node = merkleParent(uncle, node)
+		}
+		idx /= 2
+	}
+	return node
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// log2 returns the exponent of n, a power of two
+func log2(n int) int {
+	exponent := 0
+	for ; n > 1; n /= 2 {
+		exponent++
+	}
+	return exponent
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
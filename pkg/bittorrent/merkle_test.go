@@ -0,0 +1,69 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// naiveMerkleRoot pads the leaves with zero hashes to a power of two and hashes pairs recursively
+func naiveMerkleRoot(leaves [][32]byte) [32]byte {
+	width := 1
+	for width < len(leaves) {
+		width *= 2
+	}
+	padded := append(append([][32]byte(nil), leaves...), make([][32]byte, width-len(leaves))...)
+	if len(padded) == 1 {
+		return padded[0]
+	}
+	left := naiveMerkleRoot(padded[:width/2])
+	right := naiveMerkleRoot(padded[width/2:])
+	return sha256.Sum256(append(left[:], right[:]...))
+}
+
+func naiveBlockHashes(data []byte) [][32]byte {
+	var hashes [][32]byte
+	for len(data) > 0 {
+		n := min(len(data), MerkleBlockSize)
+		hashes = append(hashes, sha256.Sum256(data[:n]))
+		data = data[n:]
+	}
+	return hashes
+}
+
+func TestMerkleRoot(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5*MerkleBlockSize/10+7)
+	want := naiveMerkleRoot(naiveBlockHashes(data))
+
+	if got := MerkleRoot(MerkleBlockHashes(data), MerkleFileLeaves(len(data)), [32]byte{}); got != want {
+		t.Errorf("got %x want %x", got, want)
+	}
+	if !VerifyMerkle(data, want, 8) {
+		t.Errorf("expected data to verify")
+	}
+	if VerifyMerkle(data, want, 4) {
+		t.Errorf("expected too few leaves to fail")
+	}
+	data[0] ^= 1
+	if VerifyMerkle(data, want, 8) {
+		t.Errorf("expected modified data to fail")
+	}
+}
+
+func TestPiecesRootFromLayer(t *testing.T) {
+	// 5 pieces of 2 blocks, the layer is padded with the roots of 2 zero blocks
+	data := bytes.Repeat([]byte{7}, 9*MerkleBlockSize+100)
+	blocks := naiveBlockHashes(data)
+	var layer [][32]byte
+	for i := 0; i < len(blocks); i += 2 {
+		layer = append(layer, naiveMerkleRoot(blocks[i:min(i+2, len(blocks))]))
+	}
+
+	got := PiecesRootFromLayer(layer, 2*MerkleBlockSize)
+	if want := naiveMerkleRoot(blocks); got != want {
+		t.Errorf("got %x want %x", got, want)
+	}
+	if pad := MerklePadHash(1); pad != naiveMerkleRoot(make([][32]byte, 2)) {
+		t.Errorf("unexpected pad hash %x", pad)
+	}
+}
@@ -0,0 +1,143 @@
+package bittorrent
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// PeerHandshakeTimeout limits the time an incoming connection has to send its handshake
+const PeerHandshakeTimeout = 10 * time.Second
+
+// PeerListener accepts the connections of other peers for the torrents that were added to it
+// and serves them their verified pieces. It is safe for concurrent use.
+type PeerListener struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	seeds map[[20]byte]*Seed
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+// NewPeerListener listens on the TCP address, for example ":6881"
+func NewPeerListener(address string) (*PeerListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	peerListener := &PeerListener{
+		listener: listener,
+		seeds:    make(map[[20]byte]*Seed),
+		conns:    make(map[net.Conn]bool),
+	}
+	peerListener.wg.Add(1)
+	go peerListener.acceptLoop()
+	return peerListener, nil
+}
+
+func (peerListener *PeerListener) Addr() *net.TCPAddr {
+	return peerListener.listener.Addr().(*net.TCPAddr)
+}
+
+// Add accepts connections for the torrent of seed
+func (peerListener *PeerListener) Add(seed *Seed) error {
+	infoHash, err := seed.Torrent.InfoHash()
+	if err != nil {
+		return err
+	}
+
+	peerListener.mu.Lock()
+	defer peerListener.mu.Unlock()
+	peerListener.seeds[infoHash] = seed
+	return nil
+}
+
+// Remove stops accepting connections for the torrent, open connections are not closed
+func (peerListener *PeerListener) Remove(infoHash [20]byte) {
+	peerListener.mu.Lock()
+	defer peerListener.mu.Unlock()
+	delete(peerListener.seeds, infoHash)
+}
+
+// Close stops listening, closes all connections and waits for them to finish
+func (peerListener *PeerListener) Close() error {
+	err := peerListener.listener.Close()
+
+	peerListener.mu.Lock()
+	for conn := range peerListener.conns {
+		conn.Close()
+	}
+	peerListener.mu.Unlock()
+
+	peerListener.wg.Wait()
+	return err
+}
+
+func (peerListener *PeerListener) acceptLoop() {
+	defer peerListener.wg.Done()
+
+	for {
+		conn, err := peerListener.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("peer listener: accept failed: %s", err)
+			continue
+		}
+
+		peerListener.mu.Lock()
+		peerListener.conns[conn] = true
+		peerListener.wg.Add(1)
+		peerListener.mu.Unlock()
+
+		go func() {
+			defer peerListener.wg.Done()
+			defer func() {
+				peerListener.mu.Lock()
+				delete(peerListener.conns, conn)
+				peerListener.mu.Unlock()
+				conn.Close()
+			}()
+
+			if err := peerListener.handle(conn); err != nil {
+				log.Printf("%s: incoming connection closed: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handle answers the handshake of an incoming connection and uploads to the peer until it disconnects
+func (peerListener *PeerListener) handle(conn net.Conn) error {
+	_ = conn.SetReadDeadline(time.Now().Add(PeerHandshakeTimeout))
+	handshake, err := NewMessageReader(conn).ReadHandshake()
+	if err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	infoHash := handshake.AsHandshake().InfoHash()
+
+	peerListener.mu.Lock()
+	seed := peerListener.seeds[infoHash]
+	peerListener.mu.Unlock()
+	if seed == nil {
+		return errors.New("unknown info hash")
+	}
+	// the same check as for the handshake of an outgoing connection
+	seedInfoHash, err := seed.Torrent.InfoHash()
+	if err != nil {
+		return err
+	}
+	if err := handshake.AsHandshake().Validate(seedInfoHash); err != nil {
+		return err
+	}
+
+	if _, err := NewHandshakeMessage(seed.Torrent.Progress.PeerID, infoHash).WriteTo(conn); err != nil {
+		return err
+	}
+	return seed.serve(conn)
+}
@@ -0,0 +1,149 @@
+package bittorrent
+
+import (
+	"fmt"
+	"time"
+)
+
+// Peer exchange (ut_pex, BEP 11)
+
+const (
+	PexExtensionName = "ut_pex"
+	// PexExtensionId is the id of ut_pex in our extension handshake, peers send their PEX messages with it
+	PexExtensionId = 2
+	// PexInterval is the time between two PEX messages to the same peer, BEP 11 asks for at least a minute
+	PexInterval = time.Minute
+	// PexMaxPeers limits the added and the dropped peers of a single message
+	PexMaxPeers = 50
+)
+
+// Flags of the added peers
+const (
+	PexFlagEncryption = 0x01
+	PexFlagSeed       = 0x02
+	PexFlagUTP        = 0x04
+	PexFlagHolepunch  = 0x08
+	// PexFlagReachable is set for peers that accepted an outgoing connection
+	PexFlagReachable = 0x10
+)
+
+// PexMessage contains the compact peers that connected or disconnected since the previous message,
+// the flags hold one byte for every added peer
+type PexMessage struct {
+	Added       string `bencode:"added"`
+	AddedFlags  string `bencode:"added.f"`
+	Added6      string `bencode:"added6,omitempty"`
+	Added6Flags string `bencode:"added6.f,omitempty"`
+	Dropped     string `bencode:"dropped"`
+	Dropped6    string `bencode:"dropped6,omitempty"`
+}
+
+type PexPeer struct {
+	TrackerPeer
+	Flags byte
+}
+
+// NewPexMessage splits the peers into the IPv4 and the IPv6 lists
+func NewPexMessage(added []PexPeer, dropped []TrackerPeer) *PexMessage {
+	var msg PexMessage
+	for _, peer := range added {
+		if compact := CompactPeers([]TrackerPeer{peer.TrackerPeer}); len(compact) > 0 {
+			msg.Added += string(compact)
+			msg.AddedFlags += string(peer.Flags)
+		} else if compact := CompactPeers6([]TrackerPeer{peer.TrackerPeer}); len(compact) > 0 {
+			msg.Added6 += string(compact)
+			msg.Added6Flags += string(peer.Flags)
+		}
+	}
+	msg.Dropped = string(CompactPeers(dropped))
+	msg.Dropped6 = string(CompactPeers6(dropped))
+	return &msg
+}
+
+// ParsePexMessage decodes the dict of a ut_pex extended message
+func ParsePexMessage(m *ExtendedMessage) (*PexMessage, error) {
+	var msg PexMessage
+	if _, err := m.UnmarshalDict(&msg); err != nil {
+		return nil, fmt.Errorf("ut_pex: %s", err)
+	}
+	return &msg, nil
+}
+
+// Peers returns the added and the dropped peers of both address families.
+// Flags are zero when the flags string does not match the number of added peers.
+func (msg *PexMessage) Peers() (added []PexPeer, dropped []TrackerPeer, err error) {
+	for _, list := range []struct {
+		peers, flags string
+		parse        func([]byte) ([]TrackerPeer, error)
+	}{
+		{msg.Added, msg.AddedFlags, ParseCompactPeers},
+		{msg.Added6, msg.Added6Flags, ParseCompactPeers6},
+	} {
+		peers, err := list.parse([]byte(list.peers))
+		if err != nil {
+			return nil, nil, fmt.Errorf("ut_pex added: %s", err)
+		}
+		for i, peer := range peers {
+			pexPeer := PexPeer{TrackerPeer: peer}
+			if len(list.flags) == len(peers) {
+				pexPeer.Flags = list.flags[i]
+			}
+			added = append(added, pexPeer)
+		}
+	}
+
+	if dropped, err = ParseCompactPeers([]byte(msg.Dropped)); err != nil {
+		return nil, nil, fmt.Errorf("ut_pex dropped: %s", err)
+	}
+	dropped6, err := ParseCompactPeers6([]byte(msg.Dropped6))
+	if err != nil {
+		return nil, nil, fmt.Errorf("ut_pex dropped6: %s", err)
+	}
+	return added, append(dropped, dropped6...), nil
+}
+
+// PexSender computes the PEX messages for one connection, every message contains the changes
+// of the connected peers since the previous one. The first message contains all of them.
+type PexSender struct {
+	sent map[string]PexPeer
+}
+
+func NewPexSender() *PexSender {
+	return &PexSender{sent: make(map[string]PexPeer)}
+}
+
+// Next returns the message for the currently connected peers, nil when nothing changed.
+// Changes beyond PexMaxPeers are left for the next message.
+func (sender *PexSender) Next(connected []PexPeer) *PexMessage {
+	current := make(map[string]PexPeer, len(connected))
+	for _, peer := range connected {
+		current[peer.String()] = peer
+	}
+
+	var added []PexPeer
+	var dropped []TrackerPeer
+	for address, peer := range current {
+		if _, ok := sender.sent[address]; !ok && len(added) < PexMaxPeers {
+			added = append(added, peer)
+			sender.sent[address] = peer
+		}
+	}
+	for address, peer := range sender.sent {
+		if _, ok := current[address]; !ok && len(dropped) < PexMaxPeers {
+			dropped = append(dropped, peer.TrackerPeer)
+			delete(sender.sent, address)
+		}
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	return NewPexMessage(added, dropped)
+}
+
+// NewPexExtendedMessage encodes msg for a peer that uses peerPexId for ut_pex
+func NewPexExtendedMessage(peerPexId int, msg *PexMessage) (*ExtendedMessage, error) {
+	extended := NewExtendedMessage()
+	extended.SetExtensionMessageId(byte(peerPexId))
+	return extended.AddDict(msg)
+}
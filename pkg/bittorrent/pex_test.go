@@ -0,0 +1,243 @@
+package bittorrent
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func pexTestPeer(ip string, port int, flags byte) PexPeer {
+	return PexPeer{TrackerPeer: TrackerPeer{Ip: net.ParseIP(ip), Port: port}, Flags: flags}
+}
+
+func pexPeerStrings(peers []PexPeer) []string {
+	result := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		result = append(result, fmt.Sprintf("%s/%d", peer, peer.Flags))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func trackerPeerStrings(peers []TrackerPeer) []string {
+	result := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		result = append(result, peer.String())
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	added := []PexPeer{
+		pexTestPeer("10.0.0.1", 6881, PexFlagSeed),
+		pexTestPeer("2001:db8::1", 6882, PexFlagReachable|PexFlagUTP),
+		pexTestPeer("10.0.0.2", 6883, 0),
+	}
+	dropped := []TrackerPeer{
+		{Ip: net.ParseIP("10.0.0.3"), Port: 1},
+		{Ip: net.ParseIP("2001:db8::2"), Port: 2},
+	}
+
+	extended, err := NewPexExtendedMessage(5, NewPexMessage(added, dropped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := extended.ExtensionMessageId(); id != 5 {
+		t.Errorf("extension id %d, want 5", id)
+	}
+
+	msg, err := ParsePexMessage(extended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Added) != 12 || msg.AddedFlags != string([]byte{PexFlagSeed, 0}) {
+		t.Errorf("added %x flags %x", msg.Added, msg.AddedFlags)
+	}
+	if len(msg.Added6) != 18 || msg.Added6Flags != string([]byte{PexFlagReachable | PexFlagUTP}) {
+		t.Errorf("added6 %x flags %x", msg.Added6, msg.Added6Flags)
+	}
+
+	gotAdded, gotDropped, err := msg.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pexPeerStrings(gotAdded), pexPeerStrings(added); !reflect.DeepEqual(got, want) {
+		t.Errorf("added %v, want %v", got, want)
+	}
+	if got, want := trackerPeerStrings(gotDropped), trackerPeerStrings(dropped); !reflect.DeepEqual(got, want) {
+		t.Errorf("dropped %v, want %v", got, want)
+	}
+}
+
+func TestPexMessagePeersInvalid(t *testing.T) {
+	tests := []PexMessage{
+		{Added: "12345"},
+		{Added6: "123456"},
+		{Dropped: "1234567"},
+		{Dropped6: "1"},
+	}
+	for _, msg := range tests {
+		if _, _, err := msg.Peers(); err == nil {
+			t.Errorf("%+v: expected an error", msg)
+		}
+	}
+
+	// flags that do not match the peers are ignored
+	msg := PexMessage{Added: "\x0a\x00\x00\x01\x1a\xe1", AddedFlags: "\x02\x02"}
+	added, _, err := msg.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].Flags != 0 || added[0].String() != "10.0.0.1:6881" {
+		t.Errorf("added %v", added)
+	}
+}
+
+func TestPexSender(t *testing.T) {
+	a := pexTestPeer("10.0.0.1", 1, PexFlagReachable)
+	b := pexTestPeer("10.0.0.2", 2, PexFlagReachable)
+	c := pexTestPeer("2001:db8::3", 3, PexFlagReachable)
+
+	sender := NewPexSender()
+	if msg := sender.Next(nil); msg != nil {
+		t.Errorf("no peers: got %+v", msg)
+	}
+
+	msg := sender.Next([]PexPeer{a, b})
+	added, dropped, _ := msg.Peers()
+	if got, want := pexPeerStrings(added), pexPeerStrings([]PexPeer{a, b}); !reflect.DeepEqual(got, want) || len(dropped) != 0 {
+		t.Errorf("first message: added %v dropped %v", got, dropped)
+	}
+
+	if msg := sender.Next([]PexPeer{b, a}); msg != nil {
+		t.Errorf("unchanged peers: got %+v", msg)
+	}
+
+	msg = sender.Next([]PexPeer{b, c})
+	added, dropped, _ = msg.Peers()
+	if got := pexPeerStrings(added); !reflect.DeepEqual(got, pexPeerStrings([]PexPeer{c})) {
+		t.Errorf("added %v", got)
+	}
+	if got := trackerPeerStrings(dropped); !reflect.DeepEqual(got, []string{"10.0.0.1:1"}) {
+		t.Errorf("dropped %v", got)
+	}
+}
+
+func TestPexSenderLimit(t *testing.T) {
+	var peers []PexPeer
+	for i := 0; i < PexMaxPeers+10; i++ {
+		peers = append(peers, pexTestPeer("10.0.0.1", 1000+i, 0))
+	}
+
+	sender := NewPexSender()
+	added, _, _ := sender.Next(peers).Peers()
+	if len(added) != PexMaxPeers {
+		t.Errorf("first message: %d peers, want %d", len(added), PexMaxPeers)
+	}
+	added, _, _ = sender.Next(peers).Peers()
+	if len(added) != 10 {
+		t.Errorf("second message: %d peers, want 10", len(added))
+	}
+}
+
+func TestHandleExtendedMessagePex(t *testing.T) {
+	handler := NewPeerStateHandler()
+	swarm := NewSwarm()
+
+	handshake := addTestDict(t, NewExtendedMessage(), ExtensionHandshake{M: map[string]int{PexExtensionName: 7}})
+	if err := handler.HandleExtendedMessage(handshake, swarm); err != nil {
+		t.Fatal(err)
+	}
+	if id := handler.PeerState.Extensions[PexExtensionName]; id != 7 {
+		t.Errorf("peer ut_pex id %d, want 7", id)
+	}
+
+	connected := pexTestPeer("10.0.0.9", 9, PexFlagReachable)
+	swarm.Connected(connected)
+
+	msg, err := NewPexExtendedMessage(PexExtensionId, NewPexMessage([]PexPeer{
+		pexTestPeer("10.0.0.1", 1, 0),
+		pexTestPeer("2001:db8::2", 2, PexFlagSeed),
+		connected,
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.HandleExtendedMessage(msg, swarm); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []TrackerPeer
+	for len(swarm.Peers) > 0 {
+		got = append(got, <-swarm.Peers)
+	}
+	if want := []string{"10.0.0.1:1", "[2001:db8::2]:2"}; !reflect.DeepEqual(trackerPeerStrings(got), want) {
+		t.Errorf("swarm peers %v, want %v", trackerPeerStrings(got), want)
+	}
+
+	invalid := NewExtendedMessage()
+	invalid.SetExtensionMessageId(PexExtensionId)
+	invalid = addTestDict(t, invalid, PexMessage{Added: "1234"})
+	if err := handler.HandleExtendedMessage(invalid, swarm); err == nil {
+		t.Error("expected an error for a truncated added list")
+	}
+
+	// a ut_metadata message is not taken for pex
+	metadata := NewExtendedMessage()
+	metadata.SetExtensionMessageId(MetadataExtensionId)
+	metadata = addTestDict(t, metadata, PexMessage{Added: "1234"})
+	if err := handler.HandleExtendedMessage(metadata, swarm); err != nil {
+		t.Errorf("ut_metadata message: %s", err)
+	}
+}
+
+func TestExtensionHandshakeIds(t *testing.T) {
+	for name, id := range NewExtensionHandshake().M {
+		if got := ExtensionName(byte(id)); got != name {
+			t.Errorf("id %d: got %q want %q", id, got, name)
+		}
+	}
+	if got := ExtensionName(0); got != "" {
+		t.Errorf("id 0: got %q want none", got)
+	}
+	if NewExtensionHandshake().M[MetadataExtensionName] == 0 {
+		t.Error("ut_metadata is not advertised")
+	}
+}
+
+func TestSwarmConnectedPeers(t *testing.T) {
+	swarm := NewSwarm()
+	a := pexTestPeer("10.0.0.1", 1, PexFlagReachable)
+	b := pexTestPeer("10.0.0.2", 2, PexFlagReachable)
+	swarm.Connected(a)
+	swarm.Connected(b)
+
+	if got := pexPeerStrings(swarm.ConnectedPeers(a.TrackerPeer)); !reflect.DeepEqual(got, pexPeerStrings([]PexPeer{b})) {
+		t.Errorf("connected peers except a: %v", got)
+	}
+
+	swarm.Disconnected(b.TrackerPeer)
+	if got := swarm.ConnectedPeers(TrackerPeer{}); len(got) != 1 {
+		t.Errorf("connected peers after disconnect: %v", got)
+	}
+
+	// connected peers are not reported again
+	if n := swarm.AddPeers([]TrackerPeer{a.TrackerPeer, b.TrackerPeer}); n != 0 {
+		t.Errorf("added %d connected peers", n)
+	}
+}
+
+func TestParsePeerAddress(t *testing.T) {
+	peer, err := ParsePeerAddress("[2001:db8::1]:6881")
+	if err != nil || peer.String() != "[2001:db8::1]:6881" {
+		t.Errorf("got %v, %v", peer, err)
+	}
+	for _, address := range []string{"example.com:6881", "10.0.0.1", "10.0.0.1:0", "10.0.0.1:x"} {
+		if _, err := ParsePeerAddress(address); err == nil {
+			t.Errorf("%s: expected an error", address)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package bittorrent
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	// DefaultRandomFirstPieces are picked at random, so that there is something to upload as soon as possible
+	DefaultRandomFirstPieces = 4
+)
+
+// PiecePicker decides which piece a peer downloads next. The first RandomFirst pieces are picked at random,
+// after that the piece that the fewest peers have is picked, ties are broken at random.
+//
+// Once every remaining piece is downloaded by some peer, the picker is in endgame mode: peers also get
+// a piece that another peer is downloading, so that a slow peer does not hold up the end of the download.
+// The peers share the blocks of the piece, each one requests the blocks that are missing, and cancels its
+// requests of the blocks that arrive from another peer.
+// It is safe for concurrent use.
+type PiecePicker struct {
+	RandomFirst int
+
+	mu sync.Mutex
+	// pieces holds the pieces that are not done yet
+	pieces map[int]*Piece
+	// availability counts the peers that have each piece
+	availability []int
+	// active maps the pieces that are downloaded to the number of peers that download them
+	active    map[int]int
+	completed int
+	// changed is closed and replaced whenever a piece may become available to Pick
+	changed chan struct{}
+	// updated is closed and replaced whenever a piece that several peers download changes
+	updated chan struct{}
+}
+
+// NewPiecePicker picks among pieces, count is the number of pieces of the torrent
+func NewPiecePicker(count int, pieces []*Piece) *PiecePicker {
+	picker := &PiecePicker{
+		RandomFirst:  DefaultRandomFirstPieces,
+		pieces:       make(map[int]*Piece, len(pieces)),
+		availability: make([]int, count),
+		active:       make(map[int]int),
+		changed:      make(chan struct{}),
+		updated:      make(chan struct{}),
+	}
+	for _, piece := range pieces {
+		picker.pieces[piece.Idx] = piece
+	}
+	return picker
+}
+
+// AddPeer adds the pieces of a peer to the availability
+func (picker *PiecePicker) AddPeer(bitfield Bitfield) {
+	picker.updateAvailability(bitfield, 1)
+}
+
+// RemovePeer removes the pieces of a peer from the availability, when it disconnects or sends a new bitfield
+func (picker *PiecePicker) RemovePeer(bitfield Bitfield) {
+	picker.updateAvailability(bitfield, -1)
+}
+
+func (picker *PiecePicker) updateAvailability(bitfield Bitfield, delta int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	for idx := range picker.availability {
+		if bitfield.Has(idx) {
+			picker.availability[idx] += delta
+		}
+	}
+}
+
+// Have adds a piece that a peer announced with HAVE to the availability
+func (picker *PiecePicker) Have(idx int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	if idx >= 0 && idx < len(picker.availability) {
+		picker.availability[idx]++
+	}
+}
+
+// Availability returns the number of peers that have the piece
+func (picker *PiecePicker) Availability(idx int) int {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.availability[idx]
+}
+
+// Remaining returns the number of pieces that are not done
+func (picker *PiecePicker) Remaining() int {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return len(picker.pieces)
+}
+
+// Endgame reports whether every remaining piece is downloaded by some peer
+func (picker *PiecePicker) Endgame() bool {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.endgame()
+}
+
+func (picker *PiecePicker) endgame() bool {
+	return len(picker.pieces) > 0 && len(picker.active) == len(picker.pieces)
+}
+
+// Changed returns a channel that is closed when a piece is given back or the endgame starts,
+// peers that got no piece from Pick should try again then
+func (picker *PiecePicker) Changed() <-chan struct{} {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.changed
+}
+
+// Notify closes the Changed channel, for example when the hashes of v2 pieces arrived so that they can be picked
+func (picker *PiecePicker) Notify() {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	picker.notify()
+}
+
+func (picker *PiecePicker) notify() {
+	close(picker.changed)
+	picker.changed = make(chan struct{})
+}
+
+// Pick returns the next piece for a peer with the pieces of bitfield, or nil when the peer has none of the
+// remaining pieces. In endgame mode the piece is one that other peers download, the one with the fewest
+// peers is picked. The bitfield must not have the pieces the peer is downloading already.
+func (picker *PiecePicker) Pick(bitfield Bitfield) *Piece {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	if picker.endgame() {
+		return picker.pickEndgame(bitfield)
+	}
+
+	var candidates []*Piece
+	rarest := 0
+	for idx, piece := range picker.pieces {
+		if !bitfield.Has(idx) || picker.active[idx] > 0 {
+			continue
+		}
+		if picker.completed < picker.RandomFirst {
+			candidates = append(candidates, piece)
+			continue
+		}
+
+		switch availability := picker.availability[idx]; {
+		case len(candidates) == 0 || availability < rarest:
+			candidates = append(candidates[:0], piece)
+			rarest = availability
+		case availability == rarest:
+			candidates = append(candidates, piece)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	piece := candidates[rand.Intn(len(candidates))]
+	picker.active[piece.Idx] = 1
+	if picker.endgame() {
+		picker.notify()
+	}
+	return piece
+}
+
+func (picker *PiecePicker) pickEndgame(bitfield Bitfield) *Piece {
+	var candidates []*Piece
+	fewest := 0
+	for idx, peers := range picker.active {
+		if !bitfield.Has(idx) {
+			continue
+		}
+		switch {
+		case len(candidates) == 0 || peers < fewest:
+			candidates = append(candidates[:0], picker.pieces[idx])
+			fewest = peers
+		case peers == fewest:
+			candidates = append(candidates, picker.pieces[idx])
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	piece := candidates[rand.Intn(len(candidates))]
+	picker.active[piece.Idx]++
+	return piece
+}
+
+// Updated returns a channel that is closed when a piece that several peers download got a block, was done
+// or given back. The peers then cancel their requests of blocks that arrived and drop the pieces that are
+// no longer Active.
+func (picker *PiecePicker) Updated() <-chan struct{} {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.updated
+}
+
+func (picker *PiecePicker) update() {
+	close(picker.updated)
+	picker.updated = make(chan struct{})
+}
+
+// Active reports whether the piece is downloaded by some peer, it is not once it is done
+func (picker *PiecePicker) Active(piece *Piece) bool {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.active[piece.Idx] > 0
+}
+
+// Received records that a block of the piece arrived, the other peers of the piece are updated
+func (picker *PiecePicker) Received(piece *Piece) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	if picker.active[piece.Idx] > 1 {
+		picker.update()
+	}
+}
+
+// Done records a downloaded piece, the other peers of the piece are updated.
+// It returns false when the piece is not active.
+func (picker *PiecePicker) Done(piece *Piece) bool {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	peers := picker.active[piece.Idx]
+	if peers == 0 {
+		return false
+	}
+	if peers > 1 {
+		picker.update()
+	}
+	delete(picker.active, piece.Idx)
+	delete(picker.pieces, piece.Idx)
+	picker.completed++
+	if picker.endgame() {
+		picker.notify()
+	}
+	return true
+}
+
+// Failed gives the piece back for one peer, it is picked again unless other peers are still downloading it.
+// The other peers are updated then, they request the blocks that this peer will not send.
+func (picker *PiecePicker) Failed(piece *Piece) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	switch picker.active[piece.Idx] {
+	case 0:
+	case 1:
+		delete(picker.active, piece.Idx)
+		piece.Reset()
+		picker.notify()
+	default:
+		picker.active[piece.Idx]--
+		picker.update()
+	}
+}
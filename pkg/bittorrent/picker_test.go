@@ -0,0 +1,141 @@
+package bittorrent
+
+import (
+	"testing"
+)
+
+func newTestPicker(count int) (*PiecePicker, Bitfield) {
+	pieces := make([]*Piece, count)
+	all := NewBitfield(count)
+	for i := range pieces {
+		pieces[i] = &Piece{Idx: i, Len: LEN_PIECE_BLOCK_STANDARD}
+		all.Set(i)
+	}
+	return NewPiecePicker(count, pieces), all
+}
+
+func TestPiecePickerRarestFirst(t *testing.T) {
+	picker, all := newTestPicker(6)
+	picker.RandomFirst = 0
+
+	// every piece but 4 is available from three peers
+	for i := 0; i < 3; i++ {
+		picker.AddPeer(all)
+	}
+	rare := NewBitfield(6)
+	rare.Set(0)
+	picker.RemovePeer(rare)
+	picker.RemovePeer(rare)
+	picker.Have(5)
+	four := NewBitfield(6)
+	four.Set(4)
+	picker.RemovePeer(four)
+	picker.RemovePeer(four)
+
+	if piece := picker.Pick(all); piece == nil || piece.Idx != 0 && piece.Idx != 4 {
+		t.Fatalf("picked %v, want one of the rarest pieces 0 and 4", piece)
+	}
+	if piece := picker.Pick(all); piece == nil || piece.Idx != 0 && piece.Idx != 4 {
+		t.Fatalf("picked %v, want the other rarest piece", piece)
+	}
+	if piece := picker.Pick(rare); piece != nil {
+		t.Errorf("picked piece %d that is downloaded already", piece.Idx)
+	}
+	// piece 5 has one more peer than the others
+	for i := 0; i < 3; i++ {
+		if piece := picker.Pick(all); piece == nil || piece.Idx == 5 {
+			t.Fatalf("picked %v before the rarer pieces", piece)
+		}
+	}
+}
+
+func TestPiecePickerRandomFirst(t *testing.T) {
+	seen := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		picker, all := newTestPicker(8)
+		picker.AddPeer(all)
+		// availability does not matter before RandomFirst pieces are done
+		picker.Have(0)
+		picker.Have(1)
+		seen[picker.Pick(all).Idx] = true
+	}
+	if len(seen) < 3 {
+		t.Errorf("random first picks %v", seen)
+	}
+
+	picker, all := newTestPicker(8)
+	picker.RandomFirst = 1
+	picker.AddPeer(all)
+	picker.Have(0)
+	picker.Have(1)
+	picker.Done(picker.Pick(all))
+	if piece := picker.Pick(all); piece.Idx < 2 {
+		t.Errorf("picked piece %d, the rarest pieces are picked after the first", piece.Idx)
+	}
+}
+
+func TestPiecePickerEndgame(t *testing.T) {
+	picker, all := newTestPicker(2)
+	picker.AddPeer(all)
+
+	first := picker.Pick(all)
+	if picker.Endgame() {
+		t.Fatal("endgame while a piece was not picked yet")
+	}
+	second := picker.Pick(all)
+	if !picker.Endgame() {
+		t.Fatal("no endgame when all pieces are downloaded")
+	}
+
+	// both pieces get a second peer before any piece gets a third one, the peers share the piece
+	shared := []*Piece{picker.Pick(all), picker.Pick(all)}
+	if shared[0] == nil || shared[1] == nil || shared[0].Idx == shared[1].Idx {
+		t.Fatalf("endgame pieces %v", shared)
+	}
+	for _, piece := range shared {
+		if piece != first && piece != second {
+			t.Fatal("endgame returned a copy of the piece")
+		}
+	}
+
+	// blocks and the done piece update the other peer
+	updated := picker.Updated()
+	picker.Received(first)
+	select {
+	case <-updated:
+	default:
+		t.Error("the peers were not updated about a block")
+	}
+	updated = picker.Updated()
+	if !picker.Done(first) {
+		t.Fatal("first piece was not accepted")
+	}
+	select {
+	case <-updated:
+	default:
+		t.Error("the peers were not updated about the done piece")
+	}
+	if picker.Active(first) || !picker.Active(second) {
+		t.Error("only the done piece is no longer active")
+	}
+	if picker.Done(first) {
+		t.Error("a done piece was accepted twice")
+	}
+
+	// the second piece is picked again once both peers failed
+	second.PutBlock(0, make([]byte, LEN_PIECE_BLOCK_STANDARD))
+	picker.Failed(second)
+	if !picker.Active(second) || !second.HasBlock(0) {
+		t.Error("the piece was given back while another peer downloads it")
+	}
+	picker.Failed(second)
+	if second.HasBlock(0) {
+		t.Error("the blocks of the given back piece were kept")
+	}
+	if piece := picker.Pick(all); piece != second {
+		t.Errorf("picked %v after the peers failed, want the second piece", piece)
+	}
+	if remaining := picker.Remaining(); remaining != 1 {
+		t.Errorf("%d pieces remaining", remaining)
+	}
+}
@@ -0,0 +1,193 @@
+package bittorrent
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Torrents without "piece layers", such as v2 torrents whose info came from ut_metadata, request the piece
+// hashes of their files from the peers (BEP 52). The hashes are verified against the pieces root of the file
+// with the uncle hashes of the answer.
+
+// MaxHashRequestLength is the largest number of hashes requested at once
+const MaxHashRequestLength = 512
+
+// receivedLayers holds the verified piece hashes that arrived in HASHES messages, keyed by pieces root.
+// It is shared by the copies of a TorrentFileInfo and safe for concurrent use.
+type receivedLayers struct {
+	mu     sync.Mutex
+	layers map[string]*receivedLayer
+}
+
+type receivedLayer struct {
+	hashes []byte
+	// known has a bit for every verified piece hash
+	known Bitfield
+}
+
+// pieceLayerHeight is the layer of the piece hashes in the merkle tree of a file, the 16 KiB blocks are layer 0
+func (info *TorrentFileInfo) pieceLayerHeight() int {
+	return log2(info.PieceLength / MerkleBlockSize)
+}
+
+// pieceLayerFile returns the file with the pieces root, only files larger than a piece have a piece layer
+func (info *TorrentFileInfo) pieceLayerFile(root [32]byte) (*TorrentFileEntry, bool) {
+	for i := range info.filesV2 {
+		file := &info.filesV2[i]
+		if file.Length > info.PieceLength && file.PiecesRoot == string(root[:]) {
+			return file, true
+		}
+	}
+	return nil, false
+}
+
+// filePieces returns the number of pieces of a v2 file
+func (info *TorrentFileInfo) filePieces(file *TorrentFileEntry) int {
+	return (file.Length + info.PieceLength - 1) / info.PieceLength
+}
+
+// pieceLayerHash returns the hash of the piece k of the file, from the torrent or received from a peer
+func (info *TorrentFileInfo) pieceLayerHash(file *TorrentFileEntry, k int) (hash [32]byte, ok bool) {
+	if layer, ok := info.PieceLayers[file.PiecesRoot]; ok {
+		copy(hash[:], layer[k*32:])
+		return hash, true
+	}
+	if info.received == nil {
+		return hash, false
+	}
+
+	info.received.mu.Lock()
+	defer info.received.mu.Unlock()
+	layer := info.received.layers[file.PiecesRoot]
+	if layer == nil || !layer.known.Has(k) {
+		return hash, false
+	}
+	copy(hash[:], layer.hashes[k*32:])
+	return hash, true
+}
+
+// PieceHashKnown reports whether the piece can be verified, the hashes of v2-only torrents may still be missing
+func (info *TorrentFileInfo) PieceHashKnown(idx int) bool {
+	if info.HasV1() {
+		return true
+	}
+	_, _, ok := info.PieceHashV2(idx)
+	return ok
+}
+
+// HashRequests returns the requests for the piece hashes that are not known yet. The hashes of a file are
+// requested in parts of up to MaxHashRequestLength, each with the proof up to the pieces root.
+func (info *TorrentFileInfo) HashRequests() []HashRequestMsg {
+	var requests []HashRequestMsg
+	for i := range info.filesV2 {
+		file := &info.filesV2[i]
+		if file.Length <= info.PieceLength {
+			continue
+		}
+		width := nextPowerOfTwo(info.filePieces(file))
+		length := min(width, MaxHashRequestLength)
+		for index := 0; index < info.filePieces(file); index += length {
+			// the hashes of a request arrive together
+			if _, ok := info.pieceLayerHash(file, index); ok {
+				continue
+			}
+			requests = append(requests, HashRequestMsg{
+				PiecesRoot:  [32]byte([]byte(file.PiecesRoot)),
+				BaseLayer:   info.pieceLayerHeight(),
+				Index:       index,
+				Length:      length,
+				ProofLayers: log2(width),
+			})
+		}
+	}
+	return requests
+}
+
+// checkHashRange checks that the hashes are a part of the piece layer of the file that starts at a multiple
+// of its length, it returns the width of the layer
+func (info *TorrentFileInfo) checkHashRange(file *TorrentFileEntry, baseLayer, index, length int) (int, error) {
+	width := nextPowerOfTwo(info.filePieces(file))
+	if baseLayer != info.pieceLayerHeight() || !isPowerOfTwo(length) || length > MaxHashRequestLength ||
+		index < 0 || index%length != 0 || index+length > width {
+		return 0, fmt.Errorf("hashes of %v: invalid range base layer=%d index=%d length=%d", file.Path, baseLayer, index, length)
+	}
+	return width, nil
+}
+
+// AddHashes verifies the piece hashes of a HASHES message against the pieces root of their file and keeps them
+func (info *TorrentFileInfo) AddHashes(msg HashesMsg) error {
+	file, ok := info.pieceLayerFile(msg.PiecesRoot)
+	if !ok || info.received == nil {
+		return fmt.Errorf("hashes: unknown pieces root %x", msg.PiecesRoot)
+	}
+	width, err := info.checkHashRange(file, msg.BaseLayer, msg.Index, msg.Length)
+	if err != nil {
+		return err
+	}
+	// the proof goes from the subtree of the hashes up to the pieces root
+	if uncles := log2(width / msg.Length); len(msg.Hashes) != msg.Length+uncles {
+		return fmt.Errorf("hashes of %v: expected %d hashes and %d uncle hashes, got %d", file.Path, msg.Length, uncles, len(msg.Hashes))
+	}
+	subtree := MerkleRoot(msg.Hashes[:msg.Length], msg.Length, [32]byte{})
+	if root := MerkleRootFromProof(subtree, msg.Index/msg.Length, msg.Hashes[msg.Length:]); string(root[:]) != file.PiecesRoot {
+		return fmt.Errorf("hashes of %v: proof does not match the pieces root", file.Path)
+	}
+
+	info.received.mu.Lock()
+	defer info.received.mu.Unlock()
+	pieces := info.filePieces(file)
+	layer := info.received.layers[file.PiecesRoot]
+	if layer == nil {
+		layer = &receivedLayer{hashes: make([]byte, 32*pieces), known: NewBitfield(pieces)}
+		info.received.layers[file.PiecesRoot] = layer
+	}
+	// the hashes beyond the last piece are padding
+	for k := msg.Index; k < min(msg.Index+msg.Length, pieces); k++ {
+		copy(layer.hashes[k*32:], msg.Hashes[k-msg.Index][:])
+		layer.known.Set(k)
+	}
+	return nil
+}
+
+// HashesFor answers a HASH_REQUEST for the piece hashes of a file whose piece layer is known completely.
+// Only the uncle hashes of the ProofLayers above the base layer are added.
+func (info *TorrentFileInfo) HashesFor(request HashRequestMsg) (HashesMsg, error) {
+	file, ok := info.pieceLayerFile(request.PiecesRoot)
+	if !ok {
+		return HashesMsg{}, fmt.Errorf("hash request: unknown pieces root %x", request.PiecesRoot)
+	}
+	width, err := info.checkHashRange(file, request.BaseLayer, request.Index, request.Length)
+	if err != nil {
+		return HashesMsg{}, err
+	}
+
+	layer := make([][32]byte, width)
+	pad := MerklePadHash(info.pieceLayerHeight())
+	for k := range layer {
+		if k >= info.filePieces(file) {
+			layer[k] = pad
+			continue
+		}
+		if layer[k], ok = info.pieceLayerHash(file, k); !ok {
+			return HashesMsg{}, fmt.Errorf("hash request: the piece layer of %v is not known", file.Path)
+		}
+	}
+
+	// the uncles of the layers within the requested hashes are left out
+	subtrees := make([][32]byte, width/request.Length)
+	for i := range subtrees {
+		subtrees[i] = MerkleRoot(layer[i*request.Length:(i+1)*request.Length], request.Length, [32]byte{})
+	}
+	uncles := MerkleProof(subtrees, request.Index/request.Length)
+	uncles = uncles[:max(0, min(len(uncles), request.ProofLayers-log2(request.Length)))]
+
+	hashes := append([][32]byte(nil), layer[request.Index:request.Index+request.Length]...)
+	return HashesMsg{
+		PiecesRoot:  request.PiecesRoot,
+		BaseLayer:   request.BaseLayer,
+		Index:       request.Index,
+		Length:      request.Length,
+		ProofLayers: request.ProofLayers,
+		Hashes:      append(hashes, uncles...),
+	}, nil
+}
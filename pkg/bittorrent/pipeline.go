@@ -0,0 +1,174 @@
+package bittorrent
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// DefaultMinOutstandingRequests are kept outstanding before the rate of the peer is known
+	DefaultMinOutstandingRequests = 4
+	// DefaultMaxOutstandingRequests caps the pipeline of a peer, most clients drop requests beyond 250
+	DefaultMaxOutstandingRequests = 128
+	// pipelineRateWindow is the time over which the download rate of the peer is measured
+	pipelineRateWindow = time.Second
+)
+
+type blockKey struct {
+	index, begin int
+}
+
+type blockRequest struct {
+	length int
+	sent   time.Time
+}
+
+// RequestPipeline keeps several block requests outstanding, so that the peer never waits for the next request.
+// The number of requests covers the blocks the peer can send within the round trip time at its measured rate,
+// plus MinOutstanding to absorb variations. The requests may span pieces when a piece has fewer blocks.
+//
+// Blocks may arrive in any order, they are placed at their offset. Blocks that were not requested are rejected.
+type RequestPipeline struct {
+	MinOutstanding int
+	MaxOutstanding int
+
+	outstanding map[blockKey]blockRequest
+
+	// minRTT is the shortest time between a request and its block, it excludes the time requests wait at the peer
+	minRTT time.Duration
+	// rate is the smoothed download rate in bytes per second
+	rate      float64
+	rateStart time.Time
+	rateBytes int
+}
+
+func NewRequestPipeline() *RequestPipeline {
+	return &RequestPipeline{
+		MinOutstanding: DefaultMinOutstandingRequests,
+		MaxOutstanding: DefaultMaxOutstandingRequests,
+		outstanding:    make(map[blockKey]blockRequest),
+	}
+}
+
+// Depth returns the number of requests that should be outstanding
+func (pipeline *RequestPipeline) Depth() int {
+	depth := pipeline.MinOutstanding
+	if pipeline.rate > 0 && pipeline.minRTT > 0 {
+		inFlight := pipeline.rate * pipeline.minRTT.Seconds() / LEN_PIECE_BLOCK_STANDARD
+		depth += int(math.Ceil(inFlight))
+	}
+	return max(1, min(depth, pipeline.MaxOutstanding))
+}
+
+// Outstanding returns the number of requests that were not answered yet
+func (pipeline *RequestPipeline) Outstanding() int {
+	return len(pipeline.outstanding)
+}
+
+// Free returns the number of requests that fit into the pipeline
+func (pipeline *RequestPipeline) Free() int {
+	return max(0, pipeline.Depth()-len(pipeline.outstanding))
+}
+
+// Unrequested returns the number of blocks of piece that are neither received nor requested
+func (pipeline *RequestPipeline) Unrequested(piece *Piece) int {
+	n := 0
+	for begin := 0; begin < piece.Len; begin += LEN_PIECE_BLOCK_STANDARD {
+		if _, ok := pipeline.outstanding[blockKey{piece.Idx, begin}]; !ok && !piece.HasBlock(begin) {
+			n++
+		}
+	}
+	return n
+}
+
+// Requests returns the requests for the blocks of piece that are neither received nor requested,
+// as many as fit into the pipeline
+func (pipeline *RequestPipeline) Requests(piece *Piece) []*Message {
+	var requests []*Message
+	now := time.Now()
+	for begin := 0; begin < piece.Len && len(pipeline.outstanding) < pipeline.Depth(); begin += LEN_PIECE_BLOCK_STANDARD {
+		key := blockKey{piece.Idx, begin}
+		if _, ok := pipeline.outstanding[key]; ok || piece.HasBlock(begin) {
+			continue
+		}
+
+		length := piece.BlockLen(begin)
+		pipeline.outstanding[key] = blockRequest{length: length, sent: now}
+		requests = append(requests, NewRequestMessage(piece.Idx, begin, length))
+	}
+	return requests
+}
+
+// Received places the block in the piece, blocks that were not requested with this length are rejected.
+// The request of a rejected block with the wrong length is forgotten, so that the block is requested again.
+func (pipeline *RequestPipeline) Received(piece *Piece, index, begin int, block []byte) error {
+	key := blockKey{index, begin}
+	request, ok := pipeline.outstanding[key]
+	if !ok {
+		return fmt.Errorf("block index=%d begin=%d was not requested", index, begin)
+	}
+	delete(pipeline.outstanding, key)
+	if len(block) != request.length {
+		return fmt.Errorf("block index=%d begin=%d has length %d, requested %d", index, begin, len(block), request.length)
+	}
+
+	now := time.Now()
+	if rtt := now.Sub(request.sent); pipeline.minRTT == 0 || rtt < pipeline.minRTT {
+		pipeline.minRTT = rtt
+	}
+	pipeline.updateRate(len(block), now)
+
+	return piece.PutBlock(begin, block)
+}
+
+// Cancel returns CANCEL messages for the outstanding requests of the piece and forgets them,
+// for example when another peer was faster with the piece
+func (pipeline *RequestPipeline) Cancel(index int) []*Message {
+	var cancels []*Message
+	for key, request := range pipeline.outstanding {
+		if key.index == index {
+			cancels = append(cancels, NewCancelMessage(key.index, key.begin, request.length))
+			delete(pipeline.outstanding, key)
+		}
+	}
+	return cancels
+}
+
+// CancelReceived returns CANCEL messages for the outstanding requests of blocks that the piece got
+// from another peer and forgets them
+func (pipeline *RequestPipeline) CancelReceived(piece *Piece) []*Message {
+	var cancels []*Message
+	for key, request := range pipeline.outstanding {
+		if key.index == piece.Idx && piece.HasBlock(key.begin) {
+			cancels = append(cancels, NewCancelMessage(key.index, key.begin, request.length))
+			delete(pipeline.outstanding, key)
+		}
+	}
+	return cancels
+}
+
+// Choked forgets the outstanding requests, the peer drops them when it chokes us
+func (pipeline *RequestPipeline) Choked() {
+	clear(pipeline.outstanding)
+}
+
+func (pipeline *RequestPipeline) updateRate(n int, now time.Time) {
+	if pipeline.rateStart.IsZero() {
+		pipeline.rateStart = now
+	}
+	pipeline.rateBytes += n
+
+	elapsed := now.Sub(pipeline.rateStart)
+	if elapsed < pipelineRateWindow {
+		return
+	}
+	current := float64(pipeline.rateBytes) / elapsed.Seconds()
+	if pipeline.rate == 0 {
+		pipeline.rate = current
+	} else {
+		pipeline.rate = 0.7*pipeline.rate + 0.3*current
+	}
+	pipeline.rateStart = now
+	pipeline.rateBytes = 0
+}
@@ -0,0 +1,189 @@
+package bittorrent
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+)
+
+func requestBegins(t *testing.T, requests []*Message) []int {
+	t.Helper()
+
+	var begins []int
+	for _, msg := range requests {
+		request, ok := decodeTestMessage(t, msg).(RequestMsg)
+		if !ok {
+			t.Fatalf("expected REQUEST, got %s", msg.Type())
+		}
+		begins = append(begins, request.Begin)
+	}
+	return begins
+}
+
+func TestRequestPipelineOutOfOrder(t *testing.T) {
+	data := make([]byte, 5*LEN_PIECE_BLOCK_STANDARD+100)
+	for i := range data {
+		data[i] = byte(i / LEN_PIECE_BLOCK_STANDARD)
+	}
+	piece := &Piece{Idx: 3, Len: len(data)}
+	block := func(begin int) []byte {
+		return data[begin:min(begin+LEN_PIECE_BLOCK_STANDARD, len(data))]
+	}
+
+	pipeline := NewRequestPipeline()
+	pipeline.MinOutstanding = 3
+	requests := pipeline.Requests(piece)
+	if got := requestBegins(t, requests); len(got) != 3 || got[2] != 2*LEN_PIECE_BLOCK_STANDARD {
+		t.Fatalf("first requests %v", got)
+	}
+	if more := pipeline.Requests(piece); len(more) != 0 {
+		t.Errorf("the pipeline is full, got %d more requests", len(more))
+	}
+
+	// the third block arrives first, it is placed at its offset
+	if err := pipeline.Received(piece, 3, 2*LEN_PIECE_BLOCK_STANDARD, block(2*LEN_PIECE_BLOCK_STANDARD)); err != nil {
+		t.Fatalf("requested block was rejected: %s", err)
+	}
+	if !piece.HasBlock(2*LEN_PIECE_BLOCK_STANDARD) || piece.HasBlock(0) {
+		t.Error("block bitmap does not match the received block")
+	}
+	if err := pipeline.Received(piece, 3, 4*LEN_PIECE_BLOCK_STANDARD, block(4*LEN_PIECE_BLOCK_STANDARD)); err == nil {
+		t.Error("block that was not requested was accepted")
+	}
+	if err := pipeline.Received(piece, 4, 0, block(0)); err == nil {
+		t.Error("block of another piece was accepted")
+	}
+	if err := pipeline.Received(piece, 3, 2*LEN_PIECE_BLOCK_STANDARD, block(2*LEN_PIECE_BLOCK_STANDARD)); err == nil {
+		t.Error("duplicate block was accepted")
+	}
+	if err := pipeline.Received(piece, 3, 0, block(0)[:100]); err == nil {
+		t.Error("block with another length than requested was accepted")
+	}
+
+	// two slots are free again, the block with the wrong length is requested again
+	if got := requestBegins(t, pipeline.Requests(piece)); len(got) != 2 || got[0] != 0 || got[1] != 3*LEN_PIECE_BLOCK_STANDARD {
+		t.Errorf("refill requests %v", got)
+	}
+
+	pipeline.Received(piece, 3, LEN_PIECE_BLOCK_STANDARD, block(LEN_PIECE_BLOCK_STANDARD))
+	pipeline.Received(piece, 3, 0, block(0))
+
+	// the remaining blocks arrive in reverse order
+	for !piece.Complete() {
+		requestBegins(t, pipeline.Requests(piece))
+		var begins []int
+		for key := range pipeline.outstanding {
+			begins = append(begins, key.begin)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(begins)))
+		for _, begin := range begins {
+			if err := pipeline.Received(piece, 3, begin, block(begin)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !bytes.Equal(piece.Data, data) {
+		t.Error("assembled piece differs")
+	}
+}
+
+func TestRequestPipelineChoked(t *testing.T) {
+	piece := &Piece{Idx: 0, Len: 4 * LEN_PIECE_BLOCK_STANDARD}
+	pipeline := NewRequestPipeline()
+	pipeline.MinOutstanding = 2
+
+	requestBegins(t, pipeline.Requests(piece))
+	pipeline.Choked()
+	if pipeline.Outstanding() != 0 {
+		t.Errorf("%d requests outstanding after choke", pipeline.Outstanding())
+	}
+	// the dropped requests are sent again
+	if got := requestBegins(t, pipeline.Requests(piece)); len(got) != 2 || got[0] != 0 {
+		t.Errorf("requests after choke %v", got)
+	}
+
+	// the requests of the first piece fill the pipeline
+	other := &Piece{Idx: 1, Len: LEN_PIECE_BLOCK_STANDARD}
+	if got := requestBegins(t, pipeline.Requests(other)); len(got) != 0 {
+		t.Errorf("requests of the next piece %v", got)
+	}
+}
+
+func TestRequestPipelineSpansPieces(t *testing.T) {
+	pieces := []*Piece{
+		{Idx: 0, Len: 2 * LEN_PIECE_BLOCK_STANDARD},
+		{Idx: 1, Len: 2 * LEN_PIECE_BLOCK_STANDARD},
+		{Idx: 2, Len: 2*LEN_PIECE_BLOCK_STANDARD + 10},
+	}
+	pipeline := NewRequestPipeline()
+	pipeline.MinOutstanding = 5
+
+	// the depth is larger than the blocks of a piece
+	var requests []*Message
+	for _, piece := range pieces {
+		requests = append(requests, pipeline.Requests(piece)...)
+	}
+	if len(requests) != 5 || pipeline.Free() != 0 || pipeline.Unrequested(pieces[2]) != 2 {
+		t.Fatalf("%d requests, %d free, %d unrequested", len(requests), pipeline.Free(), pipeline.Unrequested(pieces[2]))
+	}
+
+	// a block of the first piece makes room for the next block of the last piece
+	if err := pipeline.Received(pieces[0], 0, LEN_PIECE_BLOCK_STANDARD, make([]byte, LEN_PIECE_BLOCK_STANDARD)); err != nil {
+		t.Fatal(err)
+	}
+	if pipeline.Free() != 1 || pipeline.Unrequested(pieces[0]) != 0 {
+		t.Errorf("%d free, %d unrequested of the first piece", pipeline.Free(), pipeline.Unrequested(pieces[0]))
+	}
+	if got := requestBegins(t, pipeline.Requests(pieces[2])); len(got) != 1 || got[0] != LEN_PIECE_BLOCK_STANDARD {
+		t.Errorf("requests of the last piece %v", got)
+	}
+
+	// only the requests of one piece are canceled
+	if cancels := pipeline.Cancel(1); len(cancels) != 2 || pipeline.Outstanding() != 3 {
+		t.Errorf("%d cancels, %d outstanding", len(cancels), pipeline.Outstanding())
+	}
+}
+
+func TestRequestPipelineCancel(t *testing.T) {
+	piece := &Piece{Idx: 5, Len: 3 * LEN_PIECE_BLOCK_STANDARD}
+	pipeline := NewRequestPipeline()
+	requests := pipeline.Requests(piece)
+
+	cancels := pipeline.Cancel(5)
+	if len(cancels) != len(requests) || pipeline.Outstanding() != 0 {
+		t.Fatalf("%d cancels for %d requests, %d outstanding", len(cancels), len(requests), pipeline.Outstanding())
+	}
+	for _, msg := range cancels {
+		if cancel, ok := decodeTestMessage(t, msg).(CancelMsg); !ok || cancel.Index != 5 || cancel.Length != LEN_PIECE_BLOCK_STANDARD {
+			t.Errorf("unexpected cancel %s %x", msg.Type(), msg.Data)
+		}
+	}
+}
+
+func TestRequestPipelineDepth(t *testing.T) {
+	pipeline := NewRequestPipeline()
+	if depth := pipeline.Depth(); depth != DefaultMinOutstandingRequests {
+		t.Errorf("initial depth %d", depth)
+	}
+
+	// 1 MiB/s with 100ms round trips keeps 6.4 blocks in flight
+	pipeline.rate = 1 << 20
+	pipeline.minRTT = 100 * time.Millisecond
+	if depth := pipeline.Depth(); depth != DefaultMinOutstandingRequests+7 {
+		t.Errorf("depth %d, want %d", depth, DefaultMinOutstandingRequests+7)
+	}
+
+	pipeline.rate = 1 << 30
+	if depth := pipeline.Depth(); depth != DefaultMaxOutstandingRequests {
+		t.Errorf("depth %d, want the maximum %d", depth, DefaultMaxOutstandingRequests)
+	}
+
+	pipeline.rate = 0
+	pipeline.rateStart = time.Now().Add(-time.Second)
+	pipeline.rateBytes = 0
+	pipeline.updateRate(512*1024, time.Now())
+	if pipeline.rate < 400*1024 || pipeline.rate > 520*1024 {
+		t.Errorf("measured rate %.0f, want about 512 KiB/s", pipeline.rate)
+	}
+}
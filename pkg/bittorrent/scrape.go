@@ -0,0 +1,127 @@
+package bittorrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpScrapeMaxHashes keeps the scrape URL at a length that trackers accept
+const httpScrapeMaxHashes = 50
+
+// ScrapeResult is the swarm statistics of a torrent, Completed is the number of finished downloads
+type ScrapeResult struct {
+	InfoHash  [20]byte
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// Scrape asks the tracker for the statistics of the torrents. There is one result for every info hash in the
+// order of infoHashes, the statistics of torrents the tracker does not know are zero.
+func Scrape(ctx context.Context, trackerURL string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		scrapeURL, err := ScrapeURL(trackerURL)
+		if err != nil {
+			return nil, err
+		}
+		return scrapeHTTP(ctx, scrapeURL, infoHashes)
+	case "udp":
+		return DefaultUDPTrackerClient.Scrape(ctx, trackerURL, infoHashes)
+	default:
+		return nil, fmt.Errorf("tracker %q: unsupported scheme %q", trackerURL, u.Scheme)
+	}
+}
+
+// ScrapeURL derives the scrape URL of an HTTP tracker: the last path component has to start with "announce",
+// which is replaced by "scrape". Other trackers do not support scraping.
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+
+	// the escaped path is used so that an escaped "/" is not a path separator
+	path := u.EscapedPath()
+	i := strings.LastIndex(path, "/")
+	rest, found := strings.CutPrefix(path[i+1:], "announce")
+	if !found {
+		return "", fmt.Errorf("tracker %q: does not support scrape", announceURL)
+	}
+	u.RawPath = path[:i+1] + "scrape" + rest
+	if u.Path, err = url.PathUnescape(u.RawPath); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// scrapeResponseDict is the bencoded scrape response, files maps the raw info hashes to their statistics
+type scrapeResponseDict struct {
+	FailureReason *string                   `bencode:"failure reason"`
+	Files         map[string]scrapeFileDict `bencode:"files"`
+}
+
+type scrapeFileDict struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+func scrapeHTTP(ctx context.Context, scrapeURL string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += httpScrapeMaxHashes {
+		batch := infoHashes[start:min(start+httpScrapeMaxHashes, len(infoHashes))]
+
+		params := url.Values{}
+		for _, infoHash := range batch {
+			params.Add("info_hash", string(infoHash[:]))
+		}
+		separator := "?"
+		if strings.Contains(scrapeURL, "?") {
+			separator = "&"
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, scrapeURL+separator+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var dict scrapeResponseDict
+		if err := UnmarshalBencode(body, &dict); err != nil {
+			return nil, err
+		}
+		if dict.FailureReason != nil {
+			return nil, &TrackerError{FailureReason: *dict.FailureReason}
+		}
+
+		for _, infoHash := range batch {
+			// unknown torrents are missing in files, their statistics are zero as for UDP trackers
+			file := dict.Files[string(infoHash[:])]
+			results = append(results, ScrapeResult{
+				InfoHash:  infoHash,
+				Seeders:   file.Complete,
+				Completed: file.Downloaded,
+				Leechers:  file.Incomplete,
+			})
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,80 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4"},
+		{"http://example.com/x%2Fannounce", ""},
+	}
+
+	for _, v := range tests {
+		got, err := ScrapeURL(v.announce)
+		if v.scrape == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", v.announce, got)
+			}
+			continue
+		}
+		if err != nil || got != v.scrape {
+			t.Errorf("%s: got %q (%v) want %q", v.announce, got, err, v.scrape)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	hashes := [][20]byte{{1}, {2}, {3}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || len(r.URL.Query()["info_hash"]) != 3 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		response, _ := MarshalBencode(map[string]interface{}{
+			"files": map[string]interface{}{
+				string(hashes[0][:]): map[string]int{"complete": 5, "downloaded": 50, "incomplete": 10},
+				string(hashes[2][:]): map[string]int{"complete": 1, "downloaded": 2, "incomplete": 3},
+			},
+		})
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	results, err := Scrape(context.Background(), server.URL+"/announce", hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScrapeResult{
+		{InfoHash: hashes[0], Seeders: 5, Completed: 50, Leechers: 10},
+		// the tracker does not know hashes[1]
+		{InfoHash: hashes[1]},
+		{InfoHash: hashes[2], Seeders: 1, Completed: 2, Leechers: 3},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %+v want %+v", results, want)
+	}
+}
+
+func TestScrapeHTTPFailure(t *testing.T) {
+	server := newFakeHTTPTracker(t, "d14:failure reason7:privatee")
+
+	_, err := Scrape(context.Background(), server.URL+"/announce", [][20]byte{{1}})
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || trackerErr.FailureReason != "private" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
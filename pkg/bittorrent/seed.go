@@ -0,0 +1,215 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// MaxRequestLength is the largest block a peer may request, larger requests close the connection
+const MaxRequestLength = 128 * 1024
+
+// Seed uploads the verified pieces of a torrent to the peers that connect to the PeerListener.
+// It is safe for concurrent use.
+type Seed struct {
+	Torrent *TorrentFile
+	Storage io.ReaderAt
+	// Choker decides which connections may download, its Run has to be started for the rotation
+	Choker *Choker
+
+	mu   sync.Mutex
+	have Bitfield
+	// changed is closed and replaced whenever a piece is added to have
+	changed chan struct{}
+}
+
+// NewSeed returns a Seed whose Choker unchokes uploadSlots peers for their rate, usually DefaultUploadSlots
+func NewSeed(torrent *TorrentFile, storage io.ReaderAt, uploadSlots int) *Seed {
+	seed := &Seed{
+		Torrent: torrent,
+		Storage: storage,
+		Choker:  NewChoker(uploadSlots),
+		have:    NewBitfield(torrent.Info.PieceCount()),
+		changed: make(chan struct{}),
+	}
+	seed.Choker.Seeding = seed.Complete
+	return seed
+}
+
+// SetHave makes the piece available for upload, it must be verified and saved to Storage
+func (seed *Seed) SetHave(idx int) {
+	seed.mu.Lock()
+	defer seed.mu.Unlock()
+
+	if seed.have.Has(idx) {
+		return
+	}
+	seed.have.Set(idx)
+	close(seed.changed)
+	seed.changed = make(chan struct{})
+}
+
+func (seed *Seed) Have(idx int) bool {
+	seed.mu.Lock()
+	defer seed.mu.Unlock()
+	return seed.have.Has(idx)
+}
+
+// Complete reports whether all pieces are available
+func (seed *Seed) Complete() bool {
+	seed.mu.Lock()
+	defer seed.mu.Unlock()
+	return seed.have.Count() == seed.Torrent.Info.PieceCount()
+}
+
+// Bitfield returns a copy of the available pieces and a channel that is closed when more become available
+func (seed *Seed) Bitfield() (Bitfield, <-chan struct{}) {
+	seed.mu.Lock()
+	defer seed.mu.Unlock()
+	return append(Bitfield(nil), seed.have...), seed.changed
+}
+
+// VerifyStorage checks every piece of Storage and makes the valid ones available for upload.
+// Left of the torrent progress is reduced by the verified pieces, it returns their number.
+func (seed *Seed) VerifyStorage() int {
+	info := &seed.Torrent.Info
+	verified := 0
+	for idx := 0; idx < info.PieceCount(); idx++ {
+		if seed.Have(idx) {
+			continue
+		}
+
+		piece := info.NewPiece(idx)
+		piece.Data = make([]byte, piece.Len)
+		if _, err := seed.Storage.ReadAt(piece.Data, piece.Offset); err != nil {
+			continue
+		}
+		if err := piece.Verify(); err != nil {
+			continue
+		}
+
+		seed.SetHave(idx)
+		seed.Torrent.Progress.Left.Add(-int64(piece.Len))
+		verified++
+	}
+	return verified
+}
+
+// serve runs the upload side of a connection after the handshakes were exchanged: it sends the bitfield
+// and HAVE messages for new pieces, chokes and unchokes the peer as the choker decides and answers its requests
+// for blocks and piece hashes.
+func (seed *Seed) serve(conn net.Conn) error {
+	// the reader stops when the connection is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := NewPeerStateHandler()
+	// the handshake was read by the PeerListener
+	go NewMessageReader(conn).Run(ctx, handler.Incoming, handler.Errs)
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	chokerPeer := seed.Choker.Add(host)
+	defer seed.Choker.Remove(chokerPeer)
+
+	have, changed := seed.Bitfield()
+	if have.Count() > 0 {
+		if _, err := NewBitfieldMessage(have).WriteTo(conn); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-changed:
+			var current Bitfield
+			current, changed = seed.Bitfield()
+			for idx := 0; idx < seed.Torrent.Info.PieceCount(); idx++ {
+				if current.Has(idx) && !have.Has(idx) {
+					if _, err := NewHaveMessage(idx).WriteTo(conn); err != nil {
+						return err
+					}
+				}
+			}
+			have = current
+
+		case choke := <-chokerPeer.Choke():
+			if choke == handler.PeerState.am_choking {
+				continue
+			}
+			handler.PeerState.am_choking = choke
+			msg := NewUnchokeMessage()
+			if choke {
+				msg = NewChokeMessage()
+			}
+			if _, err := msg.WriteTo(conn); err != nil {
+				return err
+			}
+
+		case msg := <-handler.Incoming:
+			decoded, err := DecodeMessage(&msg)
+			if errors.Is(err, ErrUnknownMessage) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			switch m := decoded.(type) {
+			case InterestedMsg:
+				handler.PeerState.peer_interested = true
+				seed.Choker.SetInterested(chokerPeer, true)
+			case NotInterestedMsg:
+				handler.PeerState.peer_interested = false
+				seed.Choker.SetInterested(chokerPeer, false)
+			case RequestMsg:
+				if handler.PeerState.am_choking {
+					// requests that were sent before the choke arrived are dropped
+					continue
+				}
+				if err := seed.upload(conn, m, chokerPeer); err != nil {
+					return err
+				}
+			case HashRequestMsg:
+				var answer PeerMessage = HashRejectMsg(m)
+				if hashes, err := seed.Torrent.Info.HashesFor(m); err == nil {
+					answer = hashes
+				}
+				if _, err := answer.Encode().WriteTo(conn); err != nil {
+					return err
+				}
+			}
+
+		case err := <-handler.Errs:
+			if errors.Is(err, io.EOF) {
+				// the peer is done
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (seed *Seed) upload(conn net.Conn, request RequestMsg, chokerPeer *ChokerPeer) error {
+	index, begin, length := request.Index, request.Begin, request.Length
+	info := &seed.Torrent.Info
+	if index >= info.PieceCount() || !seed.Have(index) {
+		return fmt.Errorf("request: piece %d is not available", index)
+	}
+	if length <= 0 || length > MaxRequestLength || begin+length > info.PieceLen(index) {
+		return fmt.Errorf("request: invalid block begin=%d length=%d of piece %d", begin, length, index)
+	}
+
+	block := make([]byte, length)
+	if _, err := seed.Storage.ReadAt(block, int64(index)*int64(info.PieceLength)+int64(begin)); err != nil {
+		return fmt.Errorf("request: %s", err)
+	}
+	if _, err := NewPieceMessage(index, begin, block).WriteTo(conn); err != nil {
+		return err
+	}
+
+	seed.Torrent.Progress.Uploaded.Add(int64(length))
+	chokerPeer.Uploaded.Add(int64(length))
+	return nil
+}
@@ -0,0 +1,323 @@
+package bittorrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newSeedTestTorrent returns a single-file torrent of data with 32 KiB pieces, extra is added to the info dict
+// and may set another "piece length"
+func newSeedTestTorrent(t *testing.T, data []byte, extra map[string]interface{}) *TorrentFile {
+	t.Helper()
+
+	pieceLength := 32 * 1024
+	if length, ok := extra["piece length"].(int); ok {
+		pieceLength = length
+	}
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		hash := sha1.Sum(data[i:min(i+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	dict := map[string]interface{}{
+		"length":       len(data),
+		"name":         "data.bin",
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	}
+	for k, v := range extra {
+		dict[k] = v
+	}
+	info, err := MarshalBencode(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := NewTorrentFileFromInfo(info, "http://127.0.0.1:1/announce", 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+// newTestSeed writes data to a temporary file and serves it on a loopback PeerListener
+func newTestSeed(t *testing.T, data []byte) (*Seed, *PeerListener) {
+	t.Helper()
+	return newTestSeedOf(t, newSeedTestTorrent(t, data, nil), data)
+}
+
+// newTestSeedOf serves data as the single-file torrent
+func newTestSeedOf(t *testing.T, torrent *TorrentFile, data []byte) (*Seed, *PeerListener) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := OpenFileStorage(path, &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := NewSeed(torrent, storage, DefaultUploadSlots)
+	listener, err := NewPeerListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	if err := listener.Add(seed); err != nil {
+		t.Fatal(err)
+	}
+	return seed, listener
+}
+
+// dialTestSeed connects to the listener and exchanges the handshakes
+func dialTestSeed(t *testing.T, listener *PeerListener, infoHash [20]byte) (net.Conn, *PeerStateHandler) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler := NewPeerStateHandler()
+	go HandleIncomingMessages(ctx, conn, handler.Incoming, handler.Errs)
+	if _, err := NewHandshakeMessage([20]byte{9}, infoHash).WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveTestMessage(t, handler); msg.Type() != HANDSHAKE || msg.AsHandshake().InfoHash() != infoHash {
+		t.Fatalf("expected the handshake, got %s", msg.Type())
+	}
+	return conn, handler
+}
+
+func receiveTestMessage(t *testing.T, handler *PeerStateHandler) Message {
+	t.Helper()
+
+	select {
+	case msg := <-handler.Incoming:
+		return msg
+	case err := <-handler.Errs:
+		t.Fatalf("connection failed: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+func decodeTestMessage(t *testing.T, msg *Message) PeerMessage {
+	t.Helper()
+
+	decoded, err := DecodeMessage(msg)
+	if err != nil {
+		t.Fatalf("decoding %s: %s", msg.Type(), err)
+	}
+	return decoded
+}
+
+func TestSeedUploadToPeerWorker(t *testing.T) {
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	seed, listener := newTestSeed(t, data)
+
+	if n := seed.VerifyStorage(); n != 4 {
+		t.Fatalf("verified %d pieces, want 4", n)
+	}
+	if left := seed.Torrent.Progress.Left.Load(); left != 0 {
+		t.Errorf("left %d after verifying, want 0", left)
+	}
+
+	torrent := newSeedTestTorrent(t, data, nil)
+	torrent.Choker = NewChoker(DefaultUploadSlots)
+	output := filepath.Join(t.TempDir(), "out.bin")
+	storage, err := NewFileStorage(output, &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := torrent.Info.PieceCount()
+	pieces := make([]*Piece, count)
+	done := make(chan *Piece, count)
+	errs := make(chan error, count)
+	for i := range pieces {
+		pieces[i] = torrent.Info.NewPiece(i)
+		pieces[i].Storage = storage
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go PeerWorker(ctx, listener.Addr().String(), torrent, NewPiecePicker(count, pieces), done, errs)
+
+	for i := 0; i < count; i++ {
+		select {
+		case piece := <-done:
+			if !piece.Done {
+				t.Fatalf("piece %d failed", piece.Idx)
+			}
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("download timed out")
+		}
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+	if uploaded := seed.Torrent.Progress.Uploaded.Load(); uploaded != int64(len(data)) {
+		t.Errorf("uploaded %d, want %d", uploaded, len(data))
+	}
+
+	// the idle session is still registered with the choker
+	torrent.Choker.mu.Lock()
+	defer torrent.Choker.mu.Unlock()
+	if len(torrent.Choker.peers) != 1 || torrent.Choker.peers[0].host != "127.0.0.1" {
+		t.Fatalf("unexpected choker peers %v", torrent.Choker.peers)
+	}
+	if downloaded := torrent.Choker.peers[0].Downloaded.Load(); downloaded != int64(len(data)) {
+		t.Errorf("choker counted %d downloaded bytes, want %d", downloaded, len(data))
+	}
+}
+
+func TestSeedV2HashRequests(t *testing.T) {
+	data := make([]byte, 4*v2TestPieceLength+20000)
+	rand.New(rand.NewSource(2)).Read(data)
+	seedTorrent, err := NewTorrentFileFromBytes(v2TestSingleFile(t, data, true), 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, listener := newTestSeedOf(t, seedTorrent, data)
+	if n := seed.VerifyStorage(); n != 5 {
+		t.Fatalf("verified %d pieces, want 5", n)
+	}
+
+	// the info without piece layers, as received with ut_metadata
+	torrent, err := NewTorrentFileFromInfo(seedTorrent.RawInfo, "http://127.0.0.1:1/announce", 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), "out.bin")
+	storage, err := NewFileStorage(output, &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := torrent.Info.PieceCount()
+	pieces := make([]*Piece, count)
+	for i := range pieces {
+		pieces[i] = torrent.Info.NewPiece(i)
+		pieces[i].Storage = storage
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan *Piece, count)
+	errs := make(chan error, count)
+	go PeerWorker(ctx, listener.Addr().String(), torrent, NewPiecePicker(count, pieces), done, errs)
+
+	for i := 0; i < count; i++ {
+		select {
+		case piece := <-done:
+			if piece.V2 == nil {
+				t.Fatalf("piece %d was saved without its merkle root", piece.Idx)
+			}
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("download timed out")
+		}
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+}
+
+func TestSeedHaveAndInvalidRequest(t *testing.T) {
+	data := make([]byte, 70*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	seed, listener := newTestSeed(t, data)
+	infoHash, _ := seed.Torrent.InfoHash()
+
+	// nothing is verified yet, so no bitfield is sent
+	conn, handler := dialTestSeed(t, listener, infoHash)
+	seed.SetHave(1)
+	msg := receiveTestMessage(t, handler)
+	if msg.Type() != HAVE || msg.Data[8] != 1 {
+		t.Fatalf("expected HAVE 1, got %s %x", msg.Type(), msg.Data[:msg.Len])
+	}
+
+	NewInterestedMessage().WriteTo(conn)
+	if msg := receiveTestMessage(t, handler); msg.Type() != UNCHOKE {
+		t.Fatalf("expected UNCHOKE, got %s", msg.Type())
+	}
+
+	NewRequestMessage(1, 16*1024, 1024).WriteTo(conn)
+	msg = receiveTestMessage(t, handler)
+	if piece, ok := decodeTestMessage(t, &msg).(PieceMsg); !ok || !bytes.Equal(piece.Block, data[48*1024:49*1024]) {
+		t.Fatalf("expected the block, got %s", msg.Type())
+	}
+
+	// piece 0 is not available, the connection is closed
+	NewRequestMessage(0, 0, 1024).WriteTo(conn)
+	select {
+	case msg := <-handler.Incoming:
+		t.Fatalf("expected the connection to be closed, got %s", msg.Type())
+	case <-handler.Errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestPeerListenerInvalidHandshake(t *testing.T) {
+	seed, listener := newTestSeed(t, make([]byte, 1024))
+	infoHash, _ := seed.Torrent.InfoHash()
+	otherProtocol := NewHandshakeMessage([20]byte{9}, infoHash)
+	copy(otherProtocol.Data[OffsetHandshakePstr:], "BitTorrent protocoX")
+
+	for name, handshake := range map[string]*Message{
+		"unknown info hash": NewHandshakeMessage([20]byte{9}, [20]byte{1, 2, 3}),
+		"other protocol":    otherProtocol,
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		handshake.WriteTo(conn)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := conn.Read(make([]byte, LEN_HANDSHAKE)); err == nil {
+			t.Errorf("%s: expected the connection to be closed, read %d bytes", name, n)
+		}
+	}
+}
+
+func TestOpenFileStorageLength(t *testing.T) {
+	torrent := newSeedTestTorrent(t, make([]byte, 1024), nil)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if _, err := OpenFileStorage(path, &torrent.Info); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	os.WriteFile(path, make([]byte, 1000), 0644)
+	if _, err := OpenFileStorage(path, &torrent.Info); err == nil {
+		t.Error("expected an error for a short file")
+	}
+}
@@ -0,0 +1,444 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// KeepAliveInterval is the time without sending after which a keep-alive is sent,
+	// peers close connections that are silent for two minutes
+	KeepAliveInterval = 90 * time.Second
+	// SnubTimeout is the time the peer may take for a block while it has our requests,
+	// the connection is closed and the piece is given back then
+	SnubTimeout = 60 * time.Second
+)
+
+// SessionState is the state of the download side of a peer connection
+type SessionState int
+
+const (
+	// SessionHandshake waits for the handshake of the peer
+	SessionHandshake SessionState = iota
+	// SessionIdle has no piece, the peer has none of the pieces the picker can hand out
+	SessionIdle
+	// SessionChoked has a piece and is interested, the peer did not unchoke us yet
+	SessionChoked
+	// SessionDownloading has pieces and keeps their block requests pipelined
+	SessionDownloading
+)
+
+var SessionStateNames = map[SessionState]string{
+	SessionHandshake:   "handshake",
+	SessionIdle:        "idle",
+	SessionChoked:      "choked",
+	SessionDownloading: "downloading",
+}
+
+func (s SessionState) String() string {
+	return SessionStateNames[s]
+}
+
+// peerSession downloads pieces from one peer. Its run loop waits for messages of the peer, messages to send,
+// pieces of the picker, timers and cancellation, everything happens in that loop so no state is shared.
+type peerSession struct {
+	address string
+	torrent *TorrentFile
+	conn    net.Conn
+	handler *PeerStateHandler
+	picker  *PiecePicker
+	done    chan<- *Piece
+
+	state SessionState
+	// pieces are downloaded in their order, the next piece is picked when the pipeline has room for more
+	// requests than the blocks of the pieces that are left to request
+	pieces []*Piece
+	// updated is set while downloading, it is closed when another peer changed a piece we share in endgame mode
+	updated <-chan struct{}
+	// pickable is set when the picker had no piece for us, it is closed when the picker may have one
+	pickable <-chan struct{}
+
+	keepAlive *time.Timer
+	snub      *time.Timer
+
+	// the connected peers are exchanged with ut_pex
+	peer      TrackerPeer
+	pexSender *PexSender
+
+	// chokerPeer counts the received blocks for the choker of the seed, it is nil without one
+	chokerPeer *ChokerPeer
+}
+
+func (session *peerSession) run(ctx context.Context) error {
+	defer func() {
+		// the unfinished pieces are given back to the picker
+		for _, piece := range session.pieces {
+			session.picker.Failed(piece)
+		}
+	}()
+
+	// a bitfield received before the info of a magnet link was known is validated now
+	if err := session.handler.PeerState.SetPieceCount(session.torrent.Info.PieceCount()); err != nil {
+		return err
+	}
+	// the pieces of the peer count towards the availability of the swarm until it disconnects
+	session.handler.Picker = session.picker
+	session.picker.AddPeer(session.handler.PeerState.pieces)
+	defer func() {
+		session.picker.RemovePeer(session.handler.PeerState.pieces)
+	}()
+
+	peer, err := ParsePeerAddress(session.address)
+	if err != nil {
+		log.Printf("%s: no peer exchange: %s", session.address, err)
+	} else if swarm := session.torrent.pexSwarm(); swarm != nil {
+		session.peer = peer
+		swarm.Connected(PexPeer{TrackerPeer: peer, Flags: PexFlagReachable})
+		defer swarm.Disconnected(peer)
+	}
+	session.pexSender = NewPexSender()
+
+	if choker := session.torrent.Choker; choker != nil {
+		host, _, _ := net.SplitHostPort(session.address)
+		session.chokerPeer = choker.Add(host)
+		defer choker.Remove(session.chokerPeer)
+	}
+	pexTicker := time.NewTicker(PexInterval)
+	defer pexTicker.Stop()
+
+	session.keepAlive = time.NewTimer(KeepAliveInterval)
+	defer session.keepAlive.Stop()
+	session.snub = time.NewTimer(SnubTimeout)
+	defer session.snub.Stop()
+
+	// the handshake of the peer may have been received before, as for magnet links
+	if session.handler.PeerState.Done_handshake {
+		if err := session.requestHashes(); err != nil {
+			return err
+		}
+		if err := session.pick(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("%s: context was canceled", session.address)
+			return nil
+		case msg := <-session.handler.Outgoing:
+			if err := session.send(&msg); err != nil {
+				return err
+			}
+		case msg := <-session.handler.Incoming:
+			if err := session.receive(ctx, &msg); err != nil {
+				return err
+			}
+		case err := <-session.handler.Errs:
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("connection closed by the peer: %w", err)
+			}
+			return err
+		case <-session.pickable:
+			if err := session.pick(); err != nil {
+				return err
+			}
+		case <-session.updated:
+			if err := session.updatePieces(); err != nil {
+				return err
+			}
+		case <-session.keepAlive.C:
+			if err := session.send(NewKeepAliveMessage()); err != nil {
+				return err
+			}
+		case <-session.snub.C:
+			if session.handler.Pipeline.Outstanding() > 0 {
+				return fmt.Errorf("no block received for %s", SnubTimeout)
+			}
+		case <-pexTicker.C:
+			if err := session.sendPex(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (session *peerSession) send(msgs ...*Message) error {
+	for _, msg := range msgs {
+		if _, err := msg.WriteTo(session.conn); err != nil {
+			return fmt.Errorf("failed to send: %s", err)
+		}
+		resetTimer(session.keepAlive, KeepAliveInterval)
+		if msg.Type() == REQUEST {
+			// new requests are only sent when the pipeline has room, after a block or an unchoke
+			resetTimer(session.snub, SnubTimeout)
+		}
+	}
+	return nil
+}
+
+func (session *peerSession) receive(ctx context.Context, msg *Message) error {
+	handler := session.handler
+	t := msg.Type()
+	switch t {
+	case HANDSHAKE:
+		infoHash, err := session.torrent.InfoHash()
+		if err != nil {
+			return err
+		}
+		if err := msg.AsHandshake().Validate(infoHash); err != nil {
+			return err
+		}
+		if msg.AsHandshake().HasExtensions() {
+			handshake := NewExtensionHandshake()
+			if session.torrent.Info.IsPrivate() {
+				delete(handshake.M, PexExtensionName)
+			}
+			extended, err := NewExtendedMessage().AddDict(handshake)
+			if err != nil {
+				return err
+			}
+			if err := session.send(&extended.Message); err != nil {
+				return err
+			}
+		}
+		if err := session.requestHashes(); err != nil {
+			return err
+		}
+	case EXTENDED:
+		if err := handler.HandleExtendedMessage(msg.AsExtended(), session.torrent.pexSwarm()); err != nil {
+			log.Printf("%s: %s", session.address, err)
+		}
+	case PIECE:
+		resetTimer(session.snub, SnubTimeout)
+		if session.chokerPeer != nil && msg.Len > OffsetMsgPieceBlock {
+			session.chokerPeer.Downloaded.Add(int64(msg.Len - OffsetMsgPieceBlock))
+		}
+	case HASHES:
+		hashes, err := DecodeMessage(msg)
+		if err != nil {
+			return err
+		}
+		if err := session.torrent.Info.AddHashes(hashes.(HashesMsg)); err != nil {
+			return err
+		}
+		// the sessions that wait for the pieces of the hashes pick again
+		session.picker.Notify()
+	case HASH_REJECT:
+		log.Printf("%s: the peer rejected a hash request", session.address)
+	}
+
+	// the pipelined requests are sent right away
+	msgs, err := handler.HandleMessage(msg, session.pieces)
+	if err != nil {
+		return err
+	}
+	if err := session.send(msgs...); err != nil {
+		return err
+	}
+
+	finished, err := session.finishPieces(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !handler.PeerState.Done_handshake:
+	case finished:
+		return session.pick()
+	case t == HANDSHAKE || t == BITFIELD || t == HAVE || t == HASHES || (session.pickable == nil && (t == UNCHOKE || t == PIECE)):
+		// the peer may have a piece for us now, or the pipeline has room for the blocks of another piece
+		if session.needsPiece() {
+			return session.pick()
+		}
+	}
+	session.updateState()
+	return nil
+}
+
+// needsPiece reports whether the session has no piece, or the peer unchoked us and the pipeline has room for
+// more requests than the blocks of the pieces that are left to request
+func (session *peerSession) needsPiece() bool {
+	if len(session.pieces) == 0 {
+		return true
+	}
+	if session.handler.PeerState.peer_choking {
+		return false
+	}
+	unrequested := 0
+	for _, piece := range session.pieces {
+		unrequested += session.handler.Pipeline.Unrequested(piece)
+	}
+	return session.handler.Pipeline.Free() > unrequested
+}
+
+// pick assigns pieces until the pipeline is filled. When the picker has no piece for the peer,
+// the session waits for the picker to change, it is idle if it has no piece at all.
+func (session *peerSession) pick() error {
+	session.pickable = nil
+	// the pieces of the session are not picked again, not even as endgame copies
+	available := append(Bitfield(nil), session.handler.PeerState.pieces...)
+	for _, piece := range session.pieces {
+		available.Clear(piece.Idx)
+	}
+	// pieces are only downloaded once they can be verified, the hashes of v2-only torrents may still be missing
+	if info := &session.torrent.Info; !info.HasV1() {
+		for idx := 0; idx < info.PieceCount(); idx++ {
+			if !info.PieceHashKnown(idx) {
+				available.Clear(idx)
+			}
+		}
+	}
+	for session.needsPiece() {
+		pickable := session.picker.Changed()
+		piece := session.picker.Pick(available)
+		if piece == nil {
+			session.pickable = pickable
+			break
+		}
+		session.pieces = append(session.pieces, piece)
+		available.Clear(piece.Idx)
+		log.Printf("%s: starting downloading piece: idx=%d length=%d\n", session.address, piece.Idx, piece.Len)
+	}
+	// the channel is kept until it is closed, so that no update after the requests is missed
+	if len(session.pieces) == 0 {
+		session.updated = nil
+	} else if session.updated == nil {
+		session.updated = session.picker.Updated()
+	}
+
+	err := session.send(session.handler.Requests(session.pieces)...)
+	session.updateState()
+	return err
+}
+
+// finishPieces saves the complete pieces, it reports whether there were any. A piece that another peer
+// completed in endgame mode is saved by that peer, it is dropped once the picker has it done.
+func (session *peerSession) finishPieces(ctx context.Context) (bool, error) {
+	var finished bool
+	pieces := session.pieces[:0]
+	for i, piece := range session.pieces {
+		if !piece.finish() {
+			pieces = append(pieces, piece)
+			continue
+		}
+		if err := session.finishPiece(ctx, piece); err != nil {
+			// the failed piece and the ones after it are given back to the picker when the session ends
+			session.pieces = append(pieces, session.pieces[i:]...)
+			return false, err
+		}
+		finished = true
+	}
+	clear(session.pieces[len(pieces):])
+	session.pieces = pieces
+	return finished, nil
+}
+
+func (session *peerSession) finishPiece(ctx context.Context, piece *Piece) error {
+	if piece.V2 == nil {
+		// the hash of a v2 piece may have arrived after the piece was created
+		session.torrent.Info.setPieceV2(piece)
+	}
+	if err := piece.SaveToFile(); err != nil {
+		// the peers that share the piece download it again
+		piece.Reset()
+		return fmt.Errorf("save fail idx=%d: %s", piece.Idx, err)
+	}
+
+	if session.picker.Done(piece) {
+		session.torrent.Progress.Downloaded.Add(int64(piece.Len))
+		session.torrent.Progress.Left.Add(-int64(piece.Len))
+		piece.Done = true
+		select {
+		case session.done <- piece:
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+// updatePieces follows the pieces that are shared with other peers in endgame mode: the requests of blocks
+// that arrived from another peer are canceled, and the pieces another peer finished are dropped
+func (session *peerSession) updatePieces() error {
+	session.updated = session.picker.Updated()
+	pieces := session.pieces[:0]
+	for _, piece := range session.pieces {
+		var cancels []*Message
+		if session.picker.Active(piece) {
+			pieces = append(pieces, piece)
+			cancels = session.handler.Pipeline.CancelReceived(piece)
+		} else {
+			cancels = session.handler.Pipeline.Cancel(piece.Idx)
+		}
+		if err := session.send(cancels...); err != nil {
+			return err
+		}
+	}
+	clear(session.pieces[len(pieces):])
+	session.pieces = pieces
+	return session.pick()
+}
+
+// requestHashes asks the peer for the piece hashes that a v2-only torrent is missing, see HashRequests.
+// Torrents with SHA-1 hashes verify their pieces without them.
+func (session *peerSession) requestHashes() error {
+	info := &session.torrent.Info
+	if info.HasV1() {
+		return nil
+	}
+	for _, request := range info.HashRequests() {
+		if err := session.send(request.Encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (session *peerSession) sendPex() error {
+	peerPexId := session.handler.PeerState.Extensions[PexExtensionName]
+	swarm := session.torrent.pexSwarm()
+	if peerPexId == 0 || swarm == nil || session.peer.Ip == nil {
+		return nil
+	}
+	if msg := session.pexSender.Next(swarm.ConnectedPeers(session.peer)); msg != nil {
+		extended, err := NewPexExtendedMessage(peerPexId, msg)
+		if err != nil {
+			return err
+		}
+		return session.send(&extended.Message)
+	}
+	return nil
+}
+
+func (session *peerSession) updateState() {
+	state := SessionHandshake
+	switch {
+	case !session.handler.PeerState.Done_handshake:
+	case len(session.pieces) == 0:
+		state = SessionIdle
+	case session.handler.PeerState.peer_choking:
+		state = SessionChoked
+	default:
+		state = SessionDownloading
+	}
+
+	if state != session.state {
+		log.Printf("%s: %s -> %s", session.address, session.state, state)
+		session.state = state
+	}
+}
+
+// resetTimer restarts a timer whose channel is only received by the caller
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
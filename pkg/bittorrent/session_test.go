@@ -0,0 +1,469 @@
+package bittorrent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkGoroutines returns a function that fails the test while goroutines started in between are still running
+func checkGoroutines(t *testing.T) func() {
+	t.Helper()
+	before := runtime.NumGoroutine()
+
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				n := runtime.Stack(buf, true)
+				t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:n])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestPeerSessionPicksReturnedPiece(t *testing.T) {
+	torrent := newSeedTestTorrent(t, make([]byte, 64*1024), nil)
+	pieces := []*Piece{torrent.Info.NewPiece(0), torrent.Info.NewPiece(1)}
+	picker := NewPiecePicker(2, pieces)
+
+	// another peer downloads piece 0, our peer has piece 0 only
+	other := NewBitfield(2)
+	other.Set(0)
+	taken := picker.Pick(other)
+
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	defer peerConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer := NewPeerStateHandler()
+	go NewMessageReader(peerConn).Run(ctx, peer.Incoming, peer.Errs)
+
+	handler := NewPeerStateHandler()
+	go HandleIncomingMessages(ctx, conn, handler.Incoming, handler.Errs)
+	done := make(chan *Piece, 2)
+	errs := make(chan error, 1)
+	go PeerWorkerInitialized(ctx, "pipe", torrent, conn, handler, picker, done, errs)
+
+	infoHash, _ := torrent.InfoHash()
+	NewHandshakeMessage([20]byte{7}, infoHash).WriteTo(peerConn)
+	NewBitfieldMessage(other).WriteTo(peerConn)
+	NewUnchokeMessage().WriteTo(peerConn)
+
+	// the session is idle until the piece is given back
+	select {
+	case msg := <-peer.Incoming:
+		t.Fatalf("expected no message while idle, got %s", msg.Type())
+	case <-time.After(200 * time.Millisecond):
+	}
+	picker.Failed(taken)
+	if msg := receiveTestMessage(t, peer); msg.Type() != INTERESTED {
+		t.Fatalf("expected INTERESTED, got %s", msg.Type())
+	}
+	msg := receiveTestMessage(t, peer)
+	if request, ok := decodeTestMessage(t, &msg).(RequestMsg); !ok || request.Index != 0 {
+		t.Fatalf("expected a REQUEST of piece 0, got %s", msg.Type())
+	}
+
+	// the connection is closed, the piece is given back
+	peerConn.Close()
+	select {
+	case <-errs:
+	case <-ctx.Done():
+	}
+	if piece := picker.Pick(other); piece == nil || piece.Idx != 0 {
+		t.Errorf("piece 0 was not given back: %v", piece)
+	}
+}
+
+func TestPeerSessionWrongInfoHash(t *testing.T) {
+	torrent := newSeedTestTorrent(t, make([]byte, 64*1024), nil)
+	picker := NewPiecePicker(2, []*Piece{torrent.Info.NewPiece(0), torrent.Info.NewPiece(1)})
+
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	defer peerConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go io.Copy(io.Discard, peerConn)
+
+	handler := NewPeerStateHandler()
+	go HandleIncomingMessages(ctx, conn, handler.Incoming, handler.Errs)
+	errs := make(chan error, 1)
+	go PeerWorkerInitialized(ctx, "pipe", torrent, conn, handler, picker, make(chan *Piece, 2), errs)
+
+	// the peer serves another torrent
+	NewHandshakeMessage([20]byte{7}, [20]byte{1, 2, 3}).WriteTo(peerConn)
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "info hash") {
+			t.Errorf("unexpected error %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session accepted the handshake")
+	}
+}
+
+func TestPeerSessionFinishPiecesFailure(t *testing.T) {
+	data := make([]byte, 96*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	torrent := newSeedTestTorrent(t, data, nil)
+	pieces := []*Piece{torrent.Info.NewPiece(0), torrent.Info.NewPiece(1), torrent.Info.NewPiece(2)}
+	picker := NewPiecePicker(3, pieces)
+	all := NewBitfield(3)
+	for _, piece := range pieces {
+		all.Set(piece.Idx)
+	}
+	for range pieces {
+		all.Clear(picker.Pick(all).Idx)
+	}
+
+	// piece 0 is incomplete, piece 1 is saved and piece 2 fails its hash check
+	dir := t.TempDir()
+	for _, piece := range pieces[1:] {
+		piece.Path = filepath.Join(dir, "piece"+string(rune('0'+piece.Idx)))
+		block := data[piece.Offset : piece.Offset+int64(piece.Len)]
+		if piece.Idx == 2 {
+			block = make([]byte, piece.Len)
+		}
+		for begin := 0; begin < piece.Len; begin += LEN_PIECE_BLOCK_STANDARD {
+			if err := piece.PutBlock(begin, block[begin:begin+piece.BlockLen(begin)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	session := &peerSession{torrent: torrent, picker: picker, done: make(chan *Piece, 3), pieces: append([]*Piece(nil), pieces...)}
+	if _, err := session.finishPieces(context.Background()); err == nil {
+		t.Fatal("expected the corrupted piece to fail")
+	}
+	// the saved piece is not given back when the session ends
+	if len(session.pieces) != 2 || session.pieces[0] != pieces[0] || session.pieces[1] != pieces[2] {
+		t.Fatalf("unexpected pieces after the failure %v", session.pieces)
+	}
+	if !pieces[1].Done || picker.Remaining() != 2 {
+		t.Errorf("piece 1 done %t, %d pieces remaining", pieces[1].Done, picker.Remaining())
+	}
+}
+
+func TestPeerSessionPipelineSpansPieces(t *testing.T) {
+	data := make([]byte, 4*LEN_PIECE_BLOCK_STANDARD)
+	rand.New(rand.NewSource(5)).Read(data)
+	torrent := newSeedTestTorrent(t, data, map[string]interface{}{"piece length": LEN_PIECE_BLOCK_STANDARD})
+	storage, err := NewFileStorage(filepath.Join(t.TempDir(), "out.bin"), &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces := make([]*Piece, torrent.Info.PieceCount())
+	for i := range pieces {
+		pieces[i] = torrent.Info.NewPiece(i)
+		pieces[i].Storage = storage
+	}
+	picker := NewPiecePicker(len(pieces), pieces)
+
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	defer peerConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer := NewPeerStateHandler()
+	go NewMessageReader(peerConn).Run(ctx, peer.Incoming, peer.Errs)
+
+	// pieces have a single block, the pipeline keeps three of them requested
+	handler := NewPeerStateHandler()
+	handler.Pipeline.MinOutstanding = 3
+	go HandleIncomingMessages(ctx, conn, handler.Incoming, handler.Errs)
+	done := make(chan *Piece, len(pieces))
+	go PeerWorkerInitialized(ctx, "pipe", torrent, conn, handler, picker, done, make(chan error, 1))
+
+	infoHash, _ := torrent.InfoHash()
+	NewHandshakeMessage([20]byte{7}, infoHash).WriteTo(peerConn)
+	all := NewBitfield(len(pieces))
+	for i := range pieces {
+		all.Set(i)
+	}
+	NewBitfieldMessage(all).WriteTo(peerConn)
+	if msg := receiveTestMessage(t, peer); msg.Type() != INTERESTED {
+		t.Fatalf("expected INTERESTED, got %s", msg.Type())
+	}
+	NewUnchokeMessage().WriteTo(peerConn)
+
+	receiveRequest := func() RequestMsg {
+		t.Helper()
+		msg := receiveTestMessage(t, peer)
+		decoded, err := DecodeMessage(&msg)
+		request, ok := decoded.(RequestMsg)
+		if err != nil || !ok {
+			t.Fatalf("expected a REQUEST, got %s %v", msg.Type(), err)
+		}
+		return request
+	}
+	requested := make(map[int]bool)
+	var first RequestMsg
+	for i := 0; i < 3; i++ {
+		request := receiveRequest()
+		if i == 0 {
+			first = request
+		}
+		requested[request.Index] = true
+	}
+	if len(requested) != 3 {
+		t.Fatalf("requested pieces %v, want 3 different pieces", requested)
+	}
+
+	// the block of the first piece finishes it, the last piece is requested
+	begin := first.Index * LEN_PIECE_BLOCK_STANDARD
+	PieceMsg{Index: first.Index, Block: data[begin : begin+LEN_PIECE_BLOCK_STANDARD]}.Encode().WriteTo(peerConn)
+	if last := receiveRequest(); requested[last.Index] {
+		t.Errorf("piece %d was requested twice", last.Index)
+	}
+	select {
+	case piece := <-done:
+		if piece.Idx != first.Index {
+			t.Errorf("piece %d done, want %d", piece.Idx, first.Index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the first piece was not done")
+	}
+}
+
+func TestPeerSessionEndgameCancelsBlocks(t *testing.T) {
+	data := make([]byte, 2*LEN_PIECE_BLOCK_STANDARD)
+	rand.New(rand.NewSource(6)).Read(data)
+	torrent := newSeedTestTorrent(t, data, map[string]interface{}{"piece length": len(data)})
+	output := filepath.Join(t.TempDir(), "out.bin")
+	storage, err := NewFileStorage(output, &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	piece := torrent.Info.NewPiece(0)
+	piece.Storage = storage
+	picker := NewPiecePicker(1, []*Piece{piece})
+	infoHash, _ := torrent.InfoHash()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan *Piece, 2)
+	// startSession connects a session to a peer that has the piece, it returns the peer once it got the requests
+	startSession := func() (net.Conn, *PeerStateHandler) {
+		t.Helper()
+		conn, peerConn := net.Pipe()
+		t.Cleanup(func() { conn.Close(); peerConn.Close() })
+		peer := NewPeerStateHandler()
+		go NewMessageReader(peerConn).Run(ctx, peer.Incoming, peer.Errs)
+		handler := NewPeerStateHandler()
+		go HandleIncomingMessages(ctx, conn, handler.Incoming, handler.Errs)
+		go PeerWorkerInitialized(ctx, "pipe", torrent, conn, handler, picker, done, make(chan error, 1))
+
+		NewHandshakeMessage([20]byte{7}, infoHash).WriteTo(peerConn)
+		NewBitfieldMessage(Bitfield{0x80}).WriteTo(peerConn)
+		NewUnchokeMessage().WriteTo(peerConn)
+		for _, want := range []MessageType{INTERESTED, REQUEST, REQUEST} {
+			if msg := receiveTestMessage(t, peer); msg.Type() != want {
+				t.Fatalf("expected %s, got %s", want, msg.Type())
+			}
+		}
+		return peerConn, peer
+	}
+	receiveCancel := func(peer *PeerStateHandler) CancelMsg {
+		t.Helper()
+		msg := receiveTestMessage(t, peer)
+		decoded, err := DecodeMessage(&msg)
+		cancel, ok := decoded.(CancelMsg)
+		if err != nil || !ok {
+			t.Fatalf("expected a CANCEL, got %s %v", msg.Type(), err)
+		}
+		return cancel
+	}
+
+	// both peers get the requests of both blocks, the second one in endgame mode
+	firstConn, first := startSession()
+	secondConn, second := startSession()
+	if !picker.Endgame() {
+		t.Fatal("no endgame")
+	}
+
+	// the block from the first peer cancels its request at the second peer
+	PieceMsg{Index: 0, Begin: 0, Block: data[:LEN_PIECE_BLOCK_STANDARD]}.Encode().WriteTo(firstConn)
+	if got := receiveCancel(second); got != (CancelMsg{Index: 0, Begin: 0, Length: LEN_PIECE_BLOCK_STANDARD}) {
+		t.Errorf("second peer got %+v", got)
+	}
+
+	// the second peer completes the piece, the first peer's request is canceled
+	PieceMsg{Index: 0, Begin: LEN_PIECE_BLOCK_STANDARD, Block: data[LEN_PIECE_BLOCK_STANDARD:]}.Encode().WriteTo(secondConn)
+	if got := receiveCancel(first); got != (CancelMsg{Index: 0, Begin: LEN_PIECE_BLOCK_STANDARD, Length: LEN_PIECE_BLOCK_STANDARD}) {
+		t.Errorf("first peer got %+v", got)
+	}
+	select {
+	case piece := <-done:
+		if !piece.Done {
+			t.Error("the piece failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the piece was not done")
+	}
+	select {
+	case <-done:
+		t.Error("the piece was done twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	got, err := os.ReadFile(output)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("saved data differs, %v", err)
+	}
+}
+
+func TestPeerSessionPrivateNoPex(t *testing.T) {
+	torrent := newSeedTestTorrent(t, make([]byte, 64*1024), map[string]interface{}{"private": 1})
+	swarm := NewSwarm()
+	torrent.Swarm = swarm
+	picker := NewPiecePicker(1, []*Piece{torrent.Info.NewPiece(0)})
+
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	defer peerConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer := NewPeerStateHandler()
+	go NewMessageReader(peerConn).Run(ctx, peer.Incoming, peer.Errs)
+
+	handler := NewPeerStateHandler()
+	go HandleIncomingMessages(ctx, conn, handler.Incoming, handler.Errs)
+	go PeerWorkerInitialized(ctx, "pipe", torrent, conn, handler, picker, make(chan *Piece, 1), make(chan error, 1))
+
+	infoHash, _ := torrent.InfoHash()
+	handshake := NewHandshakeMessage([20]byte{7}, infoHash)
+	handshake.AsHandshake().SetExtensions()
+	handshake.WriteTo(peerConn)
+
+	// ut_pex is not advertised for a private torrent
+	msg := receiveTestMessage(t, peer)
+	if msg.Type() != EXTENDED {
+		t.Fatalf("expected the extension handshake, got %s", msg.Type())
+	}
+	var ours ExtensionHandshake
+	if _, err := msg.AsExtended().UnmarshalDict(&ours); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ours.M[PexExtensionName]; ok || ours.M[MetadataExtensionName] != MetadataExtensionId {
+		t.Errorf("unexpected extensions %v", ours.M)
+	}
+
+	// the peers of a pex message are ignored
+	theirs := addTestDict(t, NewExtendedMessage(), ExtensionHandshake{M: map[string]int{PexExtensionName: 5}})
+	theirs.WriteTo(peerConn)
+	pex, err := NewPexExtendedMessage(PexExtensionId, NewPexMessage([]PexPeer{pexTestPeer("10.0.0.1", 1, 0)}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pex.WriteTo(peerConn)
+	have := NewBitfield(1)
+	have.Set(0)
+	NewBitfieldMessage(have).WriteTo(peerConn)
+	if msg := receiveTestMessage(t, peer); msg.Type() != INTERESTED {
+		t.Fatalf("expected INTERESTED, got %s", msg.Type())
+	}
+	if len(swarm.Peers) != 0 {
+		t.Errorf("%d peers from pex were added to the swarm of a private torrent", len(swarm.Peers))
+	}
+}
+
+func TestHandleIncomingMessagesEOF(t *testing.T) {
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	in := make(chan Message, 1)
+	errs := make(chan error, 1)
+	go HandleIncomingMessages(context.Background(), conn, in, errs)
+
+	NewHandshakeMessage([20]byte{1}, [20]byte{2}).WriteTo(peerConn)
+	NewInterestedMessage().WriteTo(peerConn)
+	peerConn.Close()
+	for _, want := range []MessageType{HANDSHAKE, INTERESTED} {
+		if msg := <-in; msg.Type() != want {
+			t.Errorf("expected %s, got %s", want, msg.Type())
+		}
+	}
+	if err := <-errs; err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestHandleIncomingMessagesCanceled(t *testing.T) {
+	check := checkGoroutines(t)
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	defer peerConn.Close()
+
+	// one reader waits for data, the other one for a receiver of its message
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go HandleIncomingMessages(ctx, conn, make(chan Message), errs)
+	blocked, blockedPeer := net.Pipe()
+	defer blocked.Close()
+	defer blockedPeer.Close()
+	go HandleIncomingMessages(ctx, blocked, make(chan Message), errs)
+	NewHandshakeMessage([20]byte{1}, [20]byte{2}).WriteTo(blockedPeer)
+
+	cancel()
+	check()
+	select {
+	case err := <-errs:
+		t.Errorf("error after cancel: %s", err)
+	default:
+	}
+}
+
+func TestPeerSessionsTearDown(t *testing.T) {
+	check := checkGoroutines(t)
+
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(4)).Read(data)
+	seed, listener := newTestSeed(t, data)
+	seed.VerifyStorage()
+
+	torrent := newSeedTestTorrent(t, data, nil)
+	storage, err := NewFileStorage(filepath.Join(t.TempDir(), "out.bin"), &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := torrent.Info.PieceCount()
+	pieces := make([]*Piece, count)
+	for i := range pieces {
+		pieces[i] = torrent.Info.NewPiece(i)
+		pieces[i].Storage = storage
+	}
+	picker := NewPiecePicker(count, pieces)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *Piece, count)
+	errs := make(chan error, count)
+	for i := 0; i < 3; i++ {
+		go PeerWorker(ctx, listener.Addr().String(), torrent, picker, done, errs)
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-done:
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("download timed out")
+		}
+	}
+
+	// the workers, their readers and the upload sessions of the seed stop
+	cancel()
+	listener.Close()
+	check()
+}
@@ -0,0 +1,182 @@
+package bittorrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileStorage maps the continuous byte range of the torrent content onto the files on disk.
+// Pieces can span multiple files, WriteAt and ReadAt split the data at the file boundaries.
+type FileStorage struct {
+	Files []StorageFile
+}
+
+type StorageFile struct {
+	Path   string
+	Offset int64
+	Length int64
+	// Pad files are not created, writes to them are dropped and reads return zeros
+	Pad bool
+}
+
+// NewFileStorage creates the files (and directories) of the torrent content.
+// For a single-file torrent root is the output file, for a multi-file torrent it is the output directory.
+func NewFileStorage(root string, info *TorrentFileInfo) (*FileStorage, error) {
+	storage, err := newFileStorage(root, info)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range storage.Files {
+		if file.Pad {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(file.Path, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Truncate(file.Length)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+// OpenFileStorage uses the existing files of the torrent content without changing them, for example to seed them.
+// Every file must exist with the length of the torrent.
+func OpenFileStorage(root string, info *TorrentFileInfo) (*FileStorage, error) {
+	storage, err := newFileStorage(root, info)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range storage.Files {
+		if file.Pad {
+			continue
+		}
+		stat, err := os.Stat(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if stat.Size() != file.Length {
+			return nil, fmt.Errorf("storage: %s has length %d, expected %d", file.Path, stat.Size(), file.Length)
+		}
+	}
+
+	return storage, nil
+}
+
+// newFileStorage maps the files of info below root
+func newFileStorage(root string, info *TorrentFileInfo) (*FileStorage, error) {
+	storage := &FileStorage{}
+
+	if !info.IsMultiFile() {
+		storage.Files = append(storage.Files, StorageFile{Path: root, Length: int64(info.Length)})
+	} else {
+		offset := int64(0)
+		for i, file := range info.Files {
+			for _, component := range file.Path {
+				if !isValidPathComponent(component) {
+					return nil, fmt.Errorf("info.files[%d].path: invalid component %q", i, component)
+				}
+			}
+			storage.Files = append(storage.Files, StorageFile{
+				Path:   filepath.Join(append([]string{root}, file.Path...)...),
+				Offset: offset,
+				Length: int64(file.Length),
+				Pad:    file.IsPad(),
+			})
+			offset += int64(file.Length)
+		}
+	}
+
+	return storage, nil
+}
+
+// path components come from the torrent file, they must not escape the root directory
+func isValidPathComponent(component string) bool {
+	if component == "" || component == "." || component == ".." {
+		return false
+	}
+	return !strings.ContainsAny(component, "/\\\x00")
+}
+
+func (storage *FileStorage) Length() int64 {
+	if len(storage.Files) == 0 {
+		return 0
+	}
+	last := storage.Files[len(storage.Files)-1]
+	return last.Offset + last.Length
+}
+
+func (storage *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return storage.forEachFile(p, off, func(f *os.File, b []byte, fileOff int64) (int, error) {
+		return f.WriteAt(b, fileOff)
+	}, os.O_WRONLY)
+}
+
+func (storage *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return storage.forEachFile(p, off, func(f *os.File, b []byte, fileOff int64) (int, error) {
+		return f.ReadAt(b, fileOff)
+	}, os.O_RDONLY)
+}
+
+func (storage *FileStorage) forEachFile(p []byte, off int64, op func(*os.File, []byte, int64) (int, error), flag int) (int, error) {
+	if off < 0 || off+int64(len(p)) > storage.Length() {
+		return 0, fmt.Errorf("storage: range [%d, %d) out of bounds, length=%d", off, off+int64(len(p)), storage.Length())
+	}
+
+	total := 0
+	for _, file := range storage.Files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= file.Offset+file.Length || file.Length == 0 {
+			continue
+		}
+
+		fileOff := off - file.Offset
+		chunk := p
+		if remaining := file.Length - fileOff; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		if file.Pad {
+			if flag == os.O_RDONLY {
+				clear(chunk)
+			}
+			total += len(chunk)
+			p = p[len(chunk):]
+			off += int64(len(chunk))
+			continue
+		}
+
+		f, err := os.OpenFile(file.Path, flag, 0)
+		if err != nil {
+			return total, err
+		}
+		n, err := op(f, chunk, fileOff)
+		f.Close()
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+	}
+
+	if len(p) != 0 {
+		return total, io.ErrUnexpectedEOF
+	}
+	return total, nil
+}
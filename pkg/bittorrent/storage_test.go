@@ -0,0 +1,115 @@
+package bittorrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewTorrentFileInfoMultiFile(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": 4,
+		"pieces":       strings.Repeat("x", 3*20),
+		"files": []interface{}{
+			map[string]interface{}{"length": 3, "path": []interface{}{"a.txt"}},
+			map[string]interface{}{"length": 6, "path": []interface{}{"sub", "b.txt"}, "md5sum": "abc"},
+		},
+	}
+
+	data, err := MarshalBencode(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := NewTorrentFileInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileInfo.IsMultiFile() || len(fileInfo.Files) != 2 {
+		t.Fatalf("expected 2 files, got %v", fileInfo.Files)
+	}
+	if fileInfo.Length != 9 {
+		t.Errorf("got length %d want %d", fileInfo.Length, 9)
+	}
+	// the computed length is not written back, the info dict is unchanged
+	if encoded, err := MarshalBencode(fileInfo); err != nil || string(encoded) != string(data) {
+		t.Errorf("marshaled info %q differs from %q: %v", encoded, data, err)
+	}
+	if fileInfo.Files[1].Md5sum != "abc" {
+		t.Errorf("got md5sum %q want %q", fileInfo.Files[1].Md5sum, "abc")
+	}
+	if got := fileInfo.PieceLen(2); got != 1 {
+		t.Errorf("got last piece length %d want %d", got, 1)
+	}
+
+	info["pieces"] = strings.Repeat("x", 2*20)
+	data, _ = MarshalBencode(info)
+	if _, err := NewTorrentFileInfo(data); err == nil {
+		t.Errorf("expected error for wrong piece count")
+	}
+}
+
+func TestFileStorageSpanningPiece(t *testing.T) {
+	root := t.TempDir()
+	info := &TorrentFileInfo{
+		Name:        "dir",
+		PieceLength: 4,
+		Length:      9,
+		Files: []TorrentFileEntry{
+			{Length: 3, Path: []string{"a.txt"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 6, Path: []string{"sub", "b.txt"}},
+		},
+	}
+
+	storage, err := NewFileStorage(root, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pieces are written out of order, piece 0 spans a.txt, empty and sub/b.txt
+	for _, p := range []struct {
+		off  int64
+		data string
+	}{{8, "9"}, {0, "1234"}, {4, "5678"}} {
+		if _, err := storage.WriteAt([]byte(p.data), p.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, want := range map[string]string{"a.txt": "123", "empty": "", "sub/b.txt": "456789"} {
+		got, err := os.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q want %q", path, got, want)
+		}
+	}
+
+	buf := make([]byte, 5)
+	if _, err := storage.ReadAt(buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte("23456")) {
+		t.Errorf("got %q want %q", buf, "23456")
+	}
+
+	if _, err := storage.WriteAt([]byte("xx"), 8); err == nil {
+		t.Errorf("expected out of bounds error")
+	}
+}
+
+func TestFileStorageRejectsPathTraversal(t *testing.T) {
+	info := &TorrentFileInfo{
+		PieceLength: 4,
+		Length:      1,
+		Files:       []TorrentFileEntry{{Length: 1, Path: []string{"..", "evil"}}},
+	}
+
+	if _, err := NewFileStorage(t.TempDir(), info); err == nil {
+		t.Errorf("expected error for path traversal")
+	}
+}
@@ -0,0 +1,111 @@
+package bittorrent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// SwarmPeersBuffer is the number of discovered peers that can wait for the download to connect to them
+const SwarmPeersBuffer = 256
+
+// Swarm collects the peers of a torrent from all peer sources, every address is only reported once.
+// It is safe for concurrent use.
+type Swarm struct {
+	// Peers receives the newly discovered peers
+	Peers chan TrackerPeer
+
+	mu    sync.Mutex
+	known map[string]bool
+	// connected are the peers with an open connection, they are shared by peer exchange
+	connected map[string]PexPeer
+}
+
+func NewSwarm() *Swarm {
+	return &Swarm{
+		Peers:     make(chan TrackerPeer, SwarmPeersBuffer),
+		known:     make(map[string]bool),
+		connected: make(map[string]PexPeer),
+	}
+}
+
+// AddPeers reports the peers that were not known yet on Peers and returns how many were new.
+// When Peers is full the remaining peers are not remembered, so a later announce can add them.
+func (swarm *Swarm) AddPeers(peers []TrackerPeer) int {
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+
+	added := 0
+	for _, peer := range peers {
+		address := peer.String()
+		if swarm.known[address] {
+			continue
+		}
+
+		select {
+		case swarm.Peers <- peer:
+			swarm.known[address] = true
+			added++
+		default:
+			return added
+		}
+	}
+	return added
+}
+
+// Len returns the number of peers reported so far
+func (swarm *Swarm) Len() int {
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+	return len(swarm.known)
+}
+
+// Connected records an open connection to the peer, it is not reported on Peers afterwards
+func (swarm *Swarm) Connected(peer PexPeer) {
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+
+	address := peer.String()
+	swarm.known[address] = true
+	swarm.connected[address] = peer
+}
+
+func (swarm *Swarm) Disconnected(peer TrackerPeer) {
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+
+	delete(swarm.connected, peer.String())
+}
+
+// ConnectedPeers returns the peers with an open connection except the given one
+func (swarm *Swarm) ConnectedPeers(except TrackerPeer) []PexPeer {
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+
+	exceptAddress := except.String()
+	peers := make([]PexPeer, 0, len(swarm.connected))
+	for address, peer := range swarm.connected {
+		if address != exceptAddress {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// ParsePeerAddress parses an "ip:port" address, host names are not resolved
+func ParsePeerAddress(address string) (TrackerPeer, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return TrackerPeer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return TrackerPeer{}, fmt.Errorf("peer address %q: invalid ip", address)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber <= 0 || portNumber > 65535 {
+		return TrackerPeer{}, fmt.Errorf("peer address %q: invalid port", address)
+	}
+	return TrackerPeer{Ip: ip, Port: portNumber}, nil
+}
@@ -0,0 +1,233 @@
+package bittorrent
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// BitTorrent v2 (BEP 52) metadata.
+//
+// A v2 torrent describes its files with "file tree" instead of "files"/"length" and each file starts
+// at a piece boundary. A hybrid torrent contains both, the v1 "files" list aligns the files with pad files.
+
+func (info *TorrentFileInfo) IsV2() bool {
+	return info.MetaVersion == 2
+}
+
+// HasV1 is false for v2-only torrents, which have no SHA-1 "pieces"
+func (info *TorrentFileInfo) HasV1() bool {
+	return !info.IsV2() || info.Pieces != ""
+}
+
+func (info *TorrentFileInfo) IsHybrid() bool {
+	return info.IsV2() && info.HasV1()
+}
+
+func (entry *TorrentFileEntry) IsPad() bool {
+	for _, attr := range entry.Attr {
+		if attr == 'p' {
+			return true
+		}
+	}
+	return false
+}
+
+func (info *TorrentFileInfo) validateV2() error {
+	if info.PieceLength < MerkleBlockSize || !isPowerOfTwo(info.PieceLength) {
+		return fmt.Errorf("info.piece length: %d is not a power of two >= %d", info.PieceLength, MerkleBlockSize)
+	}
+	if info.FileTree == nil {
+		return fmt.Errorf("info.file tree: no \"file tree\" field")
+	}
+
+	files, err := walkFileTree(info.FileTree, nil, nil)
+	if err != nil {
+		return err
+	}
+	info.filesV2 = files
+	info.received = &receivedLayers{layers: make(map[string]*receivedLayer)}
+
+	for _, file := range files {
+		if file.Length <= info.PieceLength || info.PieceLayers == nil {
+			continue
+		}
+		layer, ok := info.PieceLayers[file.PiecesRoot]
+		if !ok {
+			return fmt.Errorf("piece layers: no layer for %v", file.Path)
+		}
+		pieces := (file.Length + info.PieceLength - 1) / info.PieceLength
+		if len(layer) != pieces*32 {
+			return fmt.Errorf("piece layers: expected %d hashes for %v, got %d bytes", pieces, file.Path, len(layer))
+		}
+		hashes := make([][32]byte, pieces)
+		for i := range hashes {
+			copy(hashes[i][:], layer[i*32:])
+		}
+		if root := PiecesRootFromLayer(hashes, info.PieceLength); string(root[:]) != file.PiecesRoot {
+			return fmt.Errorf("piece layers: layer of %v does not match pieces root", file.Path)
+		}
+	}
+
+	if info.HasV1() {
+		return nil
+	}
+
+	// v2-only: the v1 view of the files is generated, with pad files so that every file starts at a piece
+	if len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == info.Name {
+		info.Length = files[0].Length
+		return nil
+	}
+	info.Files = make([]TorrentFileEntry, 0, len(files))
+	info.Length = 0
+	for i, file := range files {
+		info.Length += file.Length
+		info.Files = append(info.Files, file)
+		if rest := file.Length % info.PieceLength; rest != 0 && i != len(files)-1 {
+			info.Files = append(info.Files, TorrentFileEntry{
+				Length: info.PieceLength - rest,
+				Path:   []string{".pad", strconv.Itoa(info.PieceLength - rest)},
+				Attr:   "p",
+			})
+			info.Length += info.PieceLength - rest
+		}
+	}
+	return nil
+}
+
+// walkFileTree flattens the nested "file tree" dicts into a list of files sorted by path,
+// a file is a dict with the empty key: {"name": {"": {"length": 1, "pieces root": "..."}}}
+func walkFileTree(tree map[string]interface{}, path []string, files []TorrentFileEntry) ([]TorrentFileEntry, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("info.file tree: %v is not a dict", append(path, name))
+		}
+
+		if name == "" {
+			if len(path) == 0 {
+				return nil, fmt.Errorf("info.file tree: file without name")
+			}
+			file, err := newFileTreeEntry(node, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+			continue
+		}
+
+		if !isValidPathComponent(name) {
+			return nil, fmt.Errorf("info.file tree: invalid path component %q", name)
+		}
+		var err error
+		files, err = walkFileTree(node, append(append([]string(nil), path...), name), files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func newFileTreeEntry(node map[string]interface{}, path []string) (TorrentFileEntry, error) {
+	entry := TorrentFileEntry{Path: path}
+
+	length, ok := node["length"].(int)
+	if !ok || length < 0 {
+		return entry, fmt.Errorf("info.file tree: invalid length of %v", path)
+	}
+	entry.Length = length
+
+	if length > 0 {
+		root, ok := node["pieces root"].(string)
+		if !ok || len(root) != 32 {
+			return entry, fmt.Errorf("info.file tree: invalid pieces root of %v", path)
+		}
+		entry.PiecesRoot = root
+	}
+
+	return entry, nil
+}
+
+// v2PieceFile returns the file containing the piece and the offset of the file in the piece aligned layout
+func (info *TorrentFileInfo) v2PieceFile(idx int) (*TorrentFileEntry, int64, bool) {
+	pieceStart := int64(idx) * int64(info.PieceLength)
+	offset := int64(0)
+	for i := range info.filesV2 {
+		file := &info.filesV2[i]
+		if file.Length > 0 && pieceStart >= offset && pieceStart < offset+int64(file.Length) {
+			return file, offset, true
+		}
+		pieces := (int64(file.Length) + int64(info.PieceLength) - 1) / int64(info.PieceLength)
+		offset += pieces * int64(info.PieceLength)
+	}
+	return nil, 0, false
+}
+
+func (info *TorrentFileInfo) v2PieceCount() int {
+	count := 0
+	for _, file := range info.filesV2 {
+		count += (file.Length + info.PieceLength - 1) / info.PieceLength
+	}
+	return count
+}
+
+// v2PieceLen is the length of the piece without the padding, v2 pieces end with the file
+func (info *TorrentFileInfo) v2PieceLen(idx int) int {
+	file, offset, ok := info.v2PieceFile(idx)
+	if !ok {
+		return 0
+	}
+	pieceStart := int64(idx) * int64(info.PieceLength)
+	return int(min(int64(info.PieceLength), offset+int64(file.Length)-pieceStart))
+}
+
+// PieceHashV2 returns the merkle root of the piece and the number of leaves it is computed from.
+// ok is false if the hash of the piece is neither in the piece layers nor received from a peer.
+func (info *TorrentFileInfo) PieceHashV2(idx int) (root [32]byte, leaves int, ok bool) {
+	file, offset, ok := info.v2PieceFile(idx)
+	if !ok {
+		return root, 0, false
+	}
+
+	// files up to one piece are verified against the pieces root directly
+	if file.Length <= info.PieceLength {
+		copy(root[:], file.PiecesRoot)
+		return root, MerkleFileLeaves(file.Length), true
+	}
+
+	k := int((int64(idx)*int64(info.PieceLength) - offset) / int64(info.PieceLength))
+	if root, ok = info.pieceLayerHash(file, k); !ok {
+		return root, 0, false
+	}
+	return root, info.PieceLength / MerkleBlockSize, true
+}
+
+// validateHybrid checks that the v1 files without pad files are the v2 files
+func (info *TorrentFileInfo) validateHybrid() error {
+	files := []TorrentFileEntry{{Length: info.Length, Path: []string{info.Name}}}
+	if info.IsMultiFile() {
+		files = files[:0]
+		for _, file := range info.Files {
+			if !file.IsPad() {
+				files = append(files, file)
+			}
+		}
+	}
+
+	if len(files) != len(info.filesV2) {
+		return fmt.Errorf("info: %d v1 files but %d v2 files", len(files), len(info.filesV2))
+	}
+	for i, file := range files {
+		if file.Length != info.filesV2[i].Length {
+			return fmt.Errorf("info.files[%d]: length %d does not match the file tree", i, file.Length)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const v2TestPieceLength = 2 * MerkleBlockSize
+
+// v2TestTorrent builds a torrent with the files "a" (two pieces) and "b" (less than a piece),
+// for hybrid torrents the v1 "files" contain a pad file after "a"
+func v2TestTorrent(t *testing.T, hybrid bool) (data []byte, a []byte, b []byte) {
+	a = bytes.Repeat([]byte("a"), v2TestPieceLength+7232)
+	b = bytes.Repeat([]byte("b"), 10000)
+
+	aBlocks := naiveBlockHashes(a)
+	layer := naiveMerkleRoot(aBlocks[:2])
+	// the last piece is padded to a full piece with zero leaves
+	last := naiveMerkleRoot([][32]byte{aBlocks[2], {}})
+	aRoot := naiveMerkleRoot(aBlocks)
+	bRoot := naiveMerkleRoot(naiveBlockHashes(b))
+
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": v2TestPieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"a": map[string]interface{}{"": map[string]interface{}{"length": len(a), "pieces root": aRoot[:]}},
+			"b": map[string]interface{}{"": map[string]interface{}{"length": len(b), "pieces root": bRoot[:]}},
+		},
+	}
+	if hybrid {
+		pad := v2TestPieceLength - len(a)%v2TestPieceLength
+		padded := append(append([]byte(nil), a...), make([]byte, pad)...)
+		var pieces []byte
+		for _, piece := range [][]byte{padded[:v2TestPieceLength], padded[v2TestPieceLength:], b} {
+			hash := sha1.Sum(piece)
+			pieces = append(pieces, hash[:]...)
+		}
+		info["pieces"] = pieces
+		info["files"] = []interface{}{
+			map[string]interface{}{"length": len(a), "path": []string{"a"}},
+			map[string]interface{}{"length": pad, "path": []string{".pad", "pad"}, "attr": "p"},
+			map[string]interface{}{"length": len(b), "path": []string{"b"}},
+		}
+	}
+
+	data, err := MarshalBencode(map[string]interface{}{
+		"announce":     "http://tracker/announce",
+		"info":         info,
+		"piece layers": map[string]interface{}{string(aRoot[:]): append(layer[:], last[:]...)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, a, b
+}
+
+func TestTorrentFileV2(t *testing.T) {
+	for _, hybrid := range []bool{false, true} {
+		data, a, b := v2TestTorrent(t, hybrid)
+		torrent, err := NewTorrentFileFromBytes(data, 1234)
+		if err != nil {
+			t.Fatalf("hybrid=%v: %s", hybrid, err)
+		}
+		info := &torrent.Info
+
+		if info.IsHybrid() != hybrid || !info.IsV2() {
+			t.Errorf("hybrid=%v: unexpected version v1=%v v2=%v", hybrid, info.HasV1(), info.IsV2())
+		}
+
+		hashV2, ok := torrent.InfoHashV2()
+		if want := sha256.Sum256(torrent.RawInfo); !ok || hashV2 != want {
+			t.Errorf("hybrid=%v: got v2 info hash %x want %x", hybrid, hashV2, want)
+		}
+		hash, _ := torrent.InfoHash()
+		want := sha1.Sum(torrent.RawInfo)
+		if !hybrid {
+			copy(want[:], hashV2[:])
+		}
+		if hash != want {
+			t.Errorf("hybrid=%v: got info hash %x want %x", hybrid, hash, want)
+		}
+
+		if info.PieceCount() != 3 || len(info.Files) != 3 || !info.Files[1].IsPad() {
+			t.Fatalf("hybrid=%v: unexpected layout %d pieces, files %+v", hybrid, info.PieceCount(), info.Files)
+		}
+		if want := 2*v2TestPieceLength + len(b); info.Length != want {
+			t.Errorf("hybrid=%v: got length %d want %d", hybrid, info.Length, want)
+		}
+
+		// pieces of hybrid torrents include the padding, v2 pieces end with the file
+		piece1 := a[v2TestPieceLength:]
+		if hybrid {
+			piece1 = append(append([]byte(nil), piece1...), make([]byte, v2TestPieceLength-len(piece1))...)
+		}
+		for i, content := range [][]byte{a[:v2TestPieceLength], piece1, b} {
+			piece := info.NewPiece(i)
+			if piece.Len != len(content) || piece.V2 == nil {
+				t.Fatalf("hybrid=%v: piece %d: unexpected piece %+v", hybrid, i, piece)
+			}
+			piece.Data = append([]byte(nil), content...)
+			if err := piece.Verify(); err != nil {
+				t.Errorf("hybrid=%v: piece %d: %s", hybrid, i, err)
+			}
+			piece.Data[0] ^= 1
+			if err := piece.Verify(); err == nil {
+				t.Errorf("hybrid=%v: piece %d: expected corrupted piece to fail", hybrid, i)
+			}
+		}
+	}
+}
+
+func TestTorrentFileV2Storage(t *testing.T) {
+	data, a, b := v2TestTorrent(t, false)
+	torrent, err := NewTorrentFileFromBytes(data, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	storage, err := NewFileStorage(root, &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, content := range [][]byte{a[:v2TestPieceLength], a[v2TestPieceLength:], b} {
+		piece := torrent.Info.NewPiece(i)
+		piece.Storage = storage
+		piece.Data = append([]byte(nil), content...)
+		if err := piece.SaveToFile(); err != nil {
+			t.Fatalf("piece %d: %s", i, err)
+		}
+	}
+
+	for name, want := range map[string][]byte{"a": a, "b": b} {
+		got, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: unexpected content (%d bytes), err=%v", name, len(got), err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("pad file should not be created: %v", err)
+	}
+
+	// pad files read as zeros
+	buf := make([]byte, 10)
+	if _, err := storage.ReadAt(buf, int64(len(a))); err != nil || !bytes.Equal(buf, make([]byte, 10)) {
+		t.Errorf("unexpected pad read %v %v", buf, err)
+	}
+}
+
+func TestTorrentFileV2InvalidLayers(t *testing.T) {
+	data, _, _ := v2TestTorrent(t, false)
+	torrent := &TorrentFile{}
+	if err := UnmarshalBencode(data, torrent); err != nil {
+		t.Fatal(err)
+	}
+	for root, layer := range torrent.PieceLayers {
+		torrent.PieceLayers[root] = layer[:32] + layer[:32]
+	}
+	if err := torrent.init(1234); err == nil {
+		t.Errorf("expected error for layer not matching the pieces root")
+	}
+}
+
+func TestMagnetLinkInfoHashV2(t *testing.T) {
+	hash := sha256.Sum256([]byte("info"))
+	magnetLink, err := NewMagnetLink("magnet:?xt=urn:btmh:1220"+hex.EncodeToString(hash[:])+"&dn=x", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := magnetLink.InfoHashV2()
+	if err != nil || got != hash {
+		t.Errorf("got %x want %x (%v)", got, hash, err)
+	}
+	truncated, err := magnetLink.InfoHash()
+	if err != nil || !bytes.Equal(truncated[:], hash[:20]) {
+		t.Errorf("got %x want %x (%v)", truncated, hash[:20], err)
+	}
+}
+
+// v2TestSingleFile builds a v2-only torrent of content with v2TestPieceLength pieces, with or without piece layers
+func v2TestSingleFile(t *testing.T, content []byte, layers bool) []byte {
+	t.Helper()
+
+	blocks := naiveBlockHashes(content)
+	perPiece := v2TestPieceLength / MerkleBlockSize
+	var layer []byte
+	for i := 0; i < len(blocks); i += perPiece {
+		leaves := make([][32]byte, perPiece)
+		copy(leaves, blocks[i:])
+		root := naiveMerkleRoot(leaves)
+		layer = append(layer, root[:]...)
+	}
+	root := naiveMerkleRoot(blocks)
+
+	torrent := map[string]interface{}{
+		"announce": "http://tracker/announce",
+		"info": map[string]interface{}{
+			"name":         "data.bin",
+			"piece length": v2TestPieceLength,
+			"meta version": 2,
+			"file tree": map[string]interface{}{
+				"data.bin": map[string]interface{}{"": map[string]interface{}{"length": len(content), "pieces root": root[:]}},
+			},
+		},
+	}
+	if layers {
+		torrent["piece layers"] = map[string]interface{}{string(root[:]): layer}
+	}
+	data, err := MarshalBencode(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTorrentFileV2HashRequests(t *testing.T) {
+	// 5 pieces, the piece layer is padded to 8 hashes
+	content := bytes.Repeat([]byte("0123456789"), (4*v2TestPieceLength+20000)/10)
+	seed, err := NewTorrentFileFromBytes(v2TestSingleFile(t, content, true), 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeech := func() *TorrentFileInfo {
+		leech, err := NewTorrentFileFromBytes(v2TestSingleFile(t, content, false), 1234)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &leech.Info
+	}
+
+	if requests := seed.Info.HashRequests(); len(requests) != 0 {
+		t.Errorf("requests %+v with piece layers", requests)
+	}
+
+	leech := newLeech()
+	if leech.PieceHashKnown(0) || leech.NewPiece(0).V2 != nil {
+		t.Fatal("hash known without piece layers")
+	}
+	requests := leech.HashRequests()
+	if len(requests) != 1 || requests[0].Index != 0 || requests[0].Length != 8 || requests[0].ProofLayers != 3 || requests[0].BaseLayer != 1 {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	if _, err := leech.HashesFor(requests[0]); err == nil {
+		t.Error("answered a hash request without the piece layer")
+	}
+
+	hashes, err := seed.Info.HashesFor(requests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leech.AddHashes(hashes); err != nil {
+		t.Fatal(err)
+	}
+	if requests := leech.HashRequests(); len(requests) != 0 {
+		t.Errorf("requests %+v after the hashes arrived", requests)
+	}
+	for i := 0; i < leech.PieceCount(); i++ {
+		piece := leech.NewPiece(i)
+		piece.Data = content[i*v2TestPieceLength : min((i+1)*v2TestPieceLength, len(content))]
+		if err := piece.Verify(); err != nil {
+			t.Errorf("piece %d: %s", i, err)
+		}
+	}
+
+	// the second half of the layer is verified with the uncle hash of the first half
+	leech = newLeech()
+	hashes, err = seed.Info.HashesFor(HashRequestMsg{PiecesRoot: requests[0].PiecesRoot, BaseLayer: 1, Index: 4, Length: 4, ProofLayers: 3})
+	if err != nil || len(hashes.Hashes) != 5 {
+		t.Fatalf("unexpected hashes %d, %v", len(hashes.Hashes), err)
+	}
+	if err := leech.AddHashes(hashes); err != nil {
+		t.Fatal(err)
+	}
+	if !leech.PieceHashKnown(4) || leech.PieceHashKnown(3) {
+		t.Error("expected only the hash of piece 4 to be known")
+	}
+
+	invalid := []struct {
+		name   string
+		change func(*HashesMsg)
+	}{
+		{"changed hash", func(m *HashesMsg) { m.Hashes[0][0] ^= 1 }},
+		{"changed uncle", func(m *HashesMsg) { m.Hashes[4][0] ^= 1 }},
+		{"missing uncle", func(m *HashesMsg) { m.Hashes = m.Hashes[:4] }},
+		{"wrong index", func(m *HashesMsg) { m.Index = 0 }},
+		{"unaligned index", func(m *HashesMsg) { m.Index = 2 }},
+		{"wrong layer", func(m *HashesMsg) { m.BaseLayer = 0 }},
+		{"unknown root", func(m *HashesMsg) { m.PiecesRoot[0] ^= 1 }},
+	}
+	for _, v := range invalid {
+		msg := hashes
+		msg.Hashes = append([][32]byte(nil), hashes.Hashes...)
+		v.change(&msg)
+		if err := newLeech().AddHashes(msg); err == nil {
+			t.Errorf("%s: hashes were accepted", v.name)
+		}
+	}
+}
+
+func TestTorrentFileHybridWithoutLayers(t *testing.T) {
+	data, a, _ := v2TestTorrent(t, true)
+	withLayers, err := NewTorrentFileFromBytes(data, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := NewTorrentFileFromInfo(withLayers.RawInfo, "http://tracker/announce", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pieces of "a" are verified with their SHA-1 hash alone
+	piece := torrent.Info.NewPiece(0)
+	if piece.V2 != nil || !torrent.Info.PieceHashKnown(0) {
+		t.Fatalf("unexpected piece %+v", piece)
+	}
+	piece.Data = append([]byte(nil), a[:v2TestPieceLength]...)
+	if err := piece.Verify(); err != nil {
+		t.Error(err)
+	}
+	piece.Data[0] ^= 1
+	if err := piece.Verify(); err == nil {
+		t.Error("expected corrupted piece to fail")
+	}
+}
@@ -0,0 +1,397 @@
+package bittorrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type AnnounceEvent string
+
+const (
+	EventNone      AnnounceEvent = ""
+	EventStarted   AnnounceEvent = "started"
+	EventCompleted AnnounceEvent = "completed"
+	EventStopped   AnnounceEvent = "stopped"
+)
+
+// AnnounceRequest contains the parameters of an announce, it is the same for HTTP and UDP trackers
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Compact    int
+	Event      AnnounceEvent
+	// TrackerID is the "tracker id" of the previous response of the tracker, only used by HTTP trackers
+	TrackerID string
+}
+
+type TrackerResponse struct {
+	// Interval and MinInterval are in seconds, -1 if the tracker did not send them
+	Interval    int
+	MinInterval int
+	Peers       []TrackerPeer
+	// Complete (seeders) and Incomplete (leechers) are -1 if the tracker did not send them
+	Complete   int
+	Incomplete int
+	// WarningMessage is a message for the user, the response is still valid
+	WarningMessage string
+	TrackerID      string
+}
+
+// TrackerError is returned when the tracker rejected the request with a "failure reason"
+type TrackerError struct {
+	FailureReason string
+}
+
+func (err *TrackerError) Error() string {
+	return fmt.Sprintf("tracker failure: %s", err.FailureReason)
+}
+
+type TrackerPeer struct {
+	Ip   net.IP
+	Port int
+	// PeerID is only known from non-compact peer lists, it is nil otherwise
+	PeerID []byte
+}
+
+func (peer TrackerPeer) String() string {
+	return net.JoinHostPort(peer.Ip.String(), strconv.Itoa(peer.Port))
+}
+
+// Announce sends the request to the tracker, the protocol is chosen by the scheme of trackerURL
+func Announce(ctx context.Context, trackerURL string, req *AnnounceRequest) (*TrackerResponse, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, trackerURL, req)
+	case "udp":
+		return DefaultUDPTrackerClient.Announce(ctx, trackerURL, req)
+	default:
+		return nil, fmt.Errorf("tracker %q: unsupported scheme %q", trackerURL, u.Scheme)
+	}
+}
+
+func newHTTPAnnounceURL(trackerURL string, req *AnnounceRequest) string {
+	trackerParams := url.Values{}
+	trackerParams.Set("info_hash", string(req.InfoHash[:]))
+	trackerParams.Set("peer_id", string(req.PeerID[:]))
+	trackerParams.Set("port", strconv.Itoa(req.Port))
+	trackerParams.Set("uploaded", strconv.Itoa(req.Uploaded))
+	trackerParams.Set("downloaded", strconv.Itoa(req.Downloaded))
+	trackerParams.Set("left", strconv.Itoa(req.Left))
+	trackerParams.Set("compact", strconv.Itoa(req.Compact))
+	if req.Event != EventNone {
+		trackerParams.Set("event", string(req.Event))
+	}
+	if req.TrackerID != "" {
+		trackerParams.Set("trackerid", req.TrackerID)
+	}
+
+	// the announce URL may already contain a query, for example a passkey
+	separator := "?"
+	if strings.Contains(trackerURL, "?") {
+		separator = "&"
+	}
+	return trackerURL + separator + trackerParams.Encode()
+}
+
+func announceHTTP(ctx context.Context, trackerURL string, req *AnnounceRequest) (*TrackerResponse, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, newHTTPAnnounceURL(trackerURL, req), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTrackerResponse(body)
+}
+
+// trackerResponseDict is the bencoded announce response
+type trackerResponseDict struct {
+	FailureReason  *string `bencode:"failure reason"`
+	WarningMessage string  `bencode:"warning message"`
+	TrackerID      string  `bencode:"tracker id"`
+	Interval       *int    `bencode:"interval"`
+	MinInterval    *int    `bencode:"min interval"`
+	Complete       *int    `bencode:"complete"`
+	Incomplete     *int    `bencode:"incomplete"`
+	// Peers is either a compact string or a list of dicts
+	Peers  BencodeRawMessage `bencode:"peers"`
+	Peers6 *string           `bencode:"peers6"`
+}
+
+// trackerPeerDict is an entry of the non-compact peer list
+type trackerPeerDict struct {
+	Ip     *string `bencode:"ip"`
+	Port   *int    `bencode:"port"`
+	PeerID *string `bencode:"peer id"`
+}
+
+func parseTrackerResponse(body []byte) (*TrackerResponse, error) {
+	var dict trackerResponseDict
+	if err := UnmarshalBencode(body, &dict); err != nil {
+		return nil, err
+	}
+
+	if dict.FailureReason != nil {
+		return nil, &TrackerError{FailureReason: *dict.FailureReason}
+	}
+
+	if dict.Peers == nil && dict.Peers6 == nil {
+		return nil, fmt.Errorf("tracker response: no \"peers\" field")
+	}
+
+	response := &TrackerResponse{
+		Peers:          make([]TrackerPeer, 0),
+		WarningMessage: dict.WarningMessage,
+		TrackerID:      dict.TrackerID,
+	}
+	if dict.Peers != nil {
+		peers, err := parseTrackerPeers(dict.Peers)
+		if err != nil {
+			return nil, err
+		}
+		response.Peers = append(response.Peers, peers...)
+	}
+	if dict.Peers6 != nil {
+		peers, err := ParseCompactPeers6([]byte(*dict.Peers6))
+		if err != nil {
+			return nil, fmt.Errorf("tracker response: peers6: %w", err)
+		}
+		response.Peers = append(response.Peers, peers...)
+	}
+
+	// optional
+	response.Interval = -1
+	if dict.Interval != nil {
+		response.Interval = *dict.Interval
+	}
+	response.MinInterval = -1
+	if dict.MinInterval != nil {
+		response.MinInterval = *dict.MinInterval
+	}
+	response.Complete = -1
+	if dict.Complete != nil {
+		response.Complete = *dict.Complete
+	}
+	response.Incomplete = -1
+	if dict.Incomplete != nil {
+		response.Incomplete = *dict.Incomplete
+	}
+
+	return response, nil
+}
+
+func parseTrackerPeers(raw BencodeRawMessage) ([]TrackerPeer, error) {
+	if raw[0] != 'l' {
+		var compact string
+		if err := UnmarshalBencode(raw, &compact); err != nil {
+			return nil, fmt.Errorf("tracker response: peers: %w", err)
+		}
+		peers, err := ParseCompactPeers([]byte(compact))
+		if err != nil {
+			return nil, fmt.Errorf("tracker response: peers: %w", err)
+		}
+		return peers, nil
+	}
+
+	var list []trackerPeerDict
+	if err := UnmarshalBencode(raw, &list); err != nil {
+		return nil, fmt.Errorf("tracker response: peers: %w", err)
+	}
+
+	peers := make([]TrackerPeer, 0, len(list))
+	for i, entry := range list {
+		if entry.Ip == nil || entry.Port == nil {
+			return nil, fmt.Errorf("tracker response: peers[%d]: missing \"ip\" or \"port\"", i)
+		}
+		if *entry.Port <= 0 || *entry.Port > 65535 {
+			return nil, fmt.Errorf("tracker response: peers[%d].port: invalid value %d", i, *entry.Port)
+		}
+		peer := TrackerPeer{Ip: net.ParseIP(*entry.Ip), Port: *entry.Port}
+		// the ip may also be a DNS name, those peers are skipped
+		if peer.Ip == nil {
+			continue
+		}
+		if entry.PeerID != nil {
+			if len(*entry.PeerID) != 20 {
+				return nil, fmt.Errorf("tracker response: peers[%d].peer id: expected 20 bytes, got %d", i, len(*entry.PeerID))
+			}
+			peer.PeerID = []byte(*entry.PeerID)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// ParseCompactPeers parses 6 byte IPv4 address and port entries
+func ParseCompactPeers(peers []byte) ([]TrackerPeer, error) {
+	return parseCompactPeers(peers, net.IPv4len)
+}
+
+// ParseCompactPeers6 parses 18 byte IPv6 address and port entries (BEP 7)
+func ParseCompactPeers6(peers []byte) ([]TrackerPeer, error) {
+	return parseCompactPeers(peers, net.IPv6len)
+}
+
+func parseCompactPeers(peers []byte, ipLen int) ([]TrackerPeer, error) {
+	entryLen := ipLen + 2
+	if len(peers)%entryLen != 0 {
+		return nil, fmt.Errorf("compact peers: length %d is not a multiple of %d", len(peers), entryLen)
+	}
+
+	result := make([]TrackerPeer, 0, len(peers)/entryLen)
+	for i := 0; i < len(peers); i += entryLen {
+		result = append(result, TrackerPeer{
+			Ip:   net.IP(append([]byte(nil), peers[i:i+ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(peers[i+ipLen:])),
+		})
+	}
+	return result, nil
+}
+
+// CompactPeers encodes the IPv4 peers as 6 byte entries, others are skipped
+func CompactPeers(peers []TrackerPeer) []byte {
+	return compactPeers(peers, net.IPv4len)
+}
+
+// CompactPeers6 encodes the IPv6 peers as 18 byte entries, others are skipped
+func CompactPeers6(peers []TrackerPeer) []byte {
+	return compactPeers(peers, net.IPv6len)
+}
+
+func compactPeers(peers []TrackerPeer, ipLen int) []byte {
+	result := make([]byte, 0, len(peers)*(ipLen+2))
+	for _, peer := range peers {
+		ip := peer.Ip.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = peer.Ip.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		result = append(result, ip...)
+		result = binary.BigEndian.AppendUint16(result, uint16(peer.Port))
+	}
+	return result
+}
+
+// TrackerList implements the multitracker tiers of BEP 12: the trackers of a tier are shuffled once,
+// tiers are tried in order and a tracker that responds is moved to the front of its tier.
+// It is safe for concurrent use.
+type TrackerList struct {
+	mu    sync.Mutex
+	tiers [][]string
+	// trackerIDs are sent back to the tracker that returned them
+	trackerIDs map[string]string
+}
+
+func NewTrackerList(tiers [][]string) *TrackerList {
+	list := &TrackerList{trackerIDs: make(map[string]string)}
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := append([]string(nil), tier...)
+		mathrand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		list.tiers = append(list.tiers, shuffled)
+	}
+	return list
+}
+
+// Tiers returns a copy of the tiers in the order they are tried
+func (list *TrackerList) Tiers() [][]string {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	tiers := make([][]string, len(list.tiers))
+	for i, tier := range list.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+// Announce returns the response of the first tracker that answers and its URL
+func (list *TrackerList) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, string, error) {
+	var errs []error
+	for i, tier := range list.Tiers() {
+		for _, trackerURL := range tier {
+			trackerReq := *req
+			trackerReq.TrackerID = list.trackerID(trackerURL)
+
+			response, err := Announce(ctx, trackerURL, &trackerReq)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, "", ctx.Err()
+				}
+				errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+				continue
+			}
+			if response.WarningMessage != "" {
+				log.Printf("tracker %s: warning: %s", trackerURL, response.WarningMessage)
+			}
+			list.promote(i, trackerURL, response.TrackerID)
+			return response, trackerURL, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, "", fmt.Errorf("no trackers")
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+func (list *TrackerList) trackerID(trackerURL string) string {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	return list.trackerIDs[trackerURL]
+}
+
+func (list *TrackerList) promote(tier int, trackerURL string, trackerID string) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if trackerID != "" {
+		list.trackerIDs[trackerURL] = trackerID
+	}
+
+	trackers := list.tiers[tier]
+	for i, v := range trackers {
+		if v == trackerURL {
+			copy(trackers[1:i+1], trackers[:i])
+			trackers[0] = trackerURL
+			return
+		}
+	}
+}
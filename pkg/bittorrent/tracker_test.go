@@ -0,0 +1,172 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newFakeHTTPTracker(t *testing.T, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTrackerListAnnounce(t *testing.T) {
+	alive := newFakeHTTPTracker(t, "d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	list := NewTrackerList([][]string{{dead.URL, alive.URL}, {"http://unused/"}})
+	for i := 0; i < 2; i++ {
+		response, trackerURL, err := list.Announce(context.Background(), &AnnounceRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trackerURL != alive.URL || response.Interval != 900 || len(response.Peers) != 1 {
+			t.Errorf("unexpected response %+v from %s", response, trackerURL)
+		}
+	}
+
+	// the tracker that responded is tried first
+	if tiers := list.Tiers(); tiers[0][0] != alive.URL || tiers[1][0] != "http://unused/" {
+		t.Errorf("unexpected tiers %v", tiers)
+	}
+}
+
+func TestTrackerListAllFail(t *testing.T) {
+	list := NewTrackerList([][]string{{"ftp://a/"}, {"ftp://b/"}})
+	if _, _, err := list.Announce(context.Background(), &AnnounceRequest{}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestTorrentFileAnnounceList(t *testing.T) {
+	torrent, err := NewTorrentFile("../../big-buck-bunny.torrent", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, want []string
+	for _, tier := range torrent.Trackers.Tiers() {
+		got = append(got, tier...)
+	}
+	for _, tier := range torrent.AnnounceList {
+		want = append(want, tier...)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(want) < 2 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got trackers %v want %v", got, want)
+	}
+}
+
+func TestMagnetLinkTrackers(t *testing.T) {
+	magnetLink, err := NewMagnetLink("magnet:?xt=urn:btih:d69f91e6b2ae4c542468d1073a71d4ea13879a7f&tr=http%3A%2F%2Fa%2F&tr=udp%3A%2F%2Fb%3A80", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"http://a/"}, {"udp://b:80"}}
+	if got := magnetLink.Trackers.Tiers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestParseTrackerResponsePeers(t *testing.T) {
+	peerID := "-XX0001-0123456789ab"
+	tests := []struct {
+		body  string
+		peers []string
+	}{
+		{"d8:intervali60e5:peers12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2e", []string{"10.0.0.1:6881", "10.0.0.2:6882"}},
+		{"d5:peersld2:ip8:10.0.0.17:peer id20:" + peerID + "4:porti6881eed2:ip3:::14:porti80eeee", []string{"10.0.0.1:6881", "[::1]:80"}},
+		// DNS names are skipped
+		{"d5:peersld2:ip9:localhost4:porti1eeee", nil},
+		{"d5:peers0:6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x50e", []string{"[::1]:80"}},
+	}
+
+	for _, v := range tests {
+		response, err := parseTrackerResponse([]byte(v.body))
+		if err != nil {
+			t.Errorf("%q: %s", v.body, err)
+			continue
+		}
+		var got []string
+		for _, peer := range response.Peers {
+			got = append(got, peer.String())
+		}
+		if !reflect.DeepEqual(got, v.peers) {
+			t.Errorf("%q: got %v want %v", v.body, got, v.peers)
+		}
+	}
+
+	response, err := parseTrackerResponse([]byte(tests[1].body))
+	if err != nil || string(response.Peers[0].PeerID) != peerID || response.Peers[1].PeerID != nil {
+		t.Errorf("unexpected peer ids %+v %v", response, err)
+	}
+}
+
+func TestParseTrackerResponseInvalidPeers(t *testing.T) {
+	tests := []string{
+		"d8:intervali60ee",
+		"d5:peers5:\x0a\x00\x00\x01\x1ae",
+		"d5:peers0:6:peers66:\x00\x00\x00\x00\x00\x00e",
+		"d5:peersld4:porti1eeee",
+		"d5:peersld2:ip8:10.0.0.14:porti70000eeee",
+		"d5:peersld2:ip8:10.0.0.17:peer id3:abc4:porti1eeee",
+		"d5:peersi1ee",
+	}
+
+	for _, body := range tests {
+		if _, err := parseTrackerResponse([]byte(body)); err == nil {
+			t.Errorf("%q: expected error", body)
+		}
+	}
+}
+
+func TestParseTrackerResponseFailure(t *testing.T) {
+	_, err := parseTrackerResponse([]byte("d14:failure reason17:torrent not founde"))
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || trackerErr.FailureReason != "torrent not found" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestParseTrackerResponseFields(t *testing.T) {
+	response, err := parseTrackerResponse([]byte("d8:completei5e10:incompletei3e8:intervali60e5:peers0:10:tracker id3:abc15:warning message4:slowe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Complete != 5 || response.Incomplete != 3 || response.TrackerID != "abc" || response.WarningMessage != "slow" {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	response, err = parseTrackerResponse([]byte("d5:peers0:e"))
+	if err != nil || response.Complete != -1 || response.Incomplete != -1 {
+		t.Errorf("unexpected response %+v %v", response, err)
+	}
+}
+
+func TestTrackerListTrackerID(t *testing.T) {
+	server, recorder := newRecordingTracker(t, "d5:peers0:10:tracker id3:abce")
+	list := NewTrackerList([][]string{{server.URL}})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := list.Announce(context.Background(), &AnnounceRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.requests[0].Has("trackerid") || recorder.requests[1].Get("trackerid") != "abc" {
+		t.Errorf("unexpected requests %v", recorder.requests)
+	}
+}
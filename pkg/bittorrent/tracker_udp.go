@@ -0,0 +1,270 @@
+package bittorrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+
+const (
+	udpTrackerProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// UDPTrackerMaxRetries is n of the last retransmission after 15*2^n seconds
+	UDPTrackerMaxRetries = 8
+	// UDPTrackerTimeout is the timeout of the first transmission, it doubles with every retransmission
+	UDPTrackerTimeout = 15 * time.Second
+	// udpConnectionIDLifetime is how long a connection id may be used by the client
+	udpConnectionIDLifetime = time.Minute
+	// udpScrapeMaxHashes keeps scrape requests and responses below a typical MTU
+	udpScrapeMaxHashes = 74
+	udpMaxPacketSize   = 2048
+)
+
+var udpAnnounceEvents = map[AnnounceEvent]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+type udpConnectionID struct {
+	id      uint64
+	expires time.Time
+}
+
+// UDPTrackerClient caches the connection ids of the trackers it talks to, it is safe for concurrent use
+type UDPTrackerClient struct {
+	Timeout    time.Duration
+	MaxRetries int
+
+	mu          sync.Mutex
+	connections map[string]udpConnectionID
+	key         uint32
+}
+
+var DefaultUDPTrackerClient = NewUDPTrackerClient()
+
+func NewUDPTrackerClient() *UDPTrackerClient {
+	client := &UDPTrackerClient{
+		Timeout:     UDPTrackerTimeout,
+		MaxRetries:  UDPTrackerMaxRetries,
+		connections: make(map[string]udpConnectionID),
+	}
+	client.key = randomUint32()
+	return client
+}
+
+func (client *UDPTrackerClient) Announce(ctx context.Context, trackerURL string, req *AnnounceRequest) (*TrackerResponse, error) {
+	packet := make([]byte, 98)
+	copy(packet[16:36], req.InfoHash[:])
+	copy(packet[36:56], req.PeerID[:])
+	binary.BigEndian.PutUint64(packet[56:], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(packet[64:], uint64(req.Left))
+	binary.BigEndian.PutUint64(packet[72:], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(packet[80:], udpAnnounceEvents[req.Event])
+	// ip (default) stays zero
+	binary.BigEndian.PutUint32(packet[88:], client.key)
+	binary.BigEndian.PutUint32(packet[92:], 0xffffffff) // num_want: default
+	binary.BigEndian.PutUint16(packet[96:], uint16(req.Port))
+
+	response, ipv6, err := client.do(ctx, trackerURL, udpActionAnnounce, packet, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &TrackerResponse{
+		Interval:    int(binary.BigEndian.Uint32(response[8:])),
+		MinInterval: -1,
+		Incomplete:  int(binary.BigEndian.Uint32(response[12:])),
+		Complete:    int(binary.BigEndian.Uint32(response[16:])),
+	}
+	if ipv6 {
+		result.Peers, err = ParseCompactPeers6(response[20:])
+	} else {
+		result.Peers, err = ParseCompactPeers(response[20:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("udp tracker: %w", err)
+	}
+	return result, nil
+}
+
+// Scrape returns the swarm statistics of the torrents in the same order as infoHashes
+func (client *UDPTrackerClient) Scrape(ctx context.Context, trackerURL string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpScrapeMaxHashes {
+		batch := infoHashes[start:min(start+udpScrapeMaxHashes, len(infoHashes))]
+
+		packet := make([]byte, 16, 16+20*len(batch))
+		for _, infoHash := range batch {
+			packet = append(packet, infoHash[:]...)
+		}
+
+		response, _, err := client.do(ctx, trackerURL, udpActionScrape, packet, 8+12*len(batch))
+		if err != nil {
+			return nil, err
+		}
+		for i, infoHash := range batch {
+			entry := response[8+12*i:]
+			results = append(results, ScrapeResult{
+				InfoHash:  infoHash,
+				Seeders:   int(binary.BigEndian.Uint32(entry[0:])),
+				Completed: int(binary.BigEndian.Uint32(entry[4:])),
+				Leechers:  int(binary.BigEndian.Uint32(entry[8:])),
+			})
+		}
+	}
+	return results, nil
+}
+
+// do sends packet (the first 16 bytes are filled in here) and returns a response of at least minLen bytes.
+// Connecting and the request itself share the retransmission schedule of BEP 15.
+func (client *UDPTrackerClient) do(ctx context.Context, trackerURL string, action uint32, packet []byte, minLen int) ([]byte, bool, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	ipv6 := conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+
+	// unblock reads when the context is canceled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for n := 0; n <= client.MaxRetries; n++ {
+		timeout := client.Timeout << n
+
+		connectionID, ok := client.connectionID(u.Host)
+		if !ok {
+			connect := make([]byte, 16)
+			binary.BigEndian.PutUint64(connect, udpTrackerProtocolID)
+			response, err := client.roundTrip(ctx, conn, udpActionConnect, connect, 16, timeout)
+			if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil {
+				continue
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			connectionID = binary.BigEndian.Uint64(response[8:])
+			client.setConnectionID(u.Host, connectionID)
+		}
+
+		binary.BigEndian.PutUint64(packet, connectionID)
+		response, err := client.roundTrip(ctx, conn, action, packet, minLen, timeout)
+		if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			// the connection id may have been rejected, a new one is requested next time
+			client.forgetConnectionID(u.Host)
+			return nil, false, err
+		}
+		return response, ipv6, nil
+	}
+
+	return nil, false, fmt.Errorf("udp tracker %s: no response after %d retransmissions", u.Host, client.MaxRetries)
+}
+
+// roundTrip sets the action and a new transaction id, sends the packet and waits for the matching response
+func (client *UDPTrackerClient) roundTrip(ctx context.Context, conn net.Conn, action uint32, packet []byte, minLen int, timeout time.Duration) ([]byte, error) {
+	transactionID := randomUint32()
+	binary.BigEndian.PutUint32(packet[8:], action)
+	binary.BigEndian.PutUint32(packet[12:], transactionID)
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctxDeadline, hasDeadline := ctx.Deadline()
+	if hasDeadline && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// the read deadline can expire just before the context
+		if errors.Is(err, os.ErrDeadlineExceeded) && hasDeadline && deadline.Equal(ctxDeadline) {
+			return nil, context.DeadlineExceeded
+		}
+		if err != nil {
+			return nil, err
+		}
+		response := buf[:n]
+
+		// responses to earlier transmissions or other packets are ignored
+		if n < 8 || binary.BigEndian.Uint32(response[4:]) != transactionID {
+			continue
+		}
+
+		switch binary.BigEndian.Uint32(response) {
+		case udpActionError:
+			return nil, &TrackerError{FailureReason: string(response[8:])}
+		case action:
+			if n < minLen {
+				return nil, fmt.Errorf("udp tracker: response of %d bytes is too short, expected %d", n, minLen)
+			}
+			return response, nil
+		default:
+			return nil, fmt.Errorf("udp tracker: unexpected action %d", binary.BigEndian.Uint32(response))
+		}
+	}
+}
+
+func (client *UDPTrackerClient) connectionID(host string) (uint64, bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	connection, ok := client.connections[host]
+	if !ok || time.Now().After(connection.expires) {
+		return 0, false
+	}
+	return connection.id, true
+}
+
+func (client *UDPTrackerClient) setConnectionID(host string, id uint64) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.connections[host] = udpConnectionID{id: id, expires: time.Now().Add(udpConnectionIDLifetime)}
+}
+
+func (client *UDPTrackerClient) forgetConnectionID(host string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	delete(client.connections, host)
+}
+
+func randomUint32() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}
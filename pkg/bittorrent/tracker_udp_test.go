@@ -0,0 +1,213 @@
+package bittorrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers BEP 15 requests on the loopback interface
+type fakeUDPTracker struct {
+	conn *net.UDPConn
+
+	mu           sync.Mutex
+	connects     int
+	announces    []AnnounceRequest
+	drop         int // number of packets to ignore, to test retransmission
+	connectionID uint64
+	failure      string
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &fakeUDPTracker{conn: conn, connectionID: 0x1122334455667788}
+	t.Cleanup(func() { conn.Close() })
+	go tracker.serve()
+	return tracker
+}
+
+func (tracker *fakeUDPTracker) URL() string {
+	return "udp://" + tracker.conn.LocalAddr().String() + "/announce"
+}
+
+func (tracker *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := tracker.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if response := tracker.handle(buf[:n]); response != nil {
+			tracker.conn.WriteToUDP(response, addr)
+		}
+	}
+}
+
+func (tracker *fakeUDPTracker) handle(packet []byte) []byte {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.drop > 0 {
+		tracker.drop--
+		return nil
+	}
+
+	action := binary.BigEndian.Uint32(packet[8:])
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = append(response, packet[12:16]...)
+
+	if action == udpActionConnect {
+		if binary.BigEndian.Uint64(packet) != udpTrackerProtocolID {
+			return nil
+		}
+		tracker.connects++
+		return binary.BigEndian.AppendUint64(response, tracker.connectionID)
+	}
+
+	if binary.BigEndian.Uint64(packet) != tracker.connectionID || tracker.failure != "" {
+		response := binary.BigEndian.AppendUint32(nil, udpActionError)
+		response = append(response, packet[12:16]...)
+		return append(response, tracker.failure...)
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		var req AnnounceRequest
+		copy(req.InfoHash[:], packet[16:36])
+		copy(req.PeerID[:], packet[36:56])
+		req.Downloaded = int(binary.BigEndian.Uint64(packet[56:]))
+		req.Left = int(binary.BigEndian.Uint64(packet[64:]))
+		req.Uploaded = int(binary.BigEndian.Uint64(packet[72:]))
+		req.Port = int(binary.BigEndian.Uint16(packet[96:]))
+		tracker.announces = append(tracker.announces, req)
+
+		response = binary.BigEndian.AppendUint32(response, 1800) // interval
+		response = binary.BigEndian.AppendUint32(response, 1)    // leechers
+		response = binary.BigEndian.AppendUint32(response, 2)    // seeders
+		return append(response, 10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2)
+	case udpActionScrape:
+		for i := 16; i+20 <= len(packet); i += 20 {
+			response = binary.BigEndian.AppendUint32(response, uint32(packet[i])) // seeders
+			response = binary.BigEndian.AppendUint32(response, 7)                 // completed
+			response = binary.BigEndian.AppendUint32(response, 3)                 // leechers
+		}
+		return response
+	}
+	return nil
+}
+
+func newTestUDPTrackerClient() *UDPTrackerClient {
+	client := NewUDPTrackerClient()
+	client.Timeout = 20 * time.Millisecond
+	client.MaxRetries = 3
+	return client
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	tracker := newFakeUDPTracker(t)
+	client := newTestUDPTrackerClient()
+
+	req := &AnnounceRequest{InfoHash: [20]byte{1}, PeerID: [20]byte{2}, Port: 6881, Downloaded: 10, Left: 20, Uploaded: 30}
+	for i := 0; i < 2; i++ {
+		response, err := client.Announce(context.Background(), tracker.URL(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Interval != 1800 || response.Complete != 2 || response.Incomplete != 1 || len(response.Peers) != 2 || response.Peers[1].String() != "10.0.0.2:6882" {
+			t.Errorf("unexpected response %+v", response)
+		}
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.connects != 1 {
+		t.Errorf("expected the connection id to be reused, got %d connects", tracker.connects)
+	}
+	if len(tracker.announces) != 2 || tracker.announces[0] != *req {
+		t.Errorf("unexpected announces %+v", tracker.announces)
+	}
+}
+
+func TestUDPTrackerRetransmission(t *testing.T) {
+	tracker := newFakeUDPTracker(t)
+	tracker.mu.Lock()
+	tracker.drop = 2
+	tracker.mu.Unlock()
+	client := newTestUDPTrackerClient()
+
+	if _, err := client.Announce(context.Background(), tracker.URL(), &AnnounceRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// all retransmissions are dropped
+	tracker.mu.Lock()
+	tracker.drop = 100
+	tracker.mu.Unlock()
+	start := time.Now()
+	_, err := client.Announce(context.Background(), tracker.URL(), &AnnounceRequest{})
+	if err == nil {
+		t.Fatal("expected error without response")
+	}
+	// 20ms + 40ms + 80ms + 160ms
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("retransmissions did not back off, elapsed %s", elapsed)
+	}
+}
+
+func TestUDPTrackerContextCanceled(t *testing.T) {
+	tracker := newFakeUDPTracker(t)
+	tracker.mu.Lock()
+	tracker.drop = 100
+	tracker.mu.Unlock()
+	client := NewUDPTrackerClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Announce(ctx, tracker.URL(), &AnnounceRequest{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	tracker := newFakeUDPTracker(t)
+	tracker.mu.Lock()
+	tracker.failure = "torrent not registered"
+	tracker.mu.Unlock()
+	client := newTestUDPTrackerClient()
+
+	_, err := client.Announce(context.Background(), tracker.URL(), &AnnounceRequest{})
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || trackerErr.FailureReason != "torrent not registered" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	tracker := newFakeUDPTracker(t)
+	client := newTestUDPTrackerClient()
+
+	// more hashes than fit into one request
+	hashes := make([][20]byte, udpScrapeMaxHashes+6)
+	for i := range hashes {
+		hashes[i][0] = byte(i)
+	}
+	results, err := client.Scrape(context.Background(), tracker.URL(), hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(hashes) {
+		t.Fatalf("got %d results want %d", len(results), len(hashes))
+	}
+	for i, result := range results {
+		if want := (ScrapeResult{InfoHash: hashes[i], Seeders: i, Completed: 7, Leechers: 3}); result != want {
+			t.Errorf("got %+v want %+v", result, want)
+		}
+	}
+}